@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	defaultAccessLogMaxSizeMB  = 100
+	defaultAccessLogMaxBackups = 5
+)
+
+// requestStats collects counters of a single HTTP request.
+type requestStats struct {
+	s3Requests atomic.Int64
+}
+
+type requestStatsKey struct{}
+
+func withRequestStats(ctx context.Context) (context.Context, *requestStats) {
+	stats := &requestStats{}
+	return context.WithValue(ctx, requestStatsKey{}, stats), stats
+}
+
+// countS3Request counts S3 requests made with a context of an HTTP request. Retries are counted as separate requests.
+func countS3Request(r *request.Request) {
+	if stats, ok := r.Context().Value(requestStatsKey{}).(*requestStats); ok {
+		stats.s3Requests.Add(1)
+	}
+}
+
+// RotatingFile is a log file rotated when it grows larger than the maximum size.
+// Rotated files get numeric suffixes, the oldest files are removed.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// renamed is set when f was renamed to a backup, but a new log file couldn't be opened.
+	renamed bool
+	// rotateFailed is set after a failed rotation, so that repeated failures are logged once.
+	rotateFailed bool
+}
+
+func OpenRotatingFile(p string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:       p,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+func (rf *RotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", rf.path, n)
+}
+
+// rotate renames the log file to the first backup and opens a new log file.
+// When it fails, writes continue to the current file, which can already be renamed.
+func (rf *RotatingFile) rotate() error {
+	if !rf.renamed {
+		os.Remove(rf.backupPath(rf.maxBackups))
+		for n := rf.maxBackups - 1; n > 0; n-- {
+			os.Rename(rf.backupPath(n), rf.backupPath(n+1))
+		}
+		if err := os.Rename(rf.path, rf.backupPath(1)); err != nil {
+			return err
+		}
+		rf.renamed = true
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.renamed = false
+	return old.Close()
+}
+
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			if !rf.rotateFailed {
+				slog.Error("failed rotating log file", slog.Any("err", err), slog.String("path", rf.path))
+				rf.rotateFailed = true
+			}
+			// Retry after another maxSize bytes instead of on every write.
+			rf.size = 0
+		} else {
+			rf.rotateFailed = false
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
+
+// accessLogResponseWriter records the status code and the size of the response.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying response writer.
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// AccessLogger logs every HTTP request after it completes.
+type AccessLogger struct {
+	logger     *slog.Logger
+	level      slog.Level
+	userHeader string
+	file       *RotatingFile
+}
+
+// NewAccessLogger creates an access logger writing to the configured file or to stderr.
+// The user name is taken from the user header set by a reverse proxy.
+func NewAccessLogger(cfg AccessLogConfig, userHeader string) (*AccessLogger, error) {
+	l := &AccessLogger{
+		level:      cfg.Level,
+		userHeader: userHeader,
+	}
+	var out io.Writer = os.Stderr
+	if cfg.File != "" {
+		maxSize := cfg.MaxSizeMB
+		if maxSize <= 0 {
+			maxSize = defaultAccessLogMaxSizeMB
+		}
+		maxBackups := cfg.MaxBackups
+		if maxBackups <= 0 {
+			maxBackups = defaultAccessLogMaxBackups
+		}
+		f, err := OpenRotatingFile(cfg.File, int64(maxSize)<<20, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+		out = f
+	}
+	opts := &slog.HandlerOptions{Level: cfg.Level}
+	if cfg.Format == "json" {
+		l.logger = slog.New(slog.NewJSONHandler(out, opts))
+	} else {
+		l.logger = slog.New(slog.NewTextHandler(out, opts))
+	}
+	return l, nil
+}
+
+// Close closes the log file.
+func (l *AccessLogger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// remoteIP returns the IP address of the client that made the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Handler logs requests served by the handler.
+func (l *AccessLogger) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, stats := withRequestStats(r.Context())
+		lw := &accessLogResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r.WithContext(ctx))
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("bytes", lw.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", remoteIP(r)),
+		}
+		if l.userHeader != "" {
+			attrs = append(attrs, slog.String("user", proxyUser(r, l.userHeader)))
+		}
+		attrs = append(attrs, slog.Int64("s3_requests", stats.s3Requests.Load()))
+		l.logger.LogAttrs(ctx, l.level, "request", attrs...)
+	})
+}
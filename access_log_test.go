@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogger(t *testing.T) {
+	store := newTestStorage(t, "test")
+
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLogger(AccessLogConfig{Format: "json", Level: slog.LevelWarn, File: logPath}, "Remote-User")
+	require.NoError(t, err)
+	defer l.Close()
+	proxies, err := NewTrustedProxies([]string{"192.0.2.1"})
+	require.NoError(t, err)
+	h := proxies.Handler(l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := store.WithContext(r.Context())
+		s.FileSize("a.mp3")
+		s.FileSize("b.mp3")
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "hello")
+	})))
+	req := httptest.NewRequest(http.MethodGet, "/library/foo", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Remote-User", "alice")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Requests made without a request context aren't counted.
+	store.FileSize("c.mp3")
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(data, &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "GET", record["method"])
+	assert.Equal(t, "/library/foo", record["path"])
+	assert.Equal(t, float64(http.StatusTeapot), record["status"])
+	assert.Equal(t, float64(5), record["bytes"])
+	assert.Equal(t, "192.0.2.1", record["remote_ip"])
+	assert.Equal(t, "alice", record["user"])
+	assert.Equal(t, float64(2), record["s3_requests"])
+	assert.Contains(t, record, "duration")
+}
+
+func TestRotatingFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "access.log")
+	rf, err := OpenRotatingFile(p, 10, 2)
+	require.NoError(t, err)
+	for _, s := range []string{"aaaaaa", "bbbbbb", "cccc", "dddddd", "eeeeee"} {
+		_, err := rf.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	require.NoError(t, rf.Close())
+
+	read := func(p string) string {
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, "eeeeee", read(p))
+	assert.Equal(t, "dddddd", read(p+".1"))
+	assert.Equal(t, "bbbbbbcccc", read(p+".2"))
+	_, err = os.Stat(p + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Appends to an existing file.
+	rf, err = OpenRotatingFile(p, 10, 2)
+	require.NoError(t, err)
+	_, err = rf.Write([]byte("ff"))
+	require.NoError(t, err)
+	require.NoError(t, rf.Close())
+	assert.Equal(t, "eeeeeeff", read(p))
+	assert.True(t, strings.HasPrefix(read(p+".1"), "dddddd"))
+}
+
+func TestRotatingFile_RotateError(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "access.log")
+	// A non-empty directory in place of the backup can't be replaced.
+	require.NoError(t, os.MkdirAll(filepath.Join(p+".1", "dir"), 0o755))
+	rf, err := OpenRotatingFile(p, 10, 1)
+	require.NoError(t, err)
+	for _, s := range []string{"aaaaaa", "bbbbbb", "cccc"} {
+		_, err := rf.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	data, err := os.ReadFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaabbbbbbcccc", string(data))
+
+	// Rotation is retried after another maxSize bytes.
+	require.NoError(t, os.RemoveAll(p+".1"))
+	_, err = rf.Write([]byte("dddddd"))
+	require.NoError(t, err)
+	require.NoError(t, rf.Close())
+	data, err = os.ReadFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, "dddddd", string(data))
+	data, err = os.ReadFile(p + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaabbbbbbcccc", string(data))
+}
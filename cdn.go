@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+// CDNSigner builds URLs of objects served by a CDN in front of the bucket.
+// Without a key pair, URLs are public and unsigned.
+type CDNSigner struct {
+	base     *url.URL
+	signer   *sign.URLSigner
+	custom   bool
+	sourceIP string
+}
+
+// NewCDNSigner creates a URL signer for the CDN. The private key is loaded from the configured file.
+func NewCDNSigner(cfg CDNConfig) (*CDNSigner, error) {
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &CDNSigner{
+		base:     base,
+		custom:   cfg.Policy == "custom",
+		sourceIP: cfg.SourceIP,
+	}
+	if cfg.KeyPairID != "" {
+		var key *rsa.PrivateKey
+		key, err = sign.LoadPEMPrivKeyFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cdn private_key_file: %w", err)
+		}
+		c.signer = sign.NewURLSigner(cfg.KeyPairID, key)
+	}
+	return c, nil
+}
+
+// URL returns the URL of the object with the S3 key. Signed URLs expire at the given time.
+func (c *CDNSigner) URL(key string, expires time.Time) (string, error) {
+	u := *c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = ""
+	if c.signer == nil {
+		return u.String(), nil
+	}
+	if !c.custom {
+		return c.signer.Sign(u.String(), expires)
+	}
+	policy := &sign.Policy{
+		Statements: []sign.Statement{{
+			Resource: u.String(),
+			Condition: sign.Condition{
+				DateLessThan: sign.NewAWSEpochTime(expires),
+			},
+		}},
+	}
+	if c.sourceIP != "" {
+		policy.Statements[0].Condition.IPAddress = &sign.IPAddress{SourceIP: c.sourceIP}
+	}
+	return c.signer.SignWithPolicy(u.String(), policy)
+}
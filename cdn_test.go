@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestRSAKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := filepath.Join(t.TempDir(), "cdn.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(p, data, 0o600))
+	return p
+}
+
+// decodeCloudFrontPolicy decodes a custom policy using the CloudFront variant of base64.
+func decodeCloudFrontPolicy(t *testing.T, s string) string {
+	t.Helper()
+	s = strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s)
+	b, err := base64.StdEncoding.DecodeString(s)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestCDNSigner(t *testing.T) {
+	keyFile := writeTestRSAKey(t)
+	expires := time.Unix(1700000000, 0)
+
+	// Public URLs aren't signed.
+	c, err := NewCDNSigner(CDNConfig{BaseURL: "https://cdn.example/media/"})
+	require.NoError(t, err)
+	u, err := c.URL("music/a b#1.mp3", expires)
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.example/media/music/a%20b%231.mp3", u)
+
+	c, err = NewCDNSigner(CDNConfig{BaseURL: "https://cdn.example", KeyPairID: "K1", PrivateKeyFile: keyFile})
+	require.NoError(t, err)
+	u, err = c.URL("music/a.mp3", expires)
+	require.NoError(t, err)
+	parsed, err := url.Parse(u)
+	require.NoError(t, err)
+	assert.Equal(t, "/music/a.mp3", parsed.Path)
+	assert.Equal(t, "1700000000", parsed.Query().Get("Expires"))
+	assert.Equal(t, "K1", parsed.Query().Get("Key-Pair-Id"))
+	assert.NotEmpty(t, parsed.Query().Get("Signature"))
+	assert.Empty(t, parsed.Query().Get("Policy"))
+
+	c, err = NewCDNSigner(CDNConfig{BaseURL: "https://cdn.example", KeyPairID: "K1", PrivateKeyFile: keyFile, Policy: "custom", SourceIP: "192.0.2.0/24"})
+	require.NoError(t, err)
+	u, err = c.URL("music/a.mp3", expires)
+	require.NoError(t, err)
+	parsed, err = url.Parse(u)
+	require.NoError(t, err)
+	assert.Empty(t, parsed.Query().Get("Expires"))
+	assert.NotEmpty(t, parsed.Query().Get("Signature"))
+	policy := decodeCloudFrontPolicy(t, parsed.Query().Get("Policy"))
+	assert.Contains(t, policy, `"Resource":"https://cdn.example/music/a.mp3"`)
+	assert.Contains(t, policy, `"AWS:SourceIp":"192.0.2.0/24"`)
+	assert.Contains(t, policy, `"AWS:EpochTime":1700000000`)
+
+	_, err = NewCDNSigner(CDNConfig{BaseURL: "https://cdn.example", KeyPairID: "K1", PrivateKeyFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+}
+
+func TestS3Storage_FileContentURLCDN(t *testing.T) {
+	cfg, closeS3 := newTestS3Config()
+	defer closeS3()
+	cfg.BasePrefix = "music/"
+	cfg.CDN = &CDNConfig{BaseURL: "https://cdn.example"}
+	s, err := NewS3Storage(cfg)
+	require.NoError(t, err)
+	_, err = s.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("test")})
+	require.NoError(t, err)
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Body:   strings.NewReader("1"),
+		Bucket: aws.String("test"),
+		Key:    aws.String("music/a.mp3"),
+	})
+	require.NoError(t, err)
+
+	u, err := s.FileContentURL("a.mp3")
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.example/music/a.mp3", u)
+
+	_, err = s.FileContentURL("b.mp3")
+	assert.Error(t, err)
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 
@@ -23,7 +28,9 @@ func (d *Duration) UnmarshalText(data []byte) error {
 type S3Credentials struct {
 	ID     string
 	Secret string
-	Token  string
+	// SecretFile is a path to a file with the secret, e.g. a mounted container secret.
+	SecretFile string `toml:"secret_file"`
+	Token      string
 }
 
 type S3Config struct {
@@ -33,39 +40,373 @@ type S3Config struct {
 	BasePrefix           string   `toml:"base_prefix"`
 	RequestPresignExpiry Duration `toml:"request_presign_expiry"`
 	ForcePathStyle       bool     `toml:"force_path_style"`
+	PlaylistsPrefix      string   `toml:"playlists_prefix"`
+	PositionsPrefix      string   `toml:"positions_prefix"`
 	Credentials          *S3Credentials
+	// Profile is a named profile from the shared AWS config and credentials files.
+	Profile string
+	// WebIdentityTokenFile is a path to an OIDC token exchanged for credentials of the AssumeRoleARN role.
+	WebIdentityTokenFile string `toml:"web_identity_token_file"`
+	// AssumeRoleARN is a role assumed with the credentials above. S3 is accessed with the role credentials.
+	AssumeRoleARN         string  `toml:"assume_role_arn"`
+	AssumeRoleExternalID  string  `toml:"assume_role_external_id"`
+	AssumeRoleSessionName string  `toml:"assume_role_session_name"`
+	STSEndpoint           *string `toml:"sts_endpoint"`
+	// CDN serves streams instead of presigned S3 URLs.
+	CDN *CDNConfig `toml:"cdn"`
+}
+
+// CDNConfig is a CDN in front of the bucket. Object keys are appended to the base URL.
+type CDNConfig struct {
+	BaseURL string `toml:"base_url"`
+	// KeyPairID and PrivateKeyFile sign CloudFront URLs. URLs aren't signed without them.
+	KeyPairID      string `toml:"key_pair_id"`
+	PrivateKeyFile string `toml:"private_key_file"`
+	// Policy is "canned" or "custom". Custom policies can restrict the source IP address.
+	Policy   string `toml:"policy"`
+	SourceIP string `toml:"source_ip"`
+}
+
+// LibraryConfig is a named library with its own S3 location.
+type LibraryConfig struct {
+	// Name is the top-level directory of the library.
+	Name string
+	S3   S3Config
+}
+
+type ServerConfig struct {
+	// UserHeader is a request header with the name of the user authenticated by a reverse proxy.
+	// It's only used on requests from TrustedProxies.
+	UserHeader string `toml:"user_header"`
+	// ShareSecret is the key signing share links. Sharing is disabled when it's empty.
+	ShareSecret string `toml:"share_secret"`
+	// BasePath is the URL path all routes are served under, e.g. "/music" for https://example.com/music/.
+	BasePath string `toml:"base_path"`
+	// TrustedProxies are CIDRs or IP addresses of reverse proxies allowed to set forwarding headers.
+	TrustedProxies []string `toml:"trusted_proxies"`
+	// Timeouts and limits of the HTTP server. Zero values are replaced with defaults.
+	ReadTimeout       Duration `toml:"read_timeout"`
+	ReadHeaderTimeout Duration `toml:"read_header_timeout"`
+	WriteTimeout      Duration `toml:"write_timeout"`
+	IdleTimeout       Duration `toml:"idle_timeout"`
+	MaxHeaderBytes    int      `toml:"max_header_bytes"`
+	MaxBodyBytes      int64    `toml:"max_body_bytes"`
+	// ShutdownTimeout is how long requests in progress can take to finish on shutdown.
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+}
+
+// TLSConfig enables HTTPS. Certificate and key files are reloaded when they change.
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// ClientCAFile is a PEM bundle of CAs. When it's set, clients must present a certificate signed by one of them.
+	ClientCAFile string `toml:"client_ca_file"`
+	// RedirectAddr is the address of a plain HTTP listener redirecting to HTTPS, e.g. ":80".
+	RedirectAddr string `toml:"redirect_addr"`
+}
+
+// Enabled returns whether HTTPS is configured.
+func (cfg TLSConfig) Enabled() bool {
+	return cfg.CertFile != ""
+}
+
+// AccessLogConfig enables logging of HTTP requests.
+type AccessLogConfig struct {
+	Enabled bool
+	// Format is "text" or "json". The default is "text".
+	Format string
+	// Level is the level of access log records. The default is "info".
+	Level slog.Level
+	// File is the path of the log file. By default, requests are logged to stderr.
+	File string
+	// MaxSizeMB is the size of the log file in megabytes at which it's rotated. The default is 100.
+	MaxSizeMB int `toml:"max_size_mb"`
+	// MaxBackups is the number of rotated files kept. The default is 5.
+	MaxBackups int `toml:"max_backups"`
+}
+
+type AudiobooksConfig struct {
+	// Prefixes are library paths where all directories are treated as audiobooks.
+	Prefixes []string
+}
+
+// CoverRule scores images matching the name, the glob or the regex as album covers.
+// Rules match lowercase file names without the extension.
+type CoverRule struct {
+	Name  string
+	Glob  string
+	Regex string
+	Score int
+}
+
+// MediaConfig overrides media detection rules. Empty rules keep their defaults.
+type MediaConfig struct {
+	AudioExtensions []string    `toml:"audio_extensions"`
+	ImageExtensions []string    `toml:"image_extensions"`
+	Covers          []CoverRule `toml:"cover"`
+	// ArtworkDirs are names of subdirectories scanned for covers.
+	ArtworkDirs []string `toml:"artwork_dirs"`
+	// Ignore are gitignore-style patterns of files and directories hidden from listings and downloads.
+	Ignore []string
+	// IgnoreFiles enables reading ignore patterns from .bsimpignore files in directories.
+	IgnoreFiles bool `toml:"ignore_files"`
+}
+
+type UPnPConfig struct {
+	Enabled      bool
+	FriendlyName string `toml:"friendly_name"`
+	// UUID identifies the device on the network. By default, it's derived from the host name.
+	UUID string
+}
+
+type MPDConfig struct {
+	Enabled bool
+	// Address is the TCP address of the MPD protocol listener. The default is "127.0.0.1:6600".
+	Address string
+	// Password is required from clients before they can run commands other than ping and password.
+	Password string
+}
+
+type TranscodingConfig struct {
+	// Enabled turns on HLS streaming. It requires ffmpeg and ffprobe.
+	Enabled bool
+	// FFmpeg and FFprobe are paths to the executables. By default, they're looked up in PATH.
+	FFmpeg          string `toml:"ffmpeg"`
+	FFprobe         string `toml:"ffprobe"`
+	Bitrate         string
+	SegmentDuration Duration `toml:"segment_duration"`
+	// MaxProcesses limits concurrent ffmpeg and ffprobe processes. Requests over the limit are rejected.
+	MaxProcesses int `toml:"max_processes"`
 }
 
 type Config struct {
-	S3 S3Config
+	// S3 is the location of the only library. It can't be used together with Libraries.
+	S3          S3Config
+	Libraries   []LibraryConfig `toml:"library"`
+	Server      ServerConfig
+	TLS         TLSConfig       `toml:"tls"`
+	AccessLog   AccessLogConfig `toml:"access_log"`
+	Audiobooks  AudiobooksConfig
+	Media       MediaConfig
+	UPnP        UPnPConfig `toml:"upnp"`
+	MPD         MPDConfig  `toml:"mpd"`
+	Transcoding TranscodingConfig
 }
 
-var errMissingBucket = errors.New("s3 bucket is required")
+var (
+	errMissingBucket      = errors.New("s3 bucket is required")
+	errInvalidLibrary     = errors.New("library name must be a non-empty directory name")
+	errDuplicateLibrary   = errors.New("duplicate library name")
+	errS3WithLibraries    = errors.New("s3 section can't be used together with libraries")
+	errCredentialsSources = errors.New("static credentials can't be used together with a profile or a web identity token")
+	errMissingRoleARN     = errors.New("assume_role_arn is required for web identity tokens, external IDs and session names")
+	errTLSKeyPair         = errors.New("tls cert_file and key_file must be set together")
+	errTLSDisabled        = errors.New("tls cert_file is required for client_ca_file and redirect_addr")
+	errInvalidBasePath    = errors.New("server base_path must be a URL path without dot segments, a query or a fragment")
+	errAccessLogFormat    = errors.New(`access_log format must be "text" or "json"`)
+	errUserHeaderProxies  = errors.New("server user_header requires trusted_proxies")
+	errCDNBaseURL         = errors.New("cdn base_url must be an absolute http or https URL")
+	errCDNKeyPair         = errors.New("cdn key_pair_id and private_key_file must be set together")
+	errCDNPolicy          = errors.New(`cdn policy must be "canned" or "custom"`)
+	errCDNSourceIP        = errors.New("cdn source_ip requires a custom policy and must be a CIDR")
+)
+
+const (
+	defaultPresignExpiry   = Duration(2 * time.Hour)
+	defaultPlaylistsPrefix = "playlists/"
+	defaultPositionsPrefix = "positions/"
+)
 
-func newConfig(r io.Reader) (*Config, error) {
+// normalizeS3Config validates the S3 config and adds missing delimiters to prefixes.
+func normalizeS3Config(cfg *S3Config) error {
+	if cfg.Bucket == "" {
+		return errMissingBucket
+	}
+	if cfg.Credentials != nil && (cfg.Profile != "" || cfg.WebIdentityTokenFile != "") {
+		return errCredentialsSources
+	}
+	if cfg.AssumeRoleARN == "" && (cfg.WebIdentityTokenFile != "" || cfg.AssumeRoleExternalID != "" || cfg.AssumeRoleSessionName != "") {
+		return errMissingRoleARN
+	}
+	if cfg.BasePrefix != "" && !strings.HasSuffix(cfg.BasePrefix, Delimiter) {
+		cfg.BasePrefix += Delimiter
+	}
+	if cfg.PlaylistsPrefix != "" && !strings.HasSuffix(cfg.PlaylistsPrefix, Delimiter) {
+		cfg.PlaylistsPrefix += Delimiter
+	}
+	if cfg.PositionsPrefix != "" && !strings.HasSuffix(cfg.PositionsPrefix, Delimiter) {
+		cfg.PositionsPrefix += Delimiter
+	}
+	if cfg.CDN != nil {
+		return validateCDNConfig(cfg.CDN)
+	}
+	return nil
+}
+
+func validateCDNConfig(cfg *CDNConfig) error {
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return errCDNBaseURL
+	}
+	if (cfg.KeyPairID == "") != (cfg.PrivateKeyFile == "") {
+		return errCDNKeyPair
+	}
+	switch cfg.Policy {
+	case "", "canned", "custom":
+	default:
+		return errCDNPolicy
+	}
+	if cfg.SourceIP != "" {
+		if _, err := netip.ParsePrefix(cfg.SourceIP); err != nil || cfg.Policy != "custom" {
+			return errCDNSourceIP
+		}
+	}
+	return nil
+}
+
+// normalizeLibraries validates libraries and sets defaults. Unlike the s3 section, empty values are replaced with defaults.
+func normalizeLibraries(libs []LibraryConfig) error {
+	names := NewStringSet()
+	for i := range libs {
+		lib := &libs[i]
+		if lib.Name == "" || lib.Name == "." || lib.Name == ".." || strings.ContainsAny(lib.Name, "/\\") {
+			return fmt.Errorf("%w: %q", errInvalidLibrary, lib.Name)
+		}
+		if names.Contains(lib.Name) {
+			return fmt.Errorf("%w: %q", errDuplicateLibrary, lib.Name)
+		}
+		names.Add(lib.Name)
+		if lib.S3.RequestPresignExpiry == 0 {
+			lib.S3.RequestPresignExpiry = defaultPresignExpiry
+		}
+		if lib.S3.PlaylistsPrefix == "" {
+			lib.S3.PlaylistsPrefix = defaultPlaylistsPrefix
+		}
+		if lib.S3.PositionsPrefix == "" {
+			lib.S3.PositionsPrefix = defaultPositionsPrefix
+		}
+		if err := normalizeS3Config(&lib.S3); err != nil {
+			return fmt.Errorf("library %q: %w", lib.Name, err)
+		}
+	}
+	return nil
+}
+
+// newConfig parses the config and overrides its values with environment variables.
+// Environment variables take precedence over the config file, which takes precedence over defaults.
+// It returns sources of all values that aren't defaults.
+func newConfig(r io.Reader, environ []string) (*Config, ConfigSources, error) {
 	cfg := &Config{
 		S3: S3Config{
-			RequestPresignExpiry: Duration(2 * time.Hour),
+			RequestPresignExpiry: defaultPresignExpiry,
+			PlaylistsPrefix:      defaultPlaylistsPrefix,
+			PositionsPrefix:      defaultPositionsPrefix,
 		},
 	}
-	dec := toml.NewDecoder(r)
-	if err := dec.Decode(cfg); err != nil {
-		return nil, err
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := toml.Unmarshal(data, cfg); err != nil {
+		return nil, nil, err
+	}
+	var doc map[string]any
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	sources := make(ConfigSources)
+	sources.addFileKeys("", doc)
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix, "", parseEnv(environ), sources); err != nil {
+		return nil, nil, err
+	}
+	if err := resolveSecretFile(cfg.S3.Credentials, "s3.credentials", sources); err != nil {
+		return nil, nil, err
+	}
+	for i := range cfg.Libraries {
+		key := fmt.Sprintf("library.%d.s3.credentials", i)
+		if err := resolveSecretFile(cfg.Libraries[i].S3.Credentials, key, sources); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
 	}
-	if cfg.S3.Bucket == "" {
-		return nil, errMissingBucket
+	return cfg, sources, nil
+}
+
+// normalizeBasePath returns the base path with a leading slash and without a trailing slash. The root path is empty.
+func normalizeBasePath(p string) (string, error) {
+	p = strings.Trim(p, Delimiter)
+	if p == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(p, "?#\\") {
+		return "", errInvalidBasePath
 	}
-	if cfg.S3.BasePrefix != "" && !strings.HasSuffix(cfg.S3.BasePrefix, Delimiter) {
-		cfg.S3.BasePrefix += Delimiter
+	for _, segment := range strings.Split(p, Delimiter) {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", errInvalidBasePath
+		}
 	}
-	return cfg, nil
+	return Delimiter + p, nil
 }
 
-func NewConfig(path string) (*Config, error) {
+// validate checks the config and normalizes its values.
+func (cfg *Config) validate() error {
+	if len(cfg.Libraries) > 0 {
+		if cfg.S3.Bucket != "" {
+			return errS3WithLibraries
+		}
+		if err := normalizeLibraries(cfg.Libraries); err != nil {
+			return err
+		}
+	} else if err := normalizeS3Config(&cfg.S3); err != nil {
+		return err
+	}
+	basePath, err := normalizeBasePath(cfg.Server.BasePath)
+	if err != nil {
+		return err
+	}
+	cfg.Server.BasePath = basePath
+	if _, err := NewTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+	if cfg.Server.UserHeader != "" && len(cfg.Server.TrustedProxies) == 0 {
+		return errUserHeaderProxies
+	}
+	switch cfg.AccessLog.Format {
+	case "", "text", "json":
+	default:
+		return errAccessLogFormat
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return errTLSKeyPair
+	}
+	if !cfg.TLS.Enabled() && (cfg.TLS.ClientCAFile != "" || cfg.TLS.RedirectAddr != "") {
+		return errTLSDisabled
+	}
+	if _, err := NewMediaDetector(cfg.Media); err != nil {
+		return fmt.Errorf("media: %w", err)
+	}
+	if _, err := newIgnoreRules("", cfg.Media.Ignore); err != nil {
+		return fmt.Errorf("media: %w", err)
+	}
+	for i, prefix := range cfg.Audiobooks.Prefixes {
+		cfg.Audiobooks.Prefixes[i] = strings.Trim(prefix, Delimiter)
+	}
+	return nil
+}
+
+// NewConfig reads the config file and applies environment variables.
+// When the path is empty, the config comes from environment variables only.
+func NewConfig(path string) (*Config, ConfigSources, error) {
+	if path == "" {
+		return newConfig(strings.NewReader(""), os.Environ())
+	}
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
-	return newConfig(f)
+	return newConfig(f, os.Environ())
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables overriding config values.
+// Variable names are config keys in upper case joined by underscores, e.g. BSIMP_S3_BUCKET.
+// Array entries are addressed by index, e.g. BSIMP_LIBRARY_0_S3_BUCKET.
+const envPrefix = "BSIMP"
+
+// ConfigSource describes where a config value came from.
+type ConfigSource string
+
+const sourceFile ConfigSource = "file"
+
+func envSource(name string) ConfigSource {
+	return ConfigSource("env " + name)
+}
+
+func secretFileSource(p string) ConfigSource {
+	return ConfigSource("secret_file " + p)
+}
+
+func (s ConfigSource) isEnv() bool {
+	return strings.HasPrefix(string(s), "env ")
+}
+
+// ConfigSources maps dotted config keys, e.g. "s3.bucket", to sources of their values.
+// Keys with default values are absent.
+type ConfigSources map[string]ConfigSource
+
+// Keys returns config keys in alphabetical order.
+func (cs ConfigSources) Keys() []string {
+	keys := make([]string, 0, len(cs))
+	for k := range cs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// addFileKeys records keys of the decoded TOML document as set by the config file.
+func (cs ConfigSources) addFileKeys(prefix string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			cs.addFileKeys(joinKey(prefix, strings.ToLower(k)), child)
+		}
+	case []map[string]any:
+		for i, child := range v {
+			cs.addFileKeys(joinKey(prefix, strconv.Itoa(i)), child)
+		}
+	case []any:
+		if len(v) > 0 {
+			if _, ok := v[0].(map[string]any); ok {
+				for i, child := range v {
+					cs.addFileKeys(joinKey(prefix, strconv.Itoa(i)), child)
+				}
+				return
+			}
+		}
+		cs[prefix] = sourceFile
+	default:
+		cs[prefix] = sourceFile
+	}
+}
+
+func joinKey(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// parseEnv returns environment variables with the bsimp prefix.
+func parseEnv(environ []string) map[string]string {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(k, envPrefix+"_") {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func hasEnvPrefix(env map[string]string, prefix string) bool {
+	for k := range env {
+		if strings.HasPrefix(k, prefix+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// tomlName returns the config key of the struct field.
+func tomlName(f reflect.StructField) string {
+	if tag, _, _ := strings.Cut(f.Tag.Get("toml"), ","); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// applyEnv overrides fields of the config struct with environment variables.
+func applyEnv(v reflect.Value, envName string, key string, env map[string]string, sources ConfigSources) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := tomlName(f)
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		err := applyEnvValue(v.Field(i), envName+"_"+strings.ToUpper(name), joinKey(key, name), env, sources)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func applyEnvValue(v reflect.Value, envName string, key string, env map[string]string, sources ConfigSources) error {
+	t := v.Type()
+	switch {
+	case t.Kind() == reflect.Struct:
+		return applyEnv(v, envName, key, env, sources)
+	case t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct:
+		if !hasEnvPrefix(env, envName) {
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return applyEnv(v.Elem(), envName, key, env, sources)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct:
+		// Variables can add entries after the ones from the config file.
+		n := v.Len()
+		for hasEnvPrefix(env, envName+"_"+strconv.Itoa(n)) {
+			n++
+		}
+		if n > v.Len() {
+			grown := reflect.MakeSlice(t, n, n)
+			reflect.Copy(grown, v)
+			v.Set(grown)
+		}
+		for i := 0; i < n; i++ {
+			idx := strconv.Itoa(i)
+			if err := applyEnv(v.Index(i), envName+"_"+idx, joinKey(key, idx), env, sources); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	s, ok := env[envName]
+	if !ok {
+		return nil
+	}
+	if err := setEnvValue(v, s); err != nil {
+		return fmt.Errorf("%s: %w", envName, err)
+	}
+	sources[key] = envSource(envName)
+	return nil
+}
+
+func setEnvValue(v reflect.Value, s string) error {
+	if reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := setEnvValue(elem.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		// Lists are comma-separated.
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+var errSecretAndSecretFile = errors.New("secret and secret_file can't be set together")
+
+// resolveSecretFile reads the secret from the secret file. A value from the environment takes precedence
+// over a value from the config file, setting both the secret and the secret file in the same place is an error.
+func resolveSecretFile(creds *S3Credentials, key string, sources ConfigSources) error {
+	if creds == nil || creds.SecretFile == "" {
+		return nil
+	}
+	secretKey, fileKey := joinKey(key, "secret"), joinKey(key, "secret_file")
+	if creds.Secret != "" {
+		if sources[secretKey].isEnv() == sources[fileKey].isEnv() {
+			return fmt.Errorf("%s: %w", key, errSecretAndSecretFile)
+		}
+		if sources[secretKey].isEnv() {
+			return nil
+		}
+	}
+	data, err := os.ReadFile(creds.SecretFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileKey, err)
+	}
+	creds.Secret = strings.TrimSpace(string(data))
+	sources[secretKey] = secretFileSource(creds.SecretFile)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Env(t *testing.T) {
+	in := `[s3]
+		   bucket = "foo"
+		   region = "us-east-1"
+		   [server]
+		   user_header = "Remote-User"
+		   trusted_proxies = ["127.0.0.1"]`
+	env := []string{
+		"BSIMP_S3_BUCKET=bar",
+		"BSIMP_S3_ENDPOINT=http://localhost:9000",
+		"BSIMP_S3_FORCE_PATH_STYLE=true",
+		"BSIMP_S3_REQUEST_PRESIGN_EXPIRY=1h",
+		"BSIMP_S3_CREDENTIALS_ID=id",
+		"BSIMP_S3_CREDENTIALS_SECRET=secret",
+		"BSIMP_AUDIOBOOKS_PREFIXES=Audiobooks, Lectures",
+		"BSIMP_MPD_ENABLED=1",
+		"HOME=/root",
+	}
+	cfg, sources, err := newConfig(strings.NewReader(in), env)
+	require.NoError(t, err)
+	assert.Equal(t, "bar", cfg.S3.Bucket)
+	assert.Equal(t, "us-east-1", *cfg.S3.Region)
+	assert.Equal(t, "http://localhost:9000", *cfg.S3.Endpoint)
+	assert.True(t, cfg.S3.ForcePathStyle)
+	assert.Equal(t, Duration(time.Hour), cfg.S3.RequestPresignExpiry)
+	assert.Equal(t, &S3Credentials{ID: "id", Secret: "secret"}, cfg.S3.Credentials)
+	assert.Equal(t, []string{"Audiobooks", "Lectures"}, cfg.Audiobooks.Prefixes)
+	assert.True(t, cfg.MPD.Enabled)
+	assert.Equal(t, "Remote-User", cfg.Server.UserHeader)
+
+	assert.Equal(t, ConfigSource("env BSIMP_S3_BUCKET"), sources["s3.bucket"])
+	assert.Equal(t, sourceFile, sources["s3.region"])
+	assert.Equal(t, sourceFile, sources["server.user_header"])
+	assert.Equal(t, ConfigSource("env BSIMP_S3_CREDENTIALS_SECRET"), sources["s3.credentials.secret"])
+	_, ok := sources["s3.playlists_prefix"]
+	assert.False(t, ok)
+	assert.Equal(t, []string{
+		"audiobooks.prefixes",
+		"mpd.enabled",
+		"s3.bucket",
+		"s3.credentials.id",
+		"s3.credentials.secret",
+		"s3.endpoint",
+		"s3.force_path_style",
+		"s3.region",
+		"s3.request_presign_expiry",
+		"server.trusted_proxies",
+		"server.user_header",
+	}, sources.Keys())
+}
+
+func TestConfig_EnvLibraries(t *testing.T) {
+	in := `[[library]]
+		   name = "Music"
+		   [library.s3]
+		   bucket = "music"`
+	env := []string{
+		"BSIMP_LIBRARY_0_S3_BASE_PREFIX=Music",
+		"BSIMP_LIBRARY_1_NAME=Audiobooks",
+		"BSIMP_LIBRARY_1_S3_BUCKET=books",
+	}
+	cfg, sources, err := newConfig(strings.NewReader(in), env)
+	require.NoError(t, err)
+	require.Len(t, cfg.Libraries, 2)
+	assert.Equal(t, "Music", cfg.Libraries[0].Name)
+	assert.Equal(t, "Music/", cfg.Libraries[0].S3.BasePrefix)
+	assert.Equal(t, "Audiobooks", cfg.Libraries[1].Name)
+	assert.Equal(t, "books", cfg.Libraries[1].S3.Bucket)
+	assert.Equal(t, sourceFile, sources["library.0.s3.bucket"])
+	assert.Equal(t, ConfigSource("env BSIMP_LIBRARY_1_S3_BUCKET"), sources["library.1.s3.bucket"])
+
+	// Environment variables alone are enough.
+	cfg, _, err = newConfig(strings.NewReader(""), []string{"BSIMP_S3_BUCKET=foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", cfg.S3.Bucket)
+}
+
+func TestConfig_EnvErrors(t *testing.T) {
+	for _, env := range []string{
+		"BSIMP_MPD_ENABLED=maybe",
+		"BSIMP_S3_REQUEST_PRESIGN_EXPIRY=soon",
+	} {
+		_, _, err := newConfig(strings.NewReader(`[s3]
+			bucket = "foo"`), []string{env})
+		if assert.Error(t, err, env) {
+			name, _, _ := strings.Cut(env, "=")
+			assert.Contains(t, err.Error(), name)
+		}
+	}
+}
+
+func TestConfig_SecretFile(t *testing.T) {
+	secretPath := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretPath, []byte("file-secret\n"), 0o600))
+
+	in := `[s3]
+		   bucket = "foo"
+		   [s3.credentials]
+		   id = "id"
+		   secret_file = "` + secretPath + `"`
+	cfg, sources, err := newConfig(strings.NewReader(in), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "file-secret", cfg.S3.Credentials.Secret)
+	assert.Equal(t, ConfigSource("secret_file "+secretPath), sources["s3.credentials.secret"])
+
+	// A secret from the environment takes precedence over a secret file from the config file.
+	cfg, _, err = newConfig(strings.NewReader(in), []string{"BSIMP_S3_CREDENTIALS_SECRET=env-secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "env-secret", cfg.S3.Credentials.Secret)
+
+	// A secret file from the environment takes precedence over a secret from the config file.
+	in = `[s3]
+		  bucket = "foo"
+		  [s3.credentials]
+		  id = "id"
+		  secret = "toml-secret"`
+	cfg, _, err = newConfig(strings.NewReader(in), []string{"BSIMP_S3_CREDENTIALS_SECRET_FILE=" + secretPath})
+	require.NoError(t, err)
+	assert.Equal(t, "file-secret", cfg.S3.Credentials.Secret)
+
+	// Both in the same source.
+	_, _, err = newConfig(strings.NewReader(in+"\nsecret_file = \""+secretPath+"\""), nil)
+	assert.ErrorIs(t, err, errSecretAndSecretFile)
+
+	_, _, err = newConfig(strings.NewReader(""), []string{
+		"BSIMP_S3_BUCKET=foo",
+		"BSIMP_S3_CREDENTIALS_SECRET_FILE=" + filepath.Join(t.TempDir(), "missing"),
+	})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"strings"
 	"testing"
 	"time"
@@ -30,6 +31,8 @@ func TestConfig(t *testing.T) {
 				S3: S3Config{
 					Bucket:               "foo",
 					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
 				},
 			},
 		},
@@ -41,14 +44,434 @@ func TestConfig(t *testing.T) {
 				S3: S3Config{
 					Bucket:               "foo",
 					RequestPresignExpiry: Duration(time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
 				},
 			},
 		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 playlists_prefix = "bsimp/playlists"`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "bsimp/playlists/",
+					PositionsPrefix:      "positions/",
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [server]
+				 user_header = "Remote-User"
+				 trusted_proxies = ["127.0.0.1"]
+				 share_secret = "secret"
+				 [audiobooks]
+				 prefixes = ["/Audiobooks/", "Lectures"]`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				Server: ServerConfig{
+					UserHeader:     "Remote-User",
+					TrustedProxies: []string{"127.0.0.1"},
+					ShareSecret:    "secret",
+				},
+				Audiobooks: AudiobooksConfig{
+					Prefixes: []string{"Audiobooks", "Lectures"},
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [mpd]
+				 enabled = true
+				 address = "localhost:6600"
+				 password = "secret"`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				MPD: MPDConfig{
+					Enabled:  true,
+					Address:  "localhost:6600",
+					Password: "secret",
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [transcoding]
+				 enabled = true
+				 ffmpeg = "/usr/bin/ffmpeg"
+				 segment_duration = "6s"`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				Transcoding: TranscodingConfig{
+					Enabled:         true,
+					FFmpeg:          "/usr/bin/ffmpeg",
+					SegmentDuration: Duration(6 * time.Second),
+				},
+			},
+		},
+		{
+			in: `[[library]]
+				 name = "Music"
+				 [library.s3]
+				 bucket = "music"
+				 base_prefix = "Music"
+				 [[library]]
+				 name = "Audiobooks"
+				 [library.s3]
+				 bucket = "books"
+				 endpoint = "https://s3.example.com"
+				 [audiobooks]
+				 prefixes = ["Audiobooks"]`,
+			expected: &Config{
+				S3: S3Config{
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				Libraries: []LibraryConfig{
+					{
+						Name: "Music",
+						S3: S3Config{
+							Bucket:               "music",
+							BasePrefix:           "Music/",
+							RequestPresignExpiry: Duration(2 * time.Hour),
+							PlaylistsPrefix:      "playlists/",
+							PositionsPrefix:      "positions/",
+						},
+					},
+					{
+						Name: "Audiobooks",
+						S3: S3Config{
+							Endpoint:             stringPtr("https://s3.example.com"),
+							Bucket:               "books",
+							RequestPresignExpiry: Duration(2 * time.Hour),
+							PlaylistsPrefix:      "playlists/",
+							PositionsPrefix:      "positions/",
+						},
+					},
+				},
+				Audiobooks: AudiobooksConfig{
+					Prefixes: []string{"Audiobooks"},
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [[library]]
+				 name = "Music"
+				 [library.s3]
+				 bucket = "music"`,
+			err: "s3 section can't be used together with libraries",
+		},
+		{
+			in: `[[library]]
+				 name = "Music"`,
+			err: `library "Music": s3 bucket is required`,
+		},
+		{
+			in: `[[library]]
+				 name = "Music/Rock"
+				 [library.s3]
+				 bucket = "music"`,
+			err: "library name must be a non-empty directory name",
+		},
+		{
+			in: `[[library]]
+				 name = "Music"
+				 [library.s3]
+				 bucket = "music"
+				 [[library]]
+				 name = "Music"
+				 [library.s3]
+				 bucket = "music2"`,
+			err: "duplicate library name",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [media]
+				 audio_extensions = ["mp3", "opus"]
+				 artwork_dirs = ["Booklet"]
+				 ignore = [".DS_Store", "*.log"]
+				 [[media.cover]]
+				 glob = "*front*"
+				 score = 2
+				 [[media.cover]]
+				 regex = "^back$"
+				 score = -1`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				Media: MediaConfig{
+					AudioExtensions: []string{"mp3", "opus"},
+					Covers: []CoverRule{
+						{Glob: "*front*", Score: 2},
+						{Regex: "^back$", Score: -1},
+					},
+					ArtworkDirs: []string{"Booklet"},
+					Ignore:      []string{".DS_Store", "*.log"},
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [[media.cover]]
+				 regex = "(front"`,
+			err: "media: cover regex",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [media]
+				 ignore = ["[abc"]`,
+			err: "media: ignore pattern",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 web_identity_token_file = "/var/run/secrets/token"
+				 assume_role_arn = "arn:aws:iam::123456789012:role/bsimp"
+				 assume_role_session_name = "bsimp-pod"`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:                "foo",
+					RequestPresignExpiry:  Duration(2 * time.Hour),
+					PlaylistsPrefix:       "playlists/",
+					PositionsPrefix:       "positions/",
+					WebIdentityTokenFile:  "/var/run/secrets/token",
+					AssumeRoleARN:         "arn:aws:iam::123456789012:role/bsimp",
+					AssumeRoleSessionName: "bsimp-pod",
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 web_identity_token_file = "/var/run/secrets/token"`,
+			err: "assume_role_arn is required",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 profile = "music"
+				 [s3.credentials]
+				 id = "id"`,
+			err: "static credentials can't be used together with a profile",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [tls]
+				 cert_file = "cert.pem"
+				 key_file = "key.pem"
+				 client_ca_file = "ca.pem"
+				 redirect_addr = ":80"`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				TLS: TLSConfig{
+					CertFile:     "cert.pem",
+					KeyFile:      "key.pem",
+					ClientCAFile: "ca.pem",
+					RedirectAddr: ":80",
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [server]
+				 base_path = "music/"`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				Server: ServerConfig{
+					BasePath: "/music",
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [server]
+				 base_path = "/music/../admin"`,
+			err: "server base_path must be a URL path",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [server]
+				 trusted_proxies = ["127.0.0.1", "10.0.0.0/8", "::1"]`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				Server: ServerConfig{
+					TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8", "::1"},
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [server]
+				 trusted_proxies = ["localhost"]`,
+			err: `server: trusted proxy "localhost"`,
+		},
+		{
+			in: `[[library]]
+				 name = "Music"
+				 [library.s3]
+				 bucket = "foo"
+				 [library.s3.cdn]
+				 base_url = "https://cdn.example"
+				 key_pair_id = "K1"
+				 private_key_file = "/etc/bsimp/cdn.pem"
+				 policy = "custom"
+				 source_ip = "192.0.2.0/24"`,
+			expected: &Config{
+				S3: S3Config{
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				Libraries: []LibraryConfig{
+					{
+						Name: "Music",
+						S3: S3Config{
+							Bucket:               "foo",
+							RequestPresignExpiry: Duration(2 * time.Hour),
+							PlaylistsPrefix:      "playlists/",
+							PositionsPrefix:      "positions/",
+							CDN: &CDNConfig{
+								BaseURL:        "https://cdn.example",
+								KeyPairID:      "K1",
+								PrivateKeyFile: "/etc/bsimp/cdn.pem",
+								Policy:         "custom",
+								SourceIP:       "192.0.2.0/24",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [server]
+				 user_header = "Remote-User"`,
+			err: "server user_header requires trusted_proxies",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [s3.cdn]
+				 base_url = "cdn.example"`,
+			err: "cdn base_url must be an absolute http or https URL",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [s3.cdn]
+				 base_url = "https://cdn.example"
+				 key_pair_id = "K1"`,
+			err: "cdn key_pair_id and private_key_file must be set together",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [s3.cdn]
+				 base_url = "https://cdn.example"
+				 source_ip = "192.0.2.0/24"`,
+			err: "cdn source_ip requires a custom policy",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [access_log]
+				 enabled = true
+				 format = "json"
+				 level = "debug"
+				 file = "/var/log/bsimp/access.log"`,
+			expected: &Config{
+				S3: S3Config{
+					Bucket:               "foo",
+					RequestPresignExpiry: Duration(2 * time.Hour),
+					PlaylistsPrefix:      "playlists/",
+					PositionsPrefix:      "positions/",
+				},
+				AccessLog: AccessLogConfig{
+					Enabled: true,
+					Format:  "json",
+					Level:   slog.LevelDebug,
+					File:    "/var/log/bsimp/access.log",
+				},
+			},
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [access_log]
+				 format = "xml"`,
+			err: "access_log format",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [tls]
+				 cert_file = "cert.pem"`,
+			err: "tls cert_file and key_file must be set together",
+		},
+		{
+			in: `[s3]
+				 bucket = "foo"
+				 [tls]
+				 redirect_addr = ":80"`,
+			err: "tls cert_file is required",
+		},
 	}
 
 	for i, tc := range testCases {
 		t.Run(fmt.Sprintf("case %d", i), func(st *testing.T) {
-			cfg, err := newConfig(strings.NewReader(tc.in))
+			cfg, _, err := newConfig(strings.NewReader(tc.in), nil)
 			if tc.err != "" {
 				assert.Contains(st, err.Error(), tc.err)
 			} else {
@@ -58,3 +481,7 @@ func TestConfig(t *testing.T) {
 		})
 	}
 }
+
+func stringPtr(s string) *string {
+	return &s
+}
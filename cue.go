@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CueTrack is a virtual track within a single audio file described by a CUE sheet.
+type CueTrack struct {
+	Number    int
+	Title     string
+	Performer string
+	Start     time.Duration
+	// End is zero for the last track in a file, meaning the track lasts until the end of the file.
+	End time.Duration
+}
+
+// StartSeconds returns the track start offset in seconds.
+func (t *CueTrack) StartSeconds() float64 {
+	return t.Start.Seconds()
+}
+
+// EndSeconds returns the track end offset in seconds, or zero if the track lasts until the end of the file.
+func (t *CueTrack) EndSeconds() float64 {
+	return t.End.Seconds()
+}
+
+// CueFile is an audio file referenced by a CUE sheet.
+type CueFile struct {
+	Name   string
+	Tracks []*CueTrack
+}
+
+// CueSheet is a parsed CUE sheet.
+type CueSheet struct {
+	Title     string
+	Performer string
+	Files     []*CueFile
+}
+
+// cueFramesPerSecond is the number of CD frames in a second used by CUE timestamps.
+const cueFramesPerSecond = 75
+
+// parseCueTime parses a mm:ss:ff timestamp.
+func parseCueTime(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid cue timestamp %q", s)
+	}
+	var vals [3]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid cue timestamp %q", s)
+		}
+		vals[i] = v
+	}
+	frames := (vals[0]*60+vals[1])*cueFramesPerSecond + vals[2]
+	return time.Duration(frames) * time.Second / cueFramesPerSecond, nil
+}
+
+// splitCueLine splits a CUE command line into a command and arguments, honoring double quotes.
+func splitCueLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes := false
+	inField := false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// decodeCueSheet converts CUE sheet content to UTF-8. Sheets created by older rippers are often encoded in Latin-1.
+func decodeCueSheet(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// ParseCueSheet parses a CUE sheet. Unknown commands are ignored.
+func ParseCueSheet(data []byte) (*CueSheet, error) {
+	sheet := &CueSheet{}
+	var file *CueFile
+	var track *CueTrack
+	scanner := bufio.NewScanner(strings.NewReader(decodeCueSheet(data)))
+	for scanner.Scan() {
+		fields := splitCueLine(strings.TrimSpace(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		args := fields[1:]
+		switch strings.ToUpper(fields[0]) {
+		case "FILE":
+			if len(args) == 0 {
+				return nil, fmt.Errorf("cue FILE without a name")
+			}
+			file = &CueFile{Name: args[0]}
+			sheet.Files = append(sheet.Files, file)
+			track = nil
+		case "TRACK":
+			if file == nil {
+				return nil, fmt.Errorf("cue TRACK before FILE")
+			}
+			if len(args) == 0 {
+				return nil, fmt.Errorf("cue TRACK without a number")
+			}
+			num, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid cue track number %q", args[0])
+			}
+			track = &CueTrack{Number: num, Performer: sheet.Performer}
+			file.Tracks = append(file.Tracks, track)
+		case "TITLE":
+			if len(args) == 0 {
+				continue
+			}
+			if track != nil {
+				track.Title = args[0]
+			} else {
+				sheet.Title = args[0]
+			}
+		case "PERFORMER":
+			if len(args) == 0 {
+				continue
+			}
+			if track != nil {
+				track.Performer = args[0]
+			} else {
+				sheet.Performer = args[0]
+			}
+		case "INDEX":
+			// Only INDEX 01 marks the track start, INDEX 00 is the pregap.
+			if track == nil || len(args) < 2 || args[0] != "01" {
+				continue
+			}
+			start, err := parseCueTime(args[1])
+			if err != nil {
+				return nil, err
+			}
+			track.Start = start
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Each track ends where the next track in the same file starts.
+	for _, f := range sheet.Files {
+		for i := 0; i < len(f.Tracks)-1; i++ {
+			f.Tracks[i].End = f.Tracks[i+1].Start
+		}
+	}
+
+	return sheet, nil
+}
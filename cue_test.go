@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCueSheet(t *testing.T) {
+	asrt := assert.New(t)
+
+	in := "\xef\xbb\xbfREM GENRE Electronic\r\n" +
+		"PERFORMER \"Aphex Twin\"\r\n" +
+		"TITLE \"Selected Ambient Works 85-92\"\r\n" +
+		"FILE \"Aphex Twin - Selected Ambient Works 85-92.wav\" WAVE\r\n" +
+		"  TRACK 01 AUDIO\r\n" +
+		"    TITLE \"Xtal\"\r\n" +
+		"    INDEX 01 00:00:00\r\n" +
+		"  TRACK 02 AUDIO\r\n" +
+		"    TITLE \"Tha\"\r\n" +
+		"    PERFORMER \"AFX\"\r\n" +
+		"    INDEX 00 04:51:10\r\n" +
+		"    INDEX 01 04:53:37\r\n" +
+		"  TRACK 03 AUDIO\r\n" +
+		"    TITLE Pulsewidth\r\n" +
+		"    INDEX 01 14:01:00\r\n"
+	sheet, err := ParseCueSheet([]byte(in))
+	asrt.NoError(err)
+	asrt.Equal(&CueSheet{
+		Title:     "Selected Ambient Works 85-92",
+		Performer: "Aphex Twin",
+		Files: []*CueFile{
+			{
+				Name: "Aphex Twin - Selected Ambient Works 85-92.wav",
+				Tracks: []*CueTrack{
+					{
+						Number:    1,
+						Title:     "Xtal",
+						Performer: "Aphex Twin",
+						Start:     0,
+						End:       4*time.Minute + 53*time.Second + 37*time.Second/75,
+					},
+					{
+						Number:    2,
+						Title:     "Tha",
+						Performer: "AFX",
+						Start:     4*time.Minute + 53*time.Second + 37*time.Second/75,
+						End:       14*time.Minute + time.Second,
+					},
+					{
+						Number:    3,
+						Title:     "Pulsewidth",
+						Performer: "Aphex Twin",
+						Start:     14*time.Minute + time.Second,
+					},
+				},
+			},
+		},
+	}, sheet)
+
+	// Latin-1 encoded sheet.
+	sheet, err = ParseCueSheet([]byte("FILE \"a.flac\" WAVE\nTRACK 01 AUDIO\nTITLE \"Caf\xe9\"\n"))
+	asrt.NoError(err)
+	asrt.Equal("Café", sheet.Files[0].Tracks[0].Title)
+
+	_, err = ParseCueSheet([]byte("TRACK 01 AUDIO\n"))
+	asrt.Error(err)
+
+	_, err = ParseCueSheet([]byte("FILE \"a.flac\" WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00\n"))
+	asrt.Error(err)
+}
+
+func TestMatchCueFile(t *testing.T) {
+	tracks := files("a/Album.flac", "a/Other.mp3")
+	assert.Equal(t, tracks[0], matchCueFile("album.flac", tracks))
+	assert.Equal(t, tracks[0], matchCueFile("Album.wav", tracks))
+	assert.Equal(t, tracks[1], matchCueFile("C:\\Rips\\Other.mp3", tracks))
+	assert.Nil(t, matchCueFile("Missing.flac", tracks))
+}
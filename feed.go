@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"mime"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const itunesNamespace = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+
+type PodcastFeed struct {
+	XMLName  xml.Name   `xml:"rss"`
+	Version  string     `xml:"version,attr"`
+	ITunesNS string     `xml:"xmlns:itunes,attr"`
+	Channel  rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description"`
+	Image       *rssImage    `xml:"image,omitempty"`
+	ITunesImage *itunesImage `xml:"itunes:image,omitempty"`
+	ITunesType  string       `xml:"itunes:type"`
+	Items       []rssItem    `xml:"item"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title         string       `xml:"title"`
+	Enclosure     rssEnclosure `xml:"enclosure"`
+	GUID          rssGUID      `xml:"guid"`
+	PubDate       string       `xml:"pubDate,omitempty"`
+	ITunesEpisode int          `xml:"itunes:episode"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// Not all audio types are registered in the mime package.
+var audioContentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"m4a":  "audio/mp4",
+	"m4b":  "audio/mp4",
+	"aac":  "audio/aac",
+	"ogg":  "audio/ogg",
+	"oga":  "audio/ogg",
+	"flac": "audio/flac",
+}
+
+func audioContentType(f *StorageFile) string {
+	_, ext := splitNameExt(strings.ToLower(f.Name()))
+	if ct, ok := audioContentTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension("." + ext); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// absoluteURL returns an absolute URL for the given route and storage path.
+func absoluteURL(baseURL *url.URL, route string, p string) string {
+	u := *baseURL
+	u.Path = strings.TrimRight(u.Path, "/") + route + p
+	return u.String()
+}
+
+// NewPodcastFeed returns an RSS podcast feed with the audio tracks from the listing as episodes.
+// Feeds are marked as serial, episodes are numbered in the listing order.
+func NewPodcastFeed(listing *MediaListing, baseURL *url.URL) *PodcastFeed {
+	dir := listing.CurrentDirectory
+	title := dir.Name()
+	if title == "" {
+		title = "Music"
+	}
+	link := absoluteURL(baseURL, "/library/", dir.Path())
+	feed := &PodcastFeed{
+		Version:  "2.0",
+		ITunesNS: itunesNamespace,
+		Channel: rssChannel{
+			Title:       title,
+			Link:        link,
+			Description: title,
+			ITunesType:  "serial",
+		},
+	}
+	if listing.Cover != nil {
+		coverURL := absoluteURL(baseURL, "/stream/", listing.Cover.Path())
+		feed.Channel.Image = &rssImage{
+			URL:   coverURL,
+			Title: title,
+			Link:  link,
+		}
+		feed.Channel.ITunesImage = &itunesImage{
+			Href: coverURL,
+		}
+	}
+	for i, track := range listing.AudioTracks {
+		item := rssItem{
+			Title: track.FriendlyName(),
+			Enclosure: rssEnclosure{
+				URL:    absoluteURL(baseURL, "/stream/", track.Path()),
+				Length: track.Size,
+				Type:   audioContentType(track),
+			},
+			GUID: rssGUID{
+				Value: track.Path(),
+			},
+			ITunesEpisode: i + 1,
+		}
+		if !track.LastModified.IsZero() {
+			item.PubDate = track.LastModified.UTC().Format(time.RFC1123Z)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	return feed
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPodcastFeed(t *testing.T) {
+	asrt := assert.New(t)
+
+	tracks := files("Books/Dune/01 Part One.mp3", "Books/Dune/02 Part Two.m4b")
+	tracks[0].Size = 100
+	tracks[0].LastModified = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	listing := &MediaListing{
+		CurrentDirectory: NewStorageDirectory("Books/Dune"),
+		Cover:            NewStorageFile("Books/Dune/cover.jpg", 1),
+		AudioTracks:      tracks,
+	}
+	baseURL := &url.URL{Scheme: "https", Host: "example.com"}
+	feed := NewPodcastFeed(listing, baseURL)
+
+	out, err := xml.Marshal(feed)
+	asrt.NoError(err)
+	expected := `<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel>` +
+		`<title>Dune</title><link>https://example.com/library/Books/Dune</link><description>Dune</description>` +
+		`<image><url>https://example.com/stream/Books/Dune/cover.jpg</url><title>Dune</title><link>https://example.com/library/Books/Dune</link></image>` +
+		`<itunes:image href="https://example.com/stream/Books/Dune/cover.jpg"></itunes:image><itunes:type>serial</itunes:type>` +
+		`<item><title>01 Part One</title><enclosure url="https://example.com/stream/Books/Dune/01%20Part%20One.mp3" length="100" type="audio/mpeg"></enclosure>` +
+		`<guid isPermaLink="false">Books/Dune/01 Part One.mp3</guid><pubDate>Mon, 02 Jan 2023 03:04:05 +0000</pubDate><itunes:episode>1</itunes:episode></item>` +
+		`<item><title>02 Part Two</title><enclosure url="https://example.com/stream/Books/Dune/02%20Part%20Two.m4b" length="1" type="audio/mp4"></enclosure>` +
+		`<guid isPermaLink="false">Books/Dune/02 Part Two.m4b</guid><itunes:episode>2</itunes:episode></item>` +
+		`</channel></rss>`
+	asrt.Equal(expected, string(out))
+}
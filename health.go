@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	readinessCacheTTL     = 5 * time.Second
+	readinessCheckTimeout = 5 * time.Second
+)
+
+// bucketCheck is a bucket checked for readiness.
+type bucketCheck struct {
+	name  string
+	store *S3Storage
+}
+
+// CheckResult is the result of a single readiness check.
+type CheckResult struct {
+	Name     string `json:"name"`
+	Bucket   string `json:"bucket,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	// CachedURLs is the number of cached presigned URLs of the bucket.
+	CachedURLs int `json:"cached_urls"`
+}
+
+// ReadinessReport is the result of all readiness checks.
+type ReadinessReport struct {
+	Ready     bool          `json:"ready"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Checks    []CheckResult `json:"checks"`
+}
+
+// Readiness checks that S3 buckets of the storage are reachable.
+// Results are cached for a few seconds, so frequent probes don't turn into S3 requests.
+type Readiness struct {
+	buckets []bucketCheck
+	ttl     time.Duration
+	timeout time.Duration
+
+	mu     sync.Mutex
+	report *ReadinessReport
+}
+
+// NewReadiness creates readiness checks for S3 buckets of the storage.
+// With multiple libraries, every library bucket is checked.
+func NewReadiness(store Storage) *Readiness {
+	rd := &Readiness{
+		ttl:     readinessCacheTTL,
+		timeout: readinessCheckTimeout,
+	}
+	switch store := store.(type) {
+	case *S3Storage:
+		rd.buckets = append(rd.buckets, bucketCheck{name: "s3", store: store})
+	case *LibraryStorage:
+		for _, name := range store.names {
+			if s3Store, ok := store.stores[name].(*S3Storage); ok {
+				rd.buckets = append(rd.buckets, bucketCheck{name: "library " + name, store: s3Store})
+			}
+		}
+	}
+	return rd
+}
+
+func (rd *Readiness) check() *ReadinessReport {
+	ctx, cancel := context.WithTimeout(context.Background(), rd.timeout)
+	defer cancel()
+	report := &ReadinessReport{
+		Ready:     true,
+		CheckedAt: time.Now(),
+		Checks:    make([]CheckResult, len(rd.buckets)),
+	}
+	var wg sync.WaitGroup
+	for i, b := range rd.buckets {
+		wg.Add(1)
+		go func(i int, b bucketCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := b.store.withContext(ctx).Ping()
+			res := CheckResult{
+				Name:       b.name,
+				Bucket:     b.store.cfg.Bucket,
+				OK:         err == nil,
+				Duration:   time.Since(start).Round(time.Millisecond).String(),
+				CachedURLs: b.store.urls.len(),
+			}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			report.Checks[i] = res
+		}(i, b)
+	}
+	wg.Wait()
+	for _, res := range report.Checks {
+		if !res.OK {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+// Check returns the cached report or runs the checks when the report is stale.
+// Concurrent callers wait for the same checks.
+func (rd *Readiness) Check() *ReadinessReport {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.report == nil || time.Since(rd.report.CheckedAt) >= rd.ttl {
+		rd.report = rd.check()
+		if !rd.report.Ready {
+			slog.Warn("readiness check failed", slog.Any("checks", rd.report.Checks))
+		}
+	}
+	return rd.report
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed writing JSON response", slog.Any("err", err))
+	}
+}
+
+// HealthHandler reports that the process is alive. It doesn't check dependencies.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// Handler responds with the readiness report, with the 503 status when a check failed.
+func (rd *Readiness) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := rd.Check()
+		code := http.StatusOK
+		if !report.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, report)
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	cfg, closeS3 := newTestS3Config()
+	defer closeS3()
+	jazz, err := NewS3Storage(cfg)
+	require.NoError(t, err)
+	cfg.Bucket = "rock"
+	rock, err := NewS3Storage(cfg)
+	require.NoError(t, err)
+	_, err = jazz.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("test")})
+	require.NoError(t, err)
+
+	libs := NewLibraryStorage()
+	libs.Add("jazz", jazz)
+	libs.Add("rock", rock)
+	rd := NewReadiness(libs)
+
+	get := func() (int, ReadinessReport) {
+		rec := httptest.NewRecorder()
+		rd.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report ReadinessReport
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+		return rec.Code, report
+	}
+
+	code, report := get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Ready)
+	require.Len(t, report.Checks, 2)
+	assert.Equal(t, "library jazz", report.Checks[0].Name)
+	assert.Equal(t, "test", report.Checks[0].Bucket)
+	assert.True(t, report.Checks[0].OK)
+	assert.Equal(t, "library rock", report.Checks[1].Name)
+	assert.False(t, report.Checks[1].OK)
+	assert.NotEmpty(t, report.Checks[1].Error)
+
+	// Results are cached.
+	_, err = rock.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("rock")})
+	require.NoError(t, err)
+	code, _ = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	rd.ttl = 0
+	code, report = get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, report.Ready)
+	assert.WithinDuration(t, time.Now(), report.CheckedAt, time.Minute)
+}
+
+func TestHealthHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	HealthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"ok": true}`, rec.Body.String())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hlsPlaylistContentType = "application/vnd.apple.mpegurl"
+	hlsSegmentContentType  = "video/mp2t"
+)
+
+// hlsSegmentCount returns the number of segments covering the duration.
+func hlsSegmentCount(duration time.Duration, segment time.Duration) int {
+	return int((duration + segment - 1) / segment)
+}
+
+// hlsPlaylist returns a VOD media playlist for the track with the given name.
+// Segment URIs are relative to the playlist: "<name>.m3u8" refers to "<name>/<index>.ts".
+func hlsPlaylist(name string, duration time.Duration, segment time.Duration) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(segment.Seconds())))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	count := hlsSegmentCount(duration, segment)
+	for i := 0; i < count; i++ {
+		length := min(segment, duration-time.Duration(i)*segment)
+		fmt.Fprintf(&b, "#EXTINF:%s,\n", formatSeconds(length))
+		fmt.Fprintf(&b, "%s/%d.ts\n", url.PathEscape(name), i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+var hlsSegmentRe = regexp.MustCompile(`^(0|[1-9][0-9]*)\.ts$`)
+
+// parseHLSSegmentPath splits a "<track path>/<index>.ts" segment path.
+func parseHLSSegmentPath(p string) (string, int, bool) {
+	track, segment := path.Split(p)
+	m := hlsSegmentRe.FindStringSubmatch(segment)
+	track = strings.TrimSuffix(track, Delimiter)
+	if m == nil || track == "" {
+		return "", 0, false
+	}
+	idx, err := strconv.Atoi(m[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return track, idx, true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHLSPlaylist(t *testing.T) {
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:10\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXTINF:10.000,\n" +
+		"01%20Windowlicker.mp3/0.ts\n" +
+		"#EXTINF:10.000,\n" +
+		"01%20Windowlicker.mp3/1.ts\n" +
+		"#EXTINF:2.500,\n" +
+		"01%20Windowlicker.mp3/2.ts\n" +
+		"#EXT-X-ENDLIST\n"
+	assert.Equal(t, expected, hlsPlaylist("01 Windowlicker.mp3", 22500*time.Millisecond, 10*time.Second))
+
+	assert.Equal(t, 2, hlsSegmentCount(20*time.Second, 10*time.Second))
+	assert.Equal(t, 3, hlsSegmentCount(20*time.Second+time.Millisecond, 10*time.Second))
+}
+
+func TestParseHLSSegmentPath(t *testing.T) {
+	testCases := []struct {
+		p     string
+		track string
+		idx   int
+		ok    bool
+	}{
+		{"a/01 Windowlicker.mp3/0.ts", "a/01 Windowlicker.mp3", 0, true},
+		{"Xtal.mp3/12.ts", "Xtal.mp3", 12, true},
+		{"Xtal.mp3/012.ts", "", 0, false},
+		{"Xtal.mp3/-1.ts", "", 0, false},
+		{"Xtal.mp3/1.mp3", "", 0, false},
+		{"0.ts", "", 0, false},
+	}
+	for _, tc := range testCases {
+		track, idx, ok := parseHLSSegmentPath(tc.p)
+		assert.Equal(t, tc.ok, ok, tc.p)
+		assert.Equal(t, tc.track, track, tc.p)
+		assert.Equal(t, tc.idx, idx, tc.p)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadTimeout       = time.Minute
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultWriteTimeout      = time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultMaxHeaderBytes    = 64 << 10
+	defaultMaxBodyBytes      = 1 << 20
+	defaultShutdownTimeout   = 30 * time.Second
+)
+
+func durationOrDefault(d Duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// HTTPServer is an HTTP server with timeouts and a graceful shutdown.
+type HTTPServer struct {
+	srv             *http.Server
+	shutdownTimeout time.Duration
+}
+
+// NewHTTPServer creates an HTTP server listening on the address with timeouts and limits from the config.
+func NewHTTPServer(addr string, h http.Handler, cfg ServerConfig) *HTTPServer {
+	maxHeaderBytes := cfg.MaxHeaderBytes
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = defaultMaxHeaderBytes
+	}
+	return &HTTPServer{
+		srv: &http.Server{
+			Addr:              addr,
+			Handler:           h,
+			ReadTimeout:       durationOrDefault(cfg.ReadTimeout, defaultReadTimeout),
+			ReadHeaderTimeout: durationOrDefault(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+			WriteTimeout:      durationOrDefault(cfg.WriteTimeout, defaultWriteTimeout),
+			IdleTimeout:       durationOrDefault(cfg.IdleTimeout, defaultIdleTimeout),
+			MaxHeaderBytes:    maxHeaderBytes,
+		},
+		shutdownTimeout: durationOrDefault(cfg.ShutdownTimeout, defaultShutdownTimeout),
+	}
+}
+
+// EnableTLS makes the server serve HTTPS with the TLS config.
+func (s *HTTPServer) EnableTLS(conf *tls.Config) {
+	s.srv.TLSConfig = conf
+}
+
+// ListenAndServe serves HTTP or HTTPS requests. It returns nil after the server is shut down.
+func (s *HTTPServer) ListenAndServe() error {
+	var err error
+	if s.srv.TLSConfig != nil {
+		err = s.srv.ListenAndServeTLS("", "")
+	} else {
+		err = s.srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for requests in progress to finish.
+// Connections still active after the shutdown timeout, e.g. endless radio streams, are closed.
+func (s *HTTPServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return s.srv.Close()
+	}
+	return err
+}
+
+// LimitRequestBody limits the size of request bodies. Reading past the limit fails.
+func LimitRequestBody(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// disableWriteTimeout lets long streaming responses run past the server write timeout.
+func disableWriteTimeout(w http.ResponseWriter) {
+	// Fails only for response writers without deadlines, e.g. in tests.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+// minGzipSize is the smallest response size worth compressing.
+const minGzipSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// acceptsGzip returns whether the client accepts gzip-encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressible returns whether the content type is text worth compressing. Media files are already compressed.
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/javascript", mediaType == "image/svg+xml":
+		return true
+	case strings.HasSuffix(mediaType, "+xml"), mediaType == "application/xml":
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the response when its headers allow it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	accepts     bool
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) shouldCompress(code int) bool {
+	h := w.Header()
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusPartialContent || code == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n < minGzipSize {
+		return false
+	}
+	return true
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if isCompressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+		if w.accepts && w.shouldCompress(code) {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			w.gz = gzipWriters.Get().(*gzip.Writer)
+			w.gz.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying response writer.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	_ = w.gz.Close()
+	w.gz.Reset(nil)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+}
+
+// Gzip compresses text responses, e.g. HTML, CSS and JavaScript, for clients accepting gzip.
+func Gzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := &gzipResponseWriter{ResponseWriter: w, accepts: acceptsGzip(r)}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
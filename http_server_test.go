@@ -0,0 +1,159 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPServer(t *testing.T) {
+	s := NewHTTPServer(":8080", http.NotFoundHandler(), ServerConfig{
+		WriteTimeout:   Duration(time.Hour),
+		MaxHeaderBytes: 1024,
+	})
+	assert.Equal(t, defaultReadTimeout, s.srv.ReadTimeout)
+	assert.Equal(t, defaultReadHeaderTimeout, s.srv.ReadHeaderTimeout)
+	assert.Equal(t, time.Hour, s.srv.WriteTimeout)
+	assert.Equal(t, defaultIdleTimeout, s.srv.IdleTimeout)
+	assert.Equal(t, 1024, s.srv.MaxHeaderBytes)
+	assert.Equal(t, defaultShutdownTimeout, s.shutdownTimeout)
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	h := LimitRequestBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}), 4)
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, post("1234"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("12345"))
+}
+
+func TestHTTPServer_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	s := NewHTTPServer(l.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// Never finishes, like a radio stream.
+			close(started)
+			<-r.Context().Done()
+			return
+		}
+		close(started)
+		<-finish
+		io.WriteString(w, "done")
+	}), ServerConfig{ShutdownTimeout: Duration(100 * time.Millisecond)})
+	errs := make(chan error, 1)
+	go func() {
+		err := s.srv.Serve(l)
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		errs <- err
+	}()
+	url := "http://" + l.Addr().String()
+
+	// Requests in progress finish.
+	bodies := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			bodies <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		bodies <- string(body)
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(finish)
+	assert.Equal(t, "done", <-bodies)
+	assert.NoError(t, <-shutdown)
+	assert.NoError(t, <-errs)
+
+	// Requests still in progress after the timeout are cut off.
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started = make(chan struct{})
+	s = NewHTTPServer(l.Addr().String(), s.srv.Handler, ServerConfig{ShutdownTimeout: Duration(100 * time.Millisecond)})
+	go s.srv.Serve(l)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/stream")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	start := time.Now()
+	assert.NoError(t, s.Shutdown())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestGzip(t *testing.T) {
+	large := strings.Repeat("<p>hello</p>", 200)
+	h := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Length", "5")
+			io.WriteString(w, "hello")
+		case "/audio":
+			w.Header().Set("Content-Type", "audio/mpeg")
+			io.WriteString(w, large)
+		default:
+			io.WriteString(w, large)
+		}
+	}))
+	get := func(p string, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, p, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := get("/", "br, gzip")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	for _, tc := range []struct {
+		p              string
+		acceptEncoding string
+	}{
+		{"/", ""},
+		{"/", "gzip;q=0"},
+		{"/small", "gzip"},
+		{"/audio", "gzip"},
+	} {
+		rec = get(tc.p, tc.acceptEncoding)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"), tc)
+		assert.NotEmpty(t, rec.Body.String(), tc)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ignoreFileName is the name of objects with ignore patterns for the directory tree they're in.
+	ignoreFileName = ".bsimpignore"
+
+	ignoreFileCacheTTL = time.Minute
+	// ignoreFileMaxCached limits the number of cached ignore files.
+	ignoreFileMaxCached = 10000
+)
+
+var (
+	errIgnored            = errors.New("file is ignored")
+	errEmptyIgnorePattern = errors.New("empty ignore pattern")
+)
+
+// ignoreRule is a gitignore-style pattern.
+type ignoreRule struct {
+	// base is the directory the pattern is relative to.
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns match paths relative to the base, other patterns match names at any depth.
+	anchored bool
+}
+
+// parseIgnoreRule parses a gitignore-style pattern. Empty lines and comments return nil.
+func parseIgnoreRule(base string, line string) (*ignoreRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	rule := &ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, Delimiter) {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, Delimiter)
+	}
+	if strings.Contains(line, Delimiter) {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, Delimiter)
+	}
+	if line == "" {
+		return nil, errEmptyIgnorePattern
+	}
+	rule.segments = strings.Split(line, Delimiter)
+	for _, segment := range rule.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("ignore pattern %q: %w", line, err)
+		}
+	}
+	return rule, nil
+}
+
+func newIgnoreRules(base string, lines []string) ([]*ignoreRule, error) {
+	var rules []*ignoreRule
+	for _, line := range lines {
+		rule, err := parseIgnoreRule(base, line)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// matchSegments matches path segments against pattern segments. "**" matches any number of segments.
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return len(name) > 0
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func (r *ignoreRule) match(p string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	rel := p
+	if r.base != "" {
+		var ok bool
+		if rel, ok = strings.CutPrefix(p, r.base+Delimiter); !ok {
+			return false
+		}
+	}
+	if !r.anchored {
+		_, name := path.Split(rel)
+		return matchSegments(r.segments, []string{name})
+	}
+	return matchSegments(r.segments, strings.Split(rel, Delimiter))
+}
+
+// matchIgnoreRules returns whether the path is ignored. The last matching rule wins.
+func matchIgnoreRules(rules []*ignoreRule, p string, dir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.match(p, dir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+type ignoreFileCacheEntry struct {
+	rules   []*ignoreRule
+	expires time.Time
+}
+
+// ignoreFileCache is shared by copies of the storage made for request contexts.
+type ignoreFileCache struct {
+	mu      sync.Mutex
+	entries map[string]ignoreFileCacheEntry
+}
+
+// IgnoreStorage hides files and directories matching ignore patterns from the underlying storage.
+// Patterns come from the config and, optionally, from ignore files in directories.
+// Like in Git, files inside ignored directories can't be re-included.
+type IgnoreStorage struct {
+	store Storage
+	rules []*ignoreRule
+	files bool
+	cache *ignoreFileCache
+}
+
+// NewIgnoreStorage creates a storage ignoring files matching the patterns.
+// When files is true, ignore files in directories are read as well.
+func NewIgnoreStorage(store Storage, patterns []string, files bool) (*IgnoreStorage, error) {
+	rules, err := newIgnoreRules("", patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &IgnoreStorage{
+		store: store,
+		rules: rules,
+		files: files,
+		cache: &ignoreFileCache{entries: make(map[string]ignoreFileCacheEntry)},
+	}, nil
+}
+
+// WithContext returns a storage making requests with the context.
+func (s *IgnoreStorage) WithContext(ctx context.Context) Storage {
+	c := *s
+	c.store = s.store.WithContext(ctx)
+	return &c
+}
+
+func joinPath(dir string, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + Delimiter + name
+}
+
+// fileRules returns rules from the ignore file in the directory. Ignore files are cached for a short time.
+func (s *IgnoreStorage) fileRules(dir string) ([]*ignoreRule, error) {
+	if !s.files {
+		return nil, nil
+	}
+	s.cache.mu.Lock()
+	entry, ok := s.cache.entries[dir]
+	s.cache.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.rules, nil
+	}
+	data, err := s.store.ReadFile(joinPath(dir, ignoreFileName))
+	if err != nil && !IsNotExist(err) {
+		return nil, err
+	}
+	var rules []*ignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		rule, err := parseIgnoreRule(dir, line)
+		if err != nil {
+			slog.Warn("invalid ignore pattern", slog.Any("err", err), slog.String("path", joinPath(dir, ignoreFileName)))
+			continue
+		}
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	s.cache.mu.Lock()
+	if len(s.cache.entries) >= ignoreFileMaxCached {
+		clear(s.cache.entries)
+	}
+	s.cache.entries[dir] = ignoreFileCacheEntry{rules: rules, expires: time.Now().Add(ignoreFileCacheTTL)}
+	s.cache.mu.Unlock()
+	return rules, nil
+}
+
+// dirRules returns rules applying to entries of the directory.
+// It returns errNoDirectory if the directory itself is ignored.
+func (s *IgnoreStorage) dirRules(dir string) ([]*ignoreRule, error) {
+	rules, err := s.fileRules("")
+	if err != nil {
+		return nil, err
+	}
+	rules = append(s.rules[:len(s.rules):len(s.rules)], rules...)
+	if dir == "" {
+		return rules, nil
+	}
+	p := ""
+	for _, segment := range strings.Split(dir, Delimiter) {
+		p = joinPath(p, segment)
+		if matchIgnoreRules(rules, p, true) {
+			return nil, errNoDirectory
+		}
+		fileRules, err := s.fileRules(p)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	return rules, nil
+}
+
+// checkFile returns errIgnored if the file is ignored.
+func (s *IgnoreStorage) checkFile(p string) error {
+	dir, name := path.Split(p)
+	if name == ignoreFileName {
+		return errIgnored
+	}
+	rules, err := s.dirRules(strings.TrimSuffix(dir, Delimiter))
+	if errors.Is(err, errNoDirectory) {
+		return errIgnored
+	}
+	if err != nil {
+		return err
+	}
+	if matchIgnoreRules(rules, p, false) {
+		return errIgnored
+	}
+	return nil
+}
+
+// List returns slices of directories and files under the given path without ignored entries.
+func (s *IgnoreStorage) List(p string) ([]*StorageDirectory, []*StorageFile, error) {
+	rules, err := s.dirRules(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirs, files, err := s.store.List(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	var visibleDirs []*StorageDirectory
+	for _, dir := range dirs {
+		if !matchIgnoreRules(rules, dir.Path(), true) {
+			visibleDirs = append(visibleDirs, dir)
+		}
+	}
+	var visibleFiles []*StorageFile
+	for _, f := range files {
+		if f.Name() != ignoreFileName && !matchIgnoreRules(rules, f.Path(), false) {
+			visibleFiles = append(visibleFiles, f)
+		}
+	}
+	return visibleDirs, visibleFiles, nil
+}
+
+func (s *IgnoreStorage) FileSize(p string) (int64, error) {
+	if err := s.checkFile(p); err != nil {
+		return 0, err
+	}
+	return s.store.FileSize(p)
+}
+
+func (s *IgnoreStorage) ReadFile(p string) ([]byte, error) {
+	if err := s.checkFile(p); err != nil {
+		return nil, err
+	}
+	return s.store.ReadFile(p)
+}
+
+func (s *IgnoreStorage) OpenFile(p string) (io.ReadCloser, error) {
+	if err := s.checkFile(p); err != nil {
+		return nil, err
+	}
+	return s.store.OpenFile(p)
+}
+
+func (s *IgnoreStorage) ReadFileAt(p string, b []byte, off int64) (int, error) {
+	if err := s.checkFile(p); err != nil {
+		return 0, err
+	}
+	return s.store.ReadFileAt(p, b, off)
+}
+
+func (s *IgnoreStorage) FileContentURL(p string) (string, error) {
+	if err := s.checkFile(p); err != nil {
+		return "", err
+	}
+	return s.store.FileContentURL(p)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchIgnoreRules(t *testing.T) {
+	rules, err := newIgnoreRules("", []string{
+		"# Comment",
+		"",
+		".DS_Store",
+		"*.log",
+		"!keep.log",
+		"@eaDir/",
+		"/Private",
+		"Music/**/scans",
+		`\#notes`,
+	})
+	require.NoError(t, err)
+	testCases := []struct {
+		p        string
+		dir      bool
+		expected bool
+	}{
+		{p: ".DS_Store", expected: true},
+		{p: "Album/.DS_Store", expected: true},
+		{p: "Album/rip.log", expected: true},
+		{p: "Album/keep.log", expected: false},
+		{p: "Album/@eaDir", dir: true, expected: true},
+		{p: "Album/@eaDir", expected: false},
+		{p: "Private", dir: true, expected: true},
+		{p: "Album/Private", dir: true, expected: false},
+		{p: "Music/scans", dir: true, expected: true},
+		{p: "Music/Album/CD1/scans", dir: true, expected: true},
+		{p: "Other/scans", dir: true, expected: false},
+		{p: "#notes", expected: true},
+		{p: "Album/01.mp3", expected: false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, matchIgnoreRules(rules, tc.p, tc.dir), tc.p)
+	}
+
+	rules, err = newIgnoreRules("Album", []string{"/*.jpg", "**/cd*"})
+	require.NoError(t, err)
+	assert.True(t, matchIgnoreRules(rules, "Album/back.jpg", false))
+	assert.False(t, matchIgnoreRules(rules, "Album/Scans/back.jpg", false))
+	assert.False(t, matchIgnoreRules(rules, "back.jpg", false))
+	assert.True(t, matchIgnoreRules(rules, "Album/Scans/cd1.png", false))
+
+	_, err = newIgnoreRules("", []string{"[abc"})
+	assert.Error(t, err)
+	_, err = newIgnoreRules("", []string{"!"})
+	assert.Equal(t, errEmptyIgnorePattern, err)
+}
+
+func TestIgnoreStorage(t *testing.T) {
+	store := newTestStorage(t, "test")
+	for key, content := range map[string]string{
+		".bsimpignore":             "*.accurip\n",
+		"Album/01.mp3":             "1",
+		"Album/rip.log":            "1",
+		"Album/rip.accurip":        "1",
+		"Album/Thumbs.db":          "1",
+		"Album/.bsimpignore":       "Thumbs.db\n@eaDir/\n",
+		"Album/@eaDir/01.mp3.jpg":  "1",
+		"Album/Scans/Thumbs.db":    "1",
+		"Album/Scans/front.jpg":    "1",
+		"Other/Thumbs.db":          "1",
+		"Other/@eaDir/01.mp3.jpg":  "1",
+		"Other/02.mp3":             "1",
+		"Private/03.mp3":           "1",
+		"Private/Nested/04.mp3":    "1",
+		"Private/Nested/.keep.mp3": "1",
+	} {
+		require.NoError(t, store.WriteObject(key, []byte(content), ""))
+	}
+
+	s, err := NewIgnoreStorage(store, []string{"*.log", "/Private/"}, true)
+	require.NoError(t, err)
+
+	ds, fs, err := s.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, dirs("Album", "Other"), ds)
+	assert.Empty(t, fs)
+
+	ds, fs, err = s.List("Album")
+	assert.NoError(t, err)
+	assert.Equal(t, dirs("Album/Scans"), ds)
+	require.Len(t, fs, 1)
+	assert.Equal(t, "Album/01.mp3", fs[0].Path())
+
+	// Ignore files apply to subdirectories.
+	_, fs, err = s.List("Album/Scans")
+	assert.NoError(t, err)
+	require.Len(t, fs, 1)
+	assert.Equal(t, "Album/Scans/front.jpg", fs[0].Path())
+
+	// Ignore files don't apply to other directories.
+	ds, fs, err = s.List("Other")
+	assert.NoError(t, err)
+	assert.Equal(t, dirs("Other/@eaDir"), ds)
+	assert.Len(t, fs, 2)
+
+	_, _, err = s.List("Private")
+	assert.True(t, IsNotExist(err))
+	_, _, err = s.List("Private/Nested")
+	assert.True(t, IsNotExist(err))
+	_, _, err = s.List("Album/@eaDir")
+	assert.True(t, IsNotExist(err))
+
+	for _, p := range []string{"Album/rip.log", "Album/rip.accurip", "Album/.bsimpignore", "Private/03.mp3", "Album/@eaDir/01.mp3.jpg"} {
+		_, err = s.FileContentURL(p)
+		assert.ErrorIs(t, err, errIgnored, p)
+		assert.True(t, IsNotExist(err), p)
+		_, err = s.ReadFile(p)
+		assert.ErrorIs(t, err, errIgnored, p)
+		_, err = s.ReadFileAt(p, make([]byte, 1), 0)
+		assert.ErrorIs(t, err, errIgnored, p)
+	}
+	n, err := s.ReadFileAt("Album/01.mp3", make([]byte, 1), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	size, err := s.FileSize("Album/01.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), size)
+
+	// Ignore files are only read when enabled.
+	s, err = NewIgnoreStorage(store, nil, false)
+	require.NoError(t, err)
+	_, fs, err = s.List("Album")
+	assert.NoError(t, err)
+	assert.Len(t, fs, 4)
+}
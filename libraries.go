@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var errNoLibrary = errors.New("library doesn't exist")
+
+// LibraryStorage combines storages of multiple libraries into a single tree.
+// Every library is a top-level directory named after the library.
+type LibraryStorage struct {
+	names  []string
+	stores map[string]Storage
+}
+
+func NewLibraryStorage() *LibraryStorage {
+	return &LibraryStorage{
+		stores: make(map[string]Storage),
+	}
+}
+
+// Add mounts the library storage under the name. Libraries are listed in the order they're added.
+func (ls *LibraryStorage) Add(name string, store Storage) {
+	if _, ok := ls.stores[name]; !ok {
+		ls.names = append(ls.names, name)
+	}
+	ls.stores[name] = store
+}
+
+// resolve returns the library storage and the path within the library.
+func (ls *LibraryStorage) resolve(p string) (Storage, string, error) {
+	name, rel, _ := strings.Cut(p, Delimiter)
+	store, ok := ls.stores[name]
+	if !ok {
+		return nil, "", errNoLibrary
+	}
+	return store, rel, nil
+}
+
+// List returns slices of directories and files under the given path. The root directory lists libraries.
+func (ls *LibraryStorage) List(p string) ([]*StorageDirectory, []*StorageFile, error) {
+	if p == "" {
+		var dirs []*StorageDirectory
+		for _, name := range ls.names {
+			dirs = append(dirs, NewStorageDirectory(name))
+		}
+		return dirs, nil, nil
+	}
+	store, rel, err := ls.resolve(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirs, files, err := store.List(rel)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, _, _ := strings.Cut(p, Delimiter)
+	for i, dir := range dirs {
+		dirs[i] = NewStorageDirectory(name + Delimiter + dir.Path())
+	}
+	for _, f := range files {
+		f.path = name + Delimiter + f.path
+	}
+	return dirs, files, nil
+}
+
+func (ls *LibraryStorage) FileSize(p string) (int64, error) {
+	store, rel, err := ls.resolve(p)
+	if err != nil {
+		return 0, err
+	}
+	return store.FileSize(rel)
+}
+
+func (ls *LibraryStorage) ReadFile(p string) ([]byte, error) {
+	store, rel, err := ls.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	return store.ReadFile(rel)
+}
+
+func (ls *LibraryStorage) OpenFile(p string) (io.ReadCloser, error) {
+	store, rel, err := ls.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	return store.OpenFile(rel)
+}
+
+func (ls *LibraryStorage) ReadFileAt(p string, b []byte, off int64) (int, error) {
+	store, rel, err := ls.resolve(p)
+	if err != nil {
+		return 0, err
+	}
+	return store.ReadFileAt(rel, b, off)
+}
+
+func (ls *LibraryStorage) FileContentURL(p string) (string, error) {
+	store, rel, err := ls.resolve(p)
+	if err != nil {
+		return "", err
+	}
+	return store.FileContentURL(rel)
+}
+
+// WithContext returns a storage making requests to all libraries with the context.
+func (ls *LibraryStorage) WithContext(ctx context.Context) Storage {
+	c := &LibraryStorage{
+		names:  ls.names,
+		stores: make(map[string]Storage, len(ls.stores)),
+	}
+	for name, store := range ls.stores {
+		c.stores[name] = store.WithContext(ctx)
+	}
+	return c
+}
+
+// NewStorage creates the storage of media files and the storage of playlists and playback positions.
+// With multiple libraries, playlists and playback positions are stored in the first library bucket.
+// Playlists and playback positions are hidden from media files.
+func NewStorage(cfg *Config) (Storage, *S3Storage, error) {
+	if len(cfg.Libraries) == 0 {
+		store, err := NewS3Storage(cfg.S3)
+		if err != nil {
+			return nil, nil, err
+		}
+		store.hide(store.cfg.PlaylistsPrefix, store.cfg.PositionsPrefix)
+		return store, store, nil
+	}
+	libs := NewLibraryStorage()
+	var state *S3Storage
+	for _, lib := range cfg.Libraries {
+		store, err := NewS3Storage(lib.S3)
+		if err != nil {
+			return nil, nil, fmt.Errorf("library %q: %w", lib.Name, err)
+		}
+		if state == nil {
+			state = store
+			state.hide(state.cfg.PlaylistsPrefix, state.cfg.PositionsPrefix)
+		}
+		libs.Add(lib.Name, store)
+	}
+	return libs, state, nil
+}
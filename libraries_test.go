@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraryStorage(t *testing.T) {
+	cfg, closeS3 := newTestS3Config()
+	defer closeS3()
+	music, err := NewS3Storage(cfg)
+	require.NoError(t, err)
+	booksCfg := cfg
+	booksCfg.Bucket = "books"
+	booksCfg.BasePrefix = "library/"
+	books, err := NewS3Storage(booksCfg)
+	require.NoError(t, err)
+
+	put := func(bucket, key, content string) {
+		t.Helper()
+		_, err := music.s3.PutObject(&s3.PutObjectInput{
+			Body:   strings.NewReader(content),
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		require.NoError(t, err)
+	}
+	for _, bucket := range []string{"test", "books"} {
+		_, err = music.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)})
+		require.NoError(t, err)
+	}
+	put("test", "Aphex Twin/01 Windowlicker.mp3", "1")
+	put("books", "library/Dune/01.m4b", "12")
+
+	ls := NewLibraryStorage()
+	ls.Add("Music", music)
+	ls.Add("Audiobooks", books)
+
+	dirs, files, err := ls.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []*StorageDirectory{NewStorageDirectory("Music"), NewStorageDirectory("Audiobooks")}, dirs)
+	assert.Empty(t, files)
+
+	dirs, files, err = ls.List("Music")
+	assert.NoError(t, err)
+	assert.Equal(t, []*StorageDirectory{NewStorageDirectory("Music/Aphex Twin")}, dirs)
+	assert.Empty(t, files)
+
+	dirs, files, err = ls.List("Audiobooks/Dune")
+	assert.NoError(t, err)
+	assert.Empty(t, dirs)
+	require.Len(t, files, 1)
+	assert.Equal(t, "Audiobooks/Dune/01.m4b", files[0].Path())
+	assert.Equal(t, int64(2), files[0].Size)
+
+	size, err := ls.FileSize("Audiobooks/Dune/01.m4b")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+
+	data, err := ls.ReadFile("Music/Aphex Twin/01 Windowlicker.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), data)
+
+	url, err := ls.FileContentURL("Audiobooks/Dune/01.m4b")
+	assert.NoError(t, err)
+	assert.Contains(t, url, "/books/library/Dune/01.m4b")
+
+	_, _, err = ls.List("Podcasts")
+	assert.True(t, IsNotExist(err))
+	_, err = ls.FileSize("Podcasts/01.mp3")
+	assert.True(t, IsNotExist(err))
+}
+
+func TestNewStorage_HidesState(t *testing.T) {
+	s3cfg, closeS3 := newTestS3Config()
+	defer closeS3()
+	s3cfg.PlaylistsPrefix = "playlists/"
+	s3cfg.PositionsPrefix = "state/positions/"
+	store, state, err := NewStorage(&Config{S3: s3cfg})
+	require.NoError(t, err)
+	_, err = state.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("test")})
+	require.NoError(t, err)
+	for _, key := range []string{"Album/1.mp3", "playlists/a.json", "state/positions/default/Album.json", "state/notes.txt"} {
+		require.NoError(t, state.WriteObject(key, []byte("1"), ""))
+	}
+
+	listedDirs, listedFiles, err := store.List("")
+	require.NoError(t, err)
+	assert.Equal(t, dirs("Album", "state"), listedDirs)
+	assert.Empty(t, listedFiles)
+	_, listedFiles, err = store.List("state")
+	require.NoError(t, err)
+	require.Len(t, listedFiles, 1)
+	assert.Equal(t, "state/notes.txt", listedFiles[0].Path())
+	_, _, err = store.List("playlists")
+	assert.True(t, IsNotExist(err))
+	_, err = store.FileSize("playlists/a.json")
+	assert.True(t, IsNotExist(err))
+	_, err = store.FileContentURL("state/positions/default/Album.json")
+	assert.True(t, IsNotExist(err))
+
+	// The state is still accessible by raw keys.
+	data, err := state.ReadObject("playlists/a.json")
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LyricsLine is a single line of lyrics. Time is zero for unsynchronised lyrics.
+type LyricsLine struct {
+	Time time.Duration
+	Text string
+}
+
+// Lyrics are track lyrics, optionally synchronised with the playback.
+type Lyrics struct {
+	Synced bool
+	Lines  []LyricsLine
+}
+
+var (
+	lrcTimestampRe = regexp.MustCompile(`^\[(\d+):(\d+)(?:[.:](\d+))?\]`)
+	lrcTagRe       = regexp.MustCompile(`^\[([a-zA-Z]+):(.*)\]$`)
+)
+
+// parseLRCTimestamp parses mm:ss.xx timestamp groups. The fraction can be in hundredths or milliseconds.
+func parseLRCTimestamp(m []string) time.Duration {
+	min, _ := strconv.Atoi(m[1])
+	sec, _ := strconv.Atoi(m[2])
+	t := time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	if frac := m[3]; frac != "" {
+		v, _ := strconv.Atoi(frac)
+		for i := len(frac); i < 3; i++ {
+			v *= 10
+		}
+		for i := len(frac); i > 3; i-- {
+			v /= 10
+		}
+		t += time.Duration(v) * time.Millisecond
+	}
+	return t
+}
+
+// ParseLRC parses lyrics in the LRC format. Lines without timestamps are treated as unsynchronised lyrics.
+func ParseLRC(data []byte) *Lyrics {
+	lyrics := &Lyrics{}
+	var offset time.Duration
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := lrcTagRe.FindStringSubmatch(line); m != nil {
+			// ID tags such as [ar:Artist]. Only the offset affects the lyrics.
+			if strings.EqualFold(m[1], "offset") {
+				ms, _ := strconv.Atoi(strings.TrimSpace(m[2]))
+				offset = time.Duration(ms) * time.Millisecond
+			}
+			continue
+		}
+		// A line can have multiple timestamps when the same text repeats.
+		var times []time.Duration
+		for m := lrcTimestampRe.FindStringSubmatch(line); m != nil; m = lrcTimestampRe.FindStringSubmatch(line) {
+			times = append(times, parseLRCTimestamp(m))
+			line = line[len(m[0]):]
+		}
+		text := strings.TrimSpace(line)
+		if len(times) == 0 {
+			if text != "" {
+				lyrics.Lines = append(lyrics.Lines, LyricsLine{Text: text})
+			}
+			continue
+		}
+		lyrics.Synced = true
+		for _, t := range times {
+			// A positive offset shifts lyrics up, i.e. lines appear sooner.
+			t -= offset
+			if t < 0 {
+				t = 0
+			}
+			lyrics.Lines = append(lyrics.Lines, LyricsLine{Time: t, Text: text})
+		}
+	}
+	if lyrics.Synced {
+		sort.SliceStable(lyrics.Lines, func(i, j int) bool {
+			return lyrics.Lines[i].Time < lyrics.Lines[j].Time
+		})
+	}
+	return lyrics
+}
+
+// findLyricsFile returns a lyrics file with the same name as the audio track, e.g. "01 Xtal.lrc" for "01 Xtal.mp3".
+func findLyricsFile(track *StorageFile, files []*StorageFile) *StorageFile {
+	trackName, _ := splitNameExt(strings.ToLower(track.Name()))
+	for _, f := range files {
+		if !IsLyricsFile(f) {
+			continue
+		}
+		name, _ := splitNameExt(strings.ToLower(f.Name()))
+		if name == trackName {
+			return f
+		}
+	}
+	return nil
+}
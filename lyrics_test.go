@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLRC(t *testing.T) {
+	in := `[ar:Daft Punk]
+[ti:Around the World]
+[offset:500]
+
+[00:01.50]Around the world
+[00:03.00][00:06.250]Around the world, around the world
+[01:02]Around the world`
+	expected := &Lyrics{
+		Synced: true,
+		Lines: []LyricsLine{
+			{Time: time.Second, Text: "Around the world"},
+			{Time: 2500 * time.Millisecond, Text: "Around the world, around the world"},
+			{Time: 5750 * time.Millisecond, Text: "Around the world, around the world"},
+			{Time: time.Minute + 1500*time.Millisecond, Text: "Around the world"},
+		},
+	}
+	assert.Equal(t, expected, ParseLRC([]byte(in)))
+
+	// Plain text lyrics.
+	expected = &Lyrics{
+		Lines: []LyricsLine{
+			{Text: "Around the world"},
+			{Text: "Around the world"},
+		},
+	}
+	assert.Equal(t, expected, ParseLRC([]byte("Around the world\n\nAround the world\n")))
+}
+
+func TestFindLyricsFile(t *testing.T) {
+	in := files("a/01 Xtal.mp3", "a/01 xtal.LRC", "a/02 Tha.lrc", "a/cover.jpg")
+	assert.Equal(t, in[1], findLyricsFile(in[0], in))
+	assert.Nil(t, findLyricsFile(in[3], in[:1]))
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -11,24 +17,145 @@ func main() {
 		configPath string
 	)
 	flag.StringVar(&httpAddr, "http", ":8080", "HTTP server address")
-	flag.StringVar(&configPath, "config", "config.toml", "config path")
+	flag.StringVar(&configPath, "config", "config.toml", "config path, empty to configure with environment variables only")
 	flag.Parse()
 
-	cfg, err := NewConfig(configPath)
+	cfg, sources, err := NewConfig(configPath)
 	if err != nil {
-		slog.Error("failed parsing confg", err, slog.String("path", configPath))
+		slog.Error("failed parsing confg", slog.Any("err", err), slog.String("path", configPath))
 		return
 	}
+	for _, key := range sources.Keys() {
+		if source := sources[key]; source != sourceFile {
+			slog.Info("config value overridden", slog.String("key", key), slog.String("source", string(source)))
+		}
+	}
 
-	store, err := NewS3Storage(cfg.S3)
+	c, err := newComponents(cfg)
 	if err != nil {
-		slog.Error("failed initializing S3 storage", err)
+		slog.Error("failed initializing components", slog.Any("err", err))
 		return
 	}
 
-	mediaLib := NewMediaLibrary(store)
+	var upnp *UPnPServer
+	if cfg.UPnP.Enabled {
+		httpURL := &url.URL{Scheme: "http", Host: httpAddr, Path: cfg.Server.BasePath}
+		if cfg.TLS.Enabled() {
+			httpURL.Scheme = "https"
+		}
+		upnp, err = NewUPnPServer(cfg.UPnP, c.mediaLib, httpURL)
+		if err != nil {
+			slog.Error("failed initializing UPnP server", slog.Any("err", err))
+			return
+		}
+		go func() {
+			if err := upnp.ListenAndServeSSDP(); err != nil {
+				slog.Error("failed starting SSDP server", slog.Any("err", err))
+			}
+		}()
+	}
+
+	var mpd *MPDServer
+	if cfg.MPD.Enabled {
+		mpd = NewMPDServer(cfg.MPD, c.mediaLib, c.playlists)
+		go func() {
+			slog.Info("started MPD server", slog.String("address", mpd.Address()))
+			if err := mpd.ListenAndServe(); err != nil {
+				slog.Error("failed starting MPD server", slog.Any("err", err))
+			}
+		}()
+	}
+
+	srv, err := NewServer(c.mediaLib, c.playlists, c.positions, c.transcoder, c.readiness, cfg.Server)
+	if err != nil {
+		slog.Error("failed initializing HTTP server", slog.Any("err", err))
+		return
+	}
+	h, err := srv.Handler(upnp)
+	if err != nil {
+		slog.Error("failed initializing HTTP server", slog.Any("err", err))
+		return
+	}
+	handler := &ReloadableHandler{}
+	handler.Store(h)
 
-	slog.Info("started HTTP server", slog.String("address", httpAddr))
-	err = StartServer(mediaLib, httpAddr)
-	slog.Error("failed starting HTTP server", err)
+	reloader := NewReloader(configPath, cfg, handler, upnp, mpd)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go reloader.Watch(signals, configPollInterval)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var root http.Handler = handler
+	if cfg.AccessLog.Enabled {
+		accessLog, err := NewAccessLogger(cfg.AccessLog, cfg.Server.UserHeader)
+		if err != nil {
+			slog.Error("failed initializing access log", slog.Any("err", err))
+			return
+		}
+		defer accessLog.Close()
+		root = accessLog.Handler(handler)
+	}
+	if len(cfg.Server.TrustedProxies) > 0 {
+		proxies, err := NewTrustedProxies(cfg.Server.TrustedProxies)
+		if err != nil {
+			slog.Error("failed parsing trusted proxies", slog.Any("err", err))
+			return
+		}
+		// Runs before the access log to log client addresses.
+		root = proxies.Handler(root)
+	}
+	httpSrv := NewHTTPServer(httpAddr, root, cfg.Server)
+	errs := make(chan error, 2)
+	var redirectSrv *HTTPServer
+	if cfg.TLS.Enabled() {
+		certs, err := NewTLSCertificates(cfg.TLS)
+		if err != nil {
+			slog.Error("failed loading TLS certificate", slog.Any("err", err))
+			return
+		}
+		httpSrv.EnableTLS(certs.Config())
+		go certs.Watch(configPollInterval)
+		if cfg.TLS.RedirectAddr != "" {
+			redirect, err := RedirectToHTTPS(httpAddr)
+			if err != nil {
+				slog.Error("failed initializing HTTPS redirect", slog.Any("err", err))
+				return
+			}
+			redirectSrv = NewHTTPServer(cfg.TLS.RedirectAddr, redirect, cfg.Server)
+			go func() {
+				slog.Info("started HTTPS redirect server", slog.String("address", cfg.TLS.RedirectAddr))
+				errs <- redirectSrv.ListenAndServe()
+			}()
+		}
+	}
+	go func() {
+		slog.Info("started HTTP server", slog.String("address", httpAddr), slog.Bool("tls", cfg.TLS.Enabled()))
+		errs <- httpSrv.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		slog.Error("failed starting HTTP server", slog.Any("err", err))
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+
+	if upnp != nil {
+		if err := upnp.Close(); err != nil {
+			slog.Error("failed stopping UPnP server", slog.Any("err", err))
+		}
+	}
+	if mpd != nil {
+		if err := mpd.Close(); err != nil {
+			slog.Error("failed stopping MPD server", slog.Any("err", err))
+		}
+	}
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(); err != nil {
+			slog.Error("failed stopping HTTPS redirect server", slog.Any("err", err))
+		}
+	}
+	if err := httpSrv.Shutdown(); err != nil {
+		slog.Error("failed stopping HTTP server", slog.Any("err", err))
+	}
 }
@@ -1,6 +1,12 @@
 package main
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
 
 type StringSet map[string]struct{}
 
@@ -21,20 +27,146 @@ func (ss StringSet) Contains(v string) bool {
 	return ok
 }
 
-// TODO: this should probably live in the config.
-var audioExtensions = NewStringSet("mp3", "m4a", "aac", "ogg", "oga", "flac")
+var (
+	defaultAudioExtensions = []string{"mp3", "m4a", "m4b", "aac", "ogg", "oga", "flac"}
+	defaultImageExtensions = []string{"jpg", "jpeg", "png", "gif"}
+	defaultArtworkDirs     = []string{"scans", "covers", "artwork", "media"}
+	defaultCoverRules      = []CoverRule{
+		// Exact match.
+		{Name: "cover", Score: 2},
+		{Name: "front", Score: 2},
+		{Name: "folder", Score: 2},
+		// Partial match.
+		{Glob: "*cover*", Score: 1},
+		{Glob: "*front*", Score: 1},
+		{Glob: "*folder*", Score: 1},
+	}
+)
+
+var (
+	errEmptyExtension = errors.New("empty file extension")
+	errCoverRule      = errors.New("cover rule must have exactly one of name, glob or regex")
+)
+
+// coverMatcher matches lowercase image names without the extension.
+type coverMatcher struct {
+	match func(name string) bool
+	score int
+}
+
+// MediaDetector classifies storage files and directories.
+type MediaDetector struct {
+	audioExtensions StringSet
+	imageExtensions StringSet
+	artworkDirs     StringSet
+	covers          []coverMatcher
+}
+
+func newExtensionSet(exts []string) (StringSet, error) {
+	ss := NewStringSet()
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		if ext == "" {
+			return nil, errEmptyExtension
+		}
+		ss.Add(ext)
+	}
+	return ss, nil
+}
+
+func newCoverMatcher(rule CoverRule) (coverMatcher, error) {
+	m := coverMatcher{score: rule.Score}
+	n := 0
+	if rule.Name != "" {
+		n++
+		name := strings.ToLower(rule.Name)
+		m.match = func(s string) bool {
+			return s == name
+		}
+	}
+	if rule.Glob != "" {
+		n++
+		glob := strings.ToLower(rule.Glob)
+		if _, err := path.Match(glob, ""); err != nil {
+			return m, fmt.Errorf("cover glob %q: %w", rule.Glob, err)
+		}
+		m.match = func(s string) bool {
+			ok, _ := path.Match(glob, s)
+			return ok
+		}
+	}
+	if rule.Regex != "" {
+		n++
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return m, fmt.Errorf("cover regex: %w", err)
+		}
+		m.match = re.MatchString
+	}
+	if n != 1 {
+		return m, errCoverRule
+	}
+	return m, nil
+}
+
+// NewMediaDetector creates a detector with the configured rules. Empty rules are replaced with defaults.
+func NewMediaDetector(cfg MediaConfig) (*MediaDetector, error) {
+	if len(cfg.AudioExtensions) == 0 {
+		cfg.AudioExtensions = defaultAudioExtensions
+	}
+	if len(cfg.ImageExtensions) == 0 {
+		cfg.ImageExtensions = defaultImageExtensions
+	}
+	if len(cfg.ArtworkDirs) == 0 {
+		cfg.ArtworkDirs = defaultArtworkDirs
+	}
+	if len(cfg.Covers) == 0 {
+		cfg.Covers = defaultCoverRules
+	}
+	var err error
+	d := &MediaDetector{
+		artworkDirs: NewStringSet(),
+	}
+	if d.audioExtensions, err = newExtensionSet(cfg.AudioExtensions); err != nil {
+		return nil, fmt.Errorf("audio extensions: %w", err)
+	}
+	if d.imageExtensions, err = newExtensionSet(cfg.ImageExtensions); err != nil {
+		return nil, fmt.Errorf("image extensions: %w", err)
+	}
+	for _, name := range cfg.ArtworkDirs {
+		d.artworkDirs.Add(strings.ToLower(name))
+	}
+	for _, rule := range cfg.Covers {
+		m, err := newCoverMatcher(rule)
+		if err != nil {
+			return nil, err
+		}
+		d.covers = append(d.covers, m)
+	}
+	return d, nil
+}
 
 // IsAudioFile returns whether the given file is an audio file.
-func IsAudioFile(f *StorageFile) bool {
+func (d *MediaDetector) IsAudioFile(f *StorageFile) bool {
 	_, ext := splitNameExt(strings.ToLower(f.Name()))
-	return audioExtensions.Contains(ext)
+	return d.audioExtensions.Contains(ext)
 }
 
-var artworkDirNames = NewStringSet("scans", "covers", "artwork", "media")
+// IsCueSheet returns whether the given file is a CUE sheet.
+func IsCueSheet(f *StorageFile) bool {
+	_, ext := splitNameExt(strings.ToLower(f.Name()))
+	return ext == "cue"
+}
+
+// IsLyricsFile returns whether the given file contains lyrics.
+func IsLyricsFile(f *StorageFile) bool {
+	_, ext := splitNameExt(strings.ToLower(f.Name()))
+	return ext == "lrc"
+}
 
 // IsArtworkDir returns whether the given directory may contain cover images.
-func IsArtworkDir(d *StorageDirectory) bool {
-	return artworkDirNames.Contains(strings.ToLower(d.Name()))
+func (d *MediaDetector) IsArtworkDir(dir *StorageDirectory) bool {
+	return d.artworkDirs.Contains(strings.ToLower(dir.Name()))
 }
 
 type ScoredFile struct {
@@ -42,9 +174,6 @@ type ScoredFile struct {
 	Score int
 }
 
-var imageExtensions = NewStringSet("jpg", "jpeg", "png", "gif")
-var coverNames = NewStringSet("cover", "front", "folder")
-
 func splitNameExt(fullName string) (string, string) {
 	idx := strings.LastIndexByte(fullName, '.')
 	if idx == -1 {
@@ -53,32 +182,28 @@ func splitNameExt(fullName string) (string, string) {
 	return fullName[:idx], fullName[idx+1:]
 }
 
-func scoreCover(f *StorageFile) int {
+// scoreCover returns the highest score of the matching cover rules. Images matching no rules score 0.
+func (d *MediaDetector) scoreCover(f *StorageFile) (int, bool) {
 	name, ext := splitNameExt(strings.ToLower(f.Name()))
-	if !imageExtensions.Contains(ext) {
-		return -1
-	}
-	// Exact match.
-	if coverNames.Contains(name) {
-		return 2
+	if !d.imageExtensions.Contains(ext) {
+		return 0, false
 	}
-	// Partial match.
-	for pattern := range coverNames {
-		if strings.Contains(name, pattern) {
-			return 1
+	score, matched := 0, false
+	for _, m := range d.covers {
+		if m.match(name) && (!matched || m.score > score) {
+			score, matched = m.score, true
 		}
 	}
-	// Any image.
-	return 0
+	return score, true
 }
 
 // ScoreCovers returns a slice of image files scored as album covers.
 // The highest score is more likely to be a cover image.
-func ScoreCovers(files []*StorageFile) []ScoredFile {
+func (d *MediaDetector) ScoreCovers(files []*StorageFile) []ScoredFile {
 	var scored []ScoredFile
 	for _, f := range files {
-		score := scoreCover(f)
-		if score == -1 {
+		score, ok := d.scoreCover(f)
+		if !ok {
 			continue
 		}
 		scored = append(scored, ScoredFile{
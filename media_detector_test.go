@@ -4,8 +4,16 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func newTestMediaDetector(t *testing.T) *MediaDetector {
+	t.Helper()
+	d, err := NewMediaDetector(MediaConfig{})
+	require.NoError(t, err)
+	return d
+}
+
 func TestScoreCovers(t *testing.T) {
 	in := files("1.mp3", "2.JpG", "3.GIF", "cover.jpg", "abc", "1_cover.png")
 	expected := []ScoredFile{
@@ -26,15 +34,79 @@ func TestScoreCovers(t *testing.T) {
 			Score:       1,
 		},
 	}
-	actual := ScoreCovers(in)
+	actual := newTestMediaDetector(t).ScoreCovers(in)
 	assert.EqualValues(t, expected, actual)
 }
 
+func TestScoreCovers_Config(t *testing.T) {
+	d, err := NewMediaDetector(MediaConfig{
+		ImageExtensions: []string{".webp", "JPG"},
+		Covers: []CoverRule{
+			{Name: "front", Score: 3},
+			{Glob: "*cover*", Score: 2},
+			{Regex: `^(back|cd\d*)$`, Score: -1},
+		},
+	})
+	require.NoError(t, err)
+	in := files("front.webp", "Album Cover.jpg", "back.jpg", "cd2.jpg", "other.jpg", "front.png")
+	expected := []ScoredFile{
+		{StorageFile: in[0], Score: 3},
+		{StorageFile: in[1], Score: 2},
+		{StorageFile: in[2], Score: -1},
+		{StorageFile: in[3], Score: -1},
+		{StorageFile: in[4], Score: 0},
+	}
+	assert.EqualValues(t, expected, d.ScoreCovers(in))
+}
+
 func TestIsAudioFile(t *testing.T) {
+	d := newTestMediaDetector(t)
 	in := files("1.mp3", "abc", "cover.jpg", "2.ogg", "3.MP3")
 	expected := []bool{true, false, false, true, true}
 	for i, f := range in {
-		actual := IsAudioFile(f)
+		actual := d.IsAudioFile(f)
+		assert.Equal(t, expected[i], actual)
+	}
+
+	d, err := NewMediaDetector(MediaConfig{
+		AudioExtensions: []string{"opus", "mp3"},
+	})
+	require.NoError(t, err)
+	in = files("1.opus", "2.flac", "3.mp3")
+	expected = []bool{true, false, true}
+	for i, f := range in {
+		actual := d.IsAudioFile(f)
 		assert.Equal(t, expected[i], actual)
 	}
 }
+
+func TestIsArtworkDir(t *testing.T) {
+	d := newTestMediaDetector(t)
+	assert.True(t, d.IsArtworkDir(NewStorageDirectory("Album/Scans")))
+	assert.False(t, d.IsArtworkDir(NewStorageDirectory("Album/Booklet")))
+
+	d, err := NewMediaDetector(MediaConfig{ArtworkDirs: []string{"Booklet"}})
+	require.NoError(t, err)
+	assert.False(t, d.IsArtworkDir(NewStorageDirectory("Album/Scans")))
+	assert.True(t, d.IsArtworkDir(NewStorageDirectory("Album/Booklet")))
+}
+
+func TestNewMediaDetector_Errors(t *testing.T) {
+	testCases := []struct {
+		cfg MediaConfig
+		err string
+	}{
+		{cfg: MediaConfig{AudioExtensions: []string{"mp3", ""}}, err: "audio extensions: empty file extension"},
+		{cfg: MediaConfig{ImageExtensions: []string{"."}}, err: "image extensions: empty file extension"},
+		{cfg: MediaConfig{Covers: []CoverRule{{Score: 1}}}, err: "cover rule must have exactly one of name, glob or regex"},
+		{cfg: MediaConfig{Covers: []CoverRule{{Name: "cover", Glob: "*cover*"}}}, err: "cover rule must have exactly one of name, glob or regex"},
+		{cfg: MediaConfig{Covers: []CoverRule{{Glob: "[cover"}}}, err: "syntax error in pattern"},
+		{cfg: MediaConfig{Covers: []CoverRule{{Regex: "(cover"}}}, err: "cover regex"},
+	}
+	for _, tc := range testCases {
+		_, err := NewMediaDetector(tc.cfg)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), tc.err)
+		}
+	}
+}
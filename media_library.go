@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"path"
 	"sort"
+	"strings"
+	"sync"
 )
 
 type MediaListing struct {
@@ -10,20 +16,72 @@ type MediaListing struct {
 	Files            []*StorageFile
 	Cover            *StorageFile
 	AudioTracks      []*StorageFile
+	// CueTracks maps paths of audio tracks to virtual tracks described by CUE sheets.
+	CueTracks map[string][]*CueTrack
+	// Lyrics maps paths of audio tracks to lyrics files.
+	Lyrics map[string]*StorageFile
+	// Audiobook is true when the directory is played as an audiobook, with chapters and a resume position.
+	Audiobook bool
+	// Chapters maps paths of audiobook tracks to their chapters.
+	Chapters map[string][]*Chapter
 }
 
 type MediaLibrary struct {
-	store *S3Storage
+	store      Storage
+	media      *MediaDetector
+	audiobooks AudiobooksConfig
+	// chapters is shared by copies of the library with different contexts.
+	chapters *chapterCache
 }
 
-func NewMediaLibrary(store *S3Storage) *MediaLibrary {
+func NewMediaLibrary(store Storage, media *MediaDetector, audiobooks AudiobooksConfig) *MediaLibrary {
 	return &MediaLibrary{
-		store: store,
+		store:      store,
+		media:      media,
+		audiobooks: audiobooks,
+		chapters:   &chapterCache{entries: make(map[chapterCacheKey][]*Chapter)},
 	}
 }
 
+// maxCachedChapters limits the number of tracks with cached chapters.
+const maxCachedChapters = 10000
+
+type chapterCacheKey struct {
+	path string
+	etag string
+}
+
+// chapterCache keeps chapters of MP4 tracks, so listings don't read the tracks again until they change.
+type chapterCache struct {
+	mu      sync.Mutex
+	entries map[chapterCacheKey][]*Chapter
+}
+
+func (c *chapterCache) get(track *StorageFile) ([]*Chapter, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chapters, ok := c.entries[chapterCacheKey{track.Path(), track.ETag}]
+	return chapters, ok
+}
+
+func (c *chapterCache) put(track *StorageFile, chapters []*Chapter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedChapters {
+		clear(c.entries)
+	}
+	c.entries[chapterCacheKey{track.Path(), track.ETag}] = chapters
+}
+
+// WithContext returns a library making storage requests with the context.
+func (ml *MediaLibrary) WithContext(ctx context.Context) *MediaLibrary {
+	c := *ml
+	c.store = ml.store.WithContext(ctx)
+	return &c
+}
+
 func (ml *MediaLibrary) findCover(files []*StorageFile) *StorageFile {
-	candidates := ScoreCovers(files)
+	candidates := ml.media.ScoreCovers(files)
 	if len(candidates) == 0 {
 		return nil
 	}
@@ -36,7 +94,7 @@ func (ml *MediaLibrary) findCover(files []*StorageFile) *StorageFile {
 func (ml *MediaLibrary) listArtworkFiles(dirs []*StorageDirectory) ([]*StorageFile, error) {
 	var candidates []*StorageFile
 	for _, dir := range dirs {
-		if !IsArtworkDir(dir) {
+		if !ml.media.IsArtworkDir(dir) {
 			continue
 		}
 		_, files, err := ml.store.List(dir.Path())
@@ -48,8 +106,131 @@ func (ml *MediaLibrary) listArtworkFiles(dirs []*StorageDirectory) ([]*StorageFi
 	return candidates, nil
 }
 
-// List returns directory listing under the provided path.
-func (ml *MediaLibrary) List(p string) (*MediaListing, error) {
+// matchCueFile returns the audio track referenced by a CUE sheet file entry.
+// Rippers often keep the original file name in the sheet after converting audio to a different format,
+// so the extension is ignored when there is no exact match.
+func matchCueFile(name string, tracks []*StorageFile) *StorageFile {
+	// Some sheets reference files using Windows paths.
+	name = strings.ToLower(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	for _, track := range tracks {
+		if strings.ToLower(track.Name()) == name {
+			return track
+		}
+	}
+	baseName, _ := splitNameExt(name)
+	for _, track := range tracks {
+		trackName, _ := splitNameExt(strings.ToLower(track.Name()))
+		if trackName == baseName {
+			return track
+		}
+	}
+	return nil
+}
+
+// findCueTracks parses CUE sheets among files and returns virtual tracks for the referenced audio tracks.
+// Unreadable and malformed CUE sheets are skipped, their audio files are listed unsplit.
+func (ml *MediaLibrary) findCueTracks(files []*StorageFile, tracks []*StorageFile) map[string][]*CueTrack {
+	var cueTracks map[string][]*CueTrack
+	for _, f := range files {
+		if !IsCueSheet(f) {
+			continue
+		}
+		data, err := ml.store.ReadFile(f.Path())
+		if err != nil {
+			slog.Warn("failed reading cue sheet", slog.Any("err", err), slog.String("path", f.Path()))
+			continue
+		}
+		sheet, err := ParseCueSheet(data)
+		if err != nil {
+			slog.Warn("failed parsing cue sheet", slog.Any("err", err), slog.String("path", f.Path()))
+			continue
+		}
+		for _, cueFile := range sheet.Files {
+			// A single track doesn't need to be split.
+			if len(cueFile.Tracks) < 2 {
+				continue
+			}
+			track := matchCueFile(cueFile.Name, tracks)
+			if track == nil {
+				continue
+			}
+			if cueTracks == nil {
+				cueTracks = make(map[string][]*CueTrack)
+			}
+			cueTracks[track.Path()] = cueFile.Tracks
+		}
+	}
+	return cueTracks
+}
+
+// isAudiobook returns whether the directory should be played as an audiobook.
+// Directories containing M4B files and directories under the configured prefixes are audiobooks.
+func (ml *MediaLibrary) isAudiobook(p string, tracks []*StorageFile) bool {
+	for _, prefix := range ml.audiobooks.Prefixes {
+		if p == prefix || strings.HasPrefix(p, prefix+Delimiter) {
+			return true
+		}
+	}
+	for _, track := range tracks {
+		if _, ext := splitNameExt(strings.ToLower(track.Name())); ext == "m4b" {
+			return true
+		}
+	}
+	return false
+}
+
+// trackChapters returns chapters of the MP4 track. Chapters are cached by the track path and ETag.
+func (ml *MediaLibrary) trackChapters(track *StorageFile) ([]*Chapter, error) {
+	if track.ETag != "" {
+		if chapters, ok := ml.chapters.get(track); ok {
+			return chapters, nil
+		}
+	}
+	r := &storageFileReader{store: ml.store, path: track.Path()}
+	chapters, err := ReadMP4Chapters(r, track.Size)
+	if err != nil {
+		return nil, err
+	}
+	if track.ETag != "" {
+		ml.chapters.put(track, chapters)
+	}
+	return chapters, nil
+}
+
+// findChapters reads chapters of MP4 audio tracks.
+func (ml *MediaLibrary) findChapters(tracks []*StorageFile) map[string][]*Chapter {
+	var chapters map[string][]*Chapter
+	for _, track := range tracks {
+		if !IsMP4File(track) {
+			continue
+		}
+		trackChapters, err := ml.trackChapters(track)
+		if err != nil {
+			slog.Warn("failed reading chapters", slog.Any("err", err), slog.String("path", track.Path()))
+			continue
+		}
+		if len(trackChapters) < 2 {
+			continue
+		}
+		if chapters == nil {
+			chapters = make(map[string][]*Chapter)
+		}
+		chapters[track.Path()] = trackChapters
+	}
+	return chapters
+}
+
+// ListingEntries are storage entries of a directory listing before media files are read.
+type ListingEntries struct {
+	Path        string
+	Directories []*StorageDirectory
+	Files       []*StorageFile
+	Cover       *StorageFile
+}
+
+// ListEntries lists the directory under the provided path and finds the cover.
+// Unlike List, it doesn't read CUE sheets and chapters.
+func (ml *MediaLibrary) ListEntries(p string) (*ListingEntries, error) {
 	dirs, files, err := ml.store.List(p)
 	if err != nil {
 		return nil, err
@@ -67,28 +248,135 @@ func (ml *MediaLibrary) List(p string) (*MediaListing, error) {
 		cover = ml.findCover(artworkFiles)
 	}
 
+	return &ListingEntries{
+		Path:        p,
+		Directories: dirs,
+		Files:       files,
+		Cover:       cover,
+	}, nil
+}
+
+// List returns directory listing under the provided path.
+func (ml *MediaLibrary) List(p string) (*MediaListing, error) {
+	entries, err := ml.ListEntries(p)
+	if err != nil {
+		return nil, err
+	}
+	return ml.Listing(entries)
+}
+
+// Listing returns directory listing of the entries.
+func (ml *MediaLibrary) Listing(entries *ListingEntries) (*MediaListing, error) {
+	p, dirs, files, cover := entries.Path, entries.Directories, entries.Files, entries.Cover
+
 	// Find audio tracks and separate all other files.
 	var tracks []*StorageFile
 	var otherFiles []*StorageFile
 	for _, f := range files {
-		if IsAudioFile(f) {
+		if ml.media.IsAudioFile(f) {
 			tracks = append(tracks, f)
 		} else if cover == nil || f.Path() != cover.Path() {
 			otherFiles = append(otherFiles, f)
 		}
 	}
 
+	cueTracks := ml.findCueTracks(otherFiles, tracks)
+
+	var lyrics map[string]*StorageFile
+	for _, track := range tracks {
+		if lrc := findLyricsFile(track, otherFiles); lrc != nil {
+			if lyrics == nil {
+				lyrics = make(map[string]*StorageFile)
+			}
+			lyrics[track.Path()] = lrc
+		}
+	}
+
+	audiobook := len(tracks) > 0 && ml.isAudiobook(p, tracks)
+	var chapters map[string][]*Chapter
+	if audiobook {
+		chapters = ml.findChapters(tracks)
+	}
+
 	listing := &MediaListing{
 		CurrentDirectory: NewStorageDirectory(p),
 		Directories:      dirs,
 		Files:            otherFiles,
 		Cover:            cover,
 		AudioTracks:      tracks,
+		CueTracks:        cueTracks,
+		Lyrics:           lyrics,
+		Audiobook:        audiobook,
+		Chapters:         chapters,
 	}
 	return listing, nil
 }
 
+var errNoLyrics = errors.New("no lyrics")
+
+// Lyrics returns lyrics for the audio track under the given path.
+func (ml *MediaLibrary) Lyrics(p string) (*Lyrics, error) {
+	dir := path.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+	_, files, err := ml.store.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	lrc := findLyricsFile(NewStorageFile(p, 0), files)
+	if lrc == nil {
+		return nil, errNoLyrics
+	}
+	data, err := ml.store.ReadFile(lrc.Path())
+	if err != nil {
+		return nil, err
+	}
+	return ParseLRC(data), nil
+}
+
 // ContentURL returns a public URL to a file under the given path.
 func (ml *MediaLibrary) ContentURL(p string) (string, error) {
 	return ml.store.FileContentURL(p)
 }
+
+// AudioTracks returns audio tracks under the provided path. The path can be either a directory or a single audio file.
+func (ml *MediaLibrary) AudioTracks(p string) ([]*StorageFile, error) {
+	listing, err := ml.List(p)
+	if err == nil {
+		return listing.AudioTracks, nil
+	}
+	f := NewStorageFile(p, 0)
+	if !ml.media.IsAudioFile(f) {
+		return nil, err
+	}
+	size, err := ml.store.FileSize(p)
+	if err != nil {
+		return nil, err
+	}
+	f.Size = size
+	return []*StorageFile{f}, nil
+}
+
+// AudioTracksTree returns audio tracks in the directory tree under the provided path.
+// Tracks in a directory come before tracks in its subdirectories.
+func (ml *MediaLibrary) AudioTracksTree(p string) ([]*StorageFile, error) {
+	dirs, files, err := ml.store.List(p)
+	if err != nil {
+		return nil, err
+	}
+	var tracks []*StorageFile
+	for _, f := range files {
+		if ml.media.IsAudioFile(f) {
+			tracks = append(tracks, f)
+		}
+	}
+	for _, dir := range dirs {
+		dirTracks, err := ml.AudioTracksTree(dir.Path())
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, dirTracks...)
+	}
+	return tracks, nil
+}
@@ -1,14 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// clearObjectMetadata resets modification times and ETags assigned by the fake S3 backend.
+func clearObjectMetadata(l *MediaListing) {
+	var all []*StorageFile
+	all = append(all, l.AudioTracks...)
+	all = append(all, l.Files...)
+	if l.Cover != nil {
+		all = append(all, l.Cover)
+	}
+	for _, f := range all {
+		f.LastModified = time.Time{}
+		f.ETag = ""
+	}
+}
+
 func TestMediaLibrary(t *testing.T) {
 	asrt := assert.New(t)
 
@@ -26,6 +45,7 @@ func TestMediaLibrary(t *testing.T) {
 	keys := []string{
 		"music/Aphex Twin/1992 - Selected Ambient Works 85-92/01. Xtal.mp3",
 		"music/Aphex Twin/1992 - Selected Ambient Works 85-92/Cover.jpg",
+		"music/Aphex Twin/1992 - Selected Ambient Works 85-92/01. Xtal.lrc",
 		"music/Aphex Twin/1999 - Windowlicker/01 Windowlicker.mp3",
 		"music/Aphex Twin/1999 - Windowlicker/02 [Equation].mp3",
 		"music/Aphex Twin/1999 - Windowlicker/03 Nannou.mp3",
@@ -47,11 +67,32 @@ func TestMediaLibrary(t *testing.T) {
 		asrt.NoError(err)
 	}
 
+	cueSheet := `FILE "Boards of Canada - Geogaddi.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE "Ready Lets Go"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Music Is Math"
+    INDEX 01 01:00:00`
+	cueKeys := map[string]string{
+		"music/Boards of Canada/2002 - Geogaddi/Boards of Canada - Geogaddi.flac": "1",
+		"music/Boards of Canada/2002 - Geogaddi/Boards of Canada - Geogaddi.cue":  cueSheet,
+	}
+	for key, content := range cueKeys {
+		_, err := storage.s3.PutObject(&s3.PutObjectInput{
+			Body:   strings.NewReader(content),
+			Bucket: aws.String("test"),
+			Key:    aws.String(key),
+		})
+		asrt.NoError(err)
+	}
+
 	testCases := map[string]MediaListing{
 		"": {
 			CurrentDirectory: NewStorageDirectory(""),
 			Directories: []*StorageDirectory{
 				NewStorageDirectory("Aphex Twin"),
+				NewStorageDirectory("Boards of Canada"),
 				NewStorageDirectory("The Prodigy"),
 				NewStorageDirectory("Venetian Snares"),
 			},
@@ -69,6 +110,12 @@ func TestMediaLibrary(t *testing.T) {
 				NewStorageFile("Aphex Twin/1992 - Selected Ambient Works 85-92/01. Xtal.mp3", 1),
 			},
 			Cover: NewStorageFile("Aphex Twin/1992 - Selected Ambient Works 85-92/Cover.jpg", 1),
+			Files: []*StorageFile{
+				NewStorageFile("Aphex Twin/1992 - Selected Ambient Works 85-92/01. Xtal.lrc", 1),
+			},
+			Lyrics: map[string]*StorageFile{
+				"Aphex Twin/1992 - Selected Ambient Works 85-92/01. Xtal.mp3": NewStorageFile("Aphex Twin/1992 - Selected Ambient Works 85-92/01. Xtal.lrc", 1),
+			},
 		},
 		"Aphex Twin/1999 - Windowlicker": {
 			CurrentDirectory: NewStorageDirectory("Aphex Twin/1999 - Windowlicker"),
@@ -85,6 +132,21 @@ func TestMediaLibrary(t *testing.T) {
 				NewStorageFile("Aphex Twin/1999 - Windowlicker/back.jpg", 1),
 			},
 		},
+		"Boards of Canada/2002 - Geogaddi": {
+			CurrentDirectory: NewStorageDirectory("Boards of Canada/2002 - Geogaddi"),
+			AudioTracks: []*StorageFile{
+				NewStorageFile("Boards of Canada/2002 - Geogaddi/Boards of Canada - Geogaddi.flac", 1),
+			},
+			Files: []*StorageFile{
+				NewStorageFile("Boards of Canada/2002 - Geogaddi/Boards of Canada - Geogaddi.cue", int64(len(cueSheet))),
+			},
+			CueTracks: map[string][]*CueTrack{
+				"Boards of Canada/2002 - Geogaddi/Boards of Canada - Geogaddi.flac": {
+					{Number: 1, Title: "Ready Lets Go", End: time.Minute},
+					{Number: 2, Title: "Music Is Math", Start: time.Minute},
+				},
+			},
+		},
 		"The Prodigy": {
 			CurrentDirectory: NewStorageDirectory("The Prodigy"),
 			Directories: []*StorageDirectory{
@@ -123,16 +185,98 @@ func TestMediaLibrary(t *testing.T) {
 		},
 	}
 
-	ml := NewMediaLibrary(storage)
+	ml := NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{})
 	for path, expectedListing := range testCases {
 		l, err := ml.List(path)
 		asrt.NoError(err)
+		clearObjectMetadata(l)
 		asrt.EqualValues(&expectedListing, l, path)
 	}
 
+	lyrics, err := ml.Lyrics("Aphex Twin/1992 - Selected Ambient Works 85-92/01. Xtal.mp3")
+	asrt.NoError(err)
+	asrt.Equal(&Lyrics{Lines: []LyricsLine{{Text: "1"}}}, lyrics)
+	_, err = ml.Lyrics("Aphex Twin/1999 - Windowlicker/01 Windowlicker.mp3")
+	asrt.ErrorIs(err, errNoLyrics)
+
 	// Path doesn't exist.
 	_, err = ml.List("music")
 	asrt.Error(err)
 	_, err = ml.List("The Prodigy/1992 - The Prodigy Experience/CD3")
 	asrt.Error(err)
 }
+
+func TestMediaLibrary_ChaptersCache(t *testing.T) {
+	storage := newTestStorage(t, "test")
+	putBook := func(titles ...string) {
+		var chapters []*Chapter
+		for i, title := range titles {
+			chapters = append(chapters, &Chapter{Title: title, Start: time.Duration(i) * time.Minute})
+		}
+		file := bytes.Join([][]byte{
+			box("ftyp", []byte("M4B ")),
+			box("moov", box("udta", chpl(chapters...))),
+		}, nil)
+		require.NoError(t, storage.WriteObject("Dune/1.m4b", file, ""))
+	}
+	ml := NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{})
+	list := func() ([]*Chapter, int64) {
+		ctx, stats := withRequestStats(context.Background())
+		l, err := ml.WithContext(ctx).List("Dune")
+		require.NoError(t, err)
+		return l.Chapters["Dune/1.m4b"], stats.s3Requests.Load()
+	}
+
+	putBook("Prologue", "Chapter 1")
+	chapters, uncachedRequests := list()
+	require.Len(t, chapters, 2)
+	assert.Equal(t, "Prologue", chapters[0].Title)
+	chapters, requests := list()
+	require.Len(t, chapters, 2)
+	assert.Less(t, requests, uncachedRequests)
+
+	// Changed tracks are read again.
+	putBook("Intro", "Chapter 1", "Chapter 2")
+	chapters, _ = list()
+	require.Len(t, chapters, 3)
+	assert.Equal(t, "Intro", chapters[0].Title)
+}
+
+// cueReadErrorStorage fails reading CUE sheets.
+type cueReadErrorStorage struct {
+	Storage
+}
+
+func (s cueReadErrorStorage) ReadFile(p string) ([]byte, error) {
+	if strings.HasSuffix(p, ".cue") {
+		return nil, errors.New("read failed")
+	}
+	return s.Storage.ReadFile(p)
+}
+
+func TestMediaLibrary_CueReadError(t *testing.T) {
+	storage := newTestStorage(t, "test", "Geogaddi/Geogaddi.flac")
+	require.NoError(t, storage.WriteObject("Geogaddi/Geogaddi.cue", []byte(`FILE "Geogaddi.flac" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    INDEX 01 01:00:00`), ""))
+
+	ml := NewMediaLibrary(cueReadErrorStorage{storage}, newTestMediaDetector(t), AudiobooksConfig{})
+	l, err := ml.List("Geogaddi")
+	require.NoError(t, err)
+	require.Len(t, l.AudioTracks, 1)
+	assert.Equal(t, "Geogaddi/Geogaddi.flac", l.AudioTracks[0].Path())
+	assert.Empty(t, l.CueTracks)
+}
+
+func TestMediaLibrary_isAudiobook(t *testing.T) {
+	ml := NewMediaLibrary(nil, nil, AudiobooksConfig{
+		Prefixes: []string{"Audiobooks"},
+	})
+	assert.True(t, ml.isAudiobook("Audiobooks", files("Audiobooks/1.mp3")))
+	assert.True(t, ml.isAudiobook("Audiobooks/Dune", files("Audiobooks/Dune/1.mp3")))
+	assert.False(t, ml.isAudiobook("AudiobooksX", files("AudiobooksX/1.mp3")))
+	assert.True(t, ml.isAudiobook("Misc", files("Misc/1.mp3", "Misc/2.M4B")))
+	assert.False(t, ml.isAudiobook("Misc", files("Misc/1.mp3", "Misc/2.m4a")))
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Chapter is a chapter within an audio file.
+type Chapter struct {
+	Title string
+	Start time.Duration
+	// End is zero for the last chapter, meaning the chapter lasts until the end of the file.
+	End time.Duration
+}
+
+// StartSeconds returns the chapter start offset in seconds.
+func (c *Chapter) StartSeconds() float64 {
+	return c.Start.Seconds()
+}
+
+// EndSeconds returns the chapter end offset in seconds, or zero if the chapter lasts until the end of the file.
+func (c *Chapter) EndSeconds() float64 {
+	return c.End.Seconds()
+}
+
+// IsMP4File returns whether the given file is an MP4 container that may have chapters.
+func IsMP4File(f *StorageFile) bool {
+	_, ext := splitNameExt(strings.ToLower(f.Name()))
+	return ext == "m4b" || ext == "m4a" || ext == "mp4"
+}
+
+// maxMP4MovieBoxSize limits the size of the metadata read from an MP4 file.
+const maxMP4MovieBoxSize = 32 << 20
+
+// maxMP4ChapterTextSize limits the size of chapter titles read at once.
+const maxMP4ChapterTextSize = 1 << 20
+
+var errNoMovieBox = errors.New("mp4 moov box not found")
+
+type mp4Box struct {
+	typ  string
+	data []byte
+}
+
+// parseMP4Boxes splits box content into child boxes.
+func parseMP4Boxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated mp4 box")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		hdrLen := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("truncated mp4 box")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			hdrLen = 16
+		}
+		if size < hdrLen || size > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid mp4 box %q size %d", typ, size)
+		}
+		boxes = append(boxes, mp4Box{typ: typ, data: data[hdrLen:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// findMP4Box returns the first child box on the given path, e.g. "udta", "chpl".
+func findMP4Box(data []byte, path ...string) ([]byte, bool) {
+	for _, typ := range path {
+		boxes, err := parseMP4Boxes(data)
+		if err != nil {
+			return nil, false
+		}
+		found := false
+		for _, box := range boxes {
+			if box.typ == typ {
+				data = box.data
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// readMP4MovieBox finds the top-level moov box and returns its content.
+func readMP4MovieBox(r io.ReaderAt, size int64) ([]byte, error) {
+	var offset int64
+	hdr := make([]byte, 16)
+	for offset+8 <= size {
+		n, err := r.ReadAt(hdr, offset)
+		if n < 8 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr))
+		typ := string(hdr[4:8])
+		hdrLen := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - offset
+		case 1:
+			if n < 16 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:]))
+			hdrLen = 16
+		}
+		if boxSize < hdrLen {
+			return nil, fmt.Errorf("invalid mp4 box %q size %d", typ, boxSize)
+		}
+		if typ == "moov" {
+			if boxSize > maxMP4MovieBoxSize {
+				return nil, fmt.Errorf("mp4 moov box is too large: %d", boxSize)
+			}
+			if offset+boxSize > size {
+				return nil, io.ErrUnexpectedEOF
+			}
+			data := make([]byte, boxSize-hdrLen)
+			if _, err := r.ReadAt(data, offset+hdrLen); err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			return data, nil
+		}
+		offset += boxSize
+	}
+	return nil, errNoMovieBox
+}
+
+// parseNeroChapters parses the chpl box written by Nero and FFmpeg. Start times are in 100ns units.
+func parseNeroChapters(data []byte) ([]*Chapter, error) {
+	errTruncated := errors.New("truncated mp4 chpl box")
+	if len(data) < 4 {
+		return nil, errTruncated
+	}
+	version := data[0]
+	data = data[4:]
+	if version != 0 {
+		if len(data) < 4 {
+			return nil, errTruncated
+		}
+		data = data[4:]
+	}
+	if len(data) < 1 {
+		return nil, errTruncated
+	}
+	count := int(data[0])
+	data = data[1:]
+	var chapters []*Chapter
+	for i := 0; i < count; i++ {
+		if len(data) < 9 {
+			return nil, errTruncated
+		}
+		start := binary.BigEndian.Uint64(data)
+		titleLen := int(data[8])
+		data = data[9:]
+		if len(data) < titleLen {
+			return nil, errTruncated
+		}
+		chapters = append(chapters, &Chapter{
+			Title: string(data[:titleLen]),
+			Start: time.Duration(start * 100),
+		})
+		data = data[titleLen:]
+	}
+	return chapters, nil
+}
+
+type mp4TextTrack struct {
+	timescale     uint32
+	sampleDeltas  []uint32
+	sampleOffsets []int64
+	sampleSizes   []uint32
+}
+
+// parseMP4SampleTable reads sample timing and locations from the trak box.
+func parseMP4SampleTable(trak []byte) (*mp4TextTrack, error) {
+	errInvalid := errors.New("invalid mp4 sample table")
+	mdhd, ok := findMP4Box(trak, "mdia", "mdhd")
+	if !ok || len(mdhd) < 1 {
+		return nil, errInvalid
+	}
+	track := &mp4TextTrack{}
+	if mdhd[0] == 1 {
+		if len(mdhd) < 24 {
+			return nil, errInvalid
+		}
+		track.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	} else {
+		if len(mdhd) < 16 {
+			return nil, errInvalid
+		}
+		track.timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	if track.timescale == 0 {
+		return nil, errInvalid
+	}
+	stbl, ok := findMP4Box(trak, "mdia", "minf", "stbl")
+	if !ok {
+		return nil, errInvalid
+	}
+
+	// Sample durations.
+	stts, ok := findMP4Box(stbl, "stts")
+	if !ok || len(stts) < 8 {
+		return nil, errInvalid
+	}
+	entries := int(binary.BigEndian.Uint32(stts[4:]))
+	if len(stts) < 8+entries*8 {
+		return nil, errInvalid
+	}
+	for i := 0; i < entries; i++ {
+		count := binary.BigEndian.Uint32(stts[8+i*8:])
+		delta := binary.BigEndian.Uint32(stts[12+i*8:])
+		for j := uint32(0); j < count && len(track.sampleDeltas) < 0xffff; j++ {
+			track.sampleDeltas = append(track.sampleDeltas, delta)
+		}
+	}
+	numSamples := len(track.sampleDeltas)
+
+	// Sample sizes.
+	stsz, ok := findMP4Box(stbl, "stsz")
+	if !ok || len(stsz) < 12 {
+		return nil, errInvalid
+	}
+	fixedSize := binary.BigEndian.Uint32(stsz[4:])
+	for i := 0; i < numSamples; i++ {
+		if fixedSize != 0 {
+			track.sampleSizes = append(track.sampleSizes, fixedSize)
+			continue
+		}
+		if len(stsz) < 16+i*4 {
+			return nil, errInvalid
+		}
+		track.sampleSizes = append(track.sampleSizes, binary.BigEndian.Uint32(stsz[12+i*4:]))
+	}
+
+	// Chunk offsets.
+	var chunkOffsets []int64
+	if stco, ok := findMP4Box(stbl, "stco"); ok && len(stco) >= 8 {
+		n := int(binary.BigEndian.Uint32(stco[4:]))
+		if len(stco) < 8+n*4 {
+			return nil, errInvalid
+		}
+		for i := 0; i < n; i++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint32(stco[8+i*4:])))
+		}
+	} else if co64, ok := findMP4Box(stbl, "co64"); ok && len(co64) >= 8 {
+		n := int(binary.BigEndian.Uint32(co64[4:]))
+		if len(co64) < 8+n*8 {
+			return nil, errInvalid
+		}
+		for i := 0; i < n; i++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint64(co64[8+i*8:])))
+		}
+	} else {
+		return nil, errInvalid
+	}
+
+	// Samples to chunks.
+	stsc, ok := findMP4Box(stbl, "stsc")
+	if !ok || len(stsc) < 8 {
+		return nil, errInvalid
+	}
+	n := int(binary.BigEndian.Uint32(stsc[4:]))
+	if len(stsc) < 8+n*12 || n == 0 {
+		return nil, errInvalid
+	}
+	sample := 0
+	for i := 0; i < n && sample < numSamples; i++ {
+		firstChunk := int(binary.BigEndian.Uint32(stsc[8+i*12:])) - 1
+		samplesPerChunk := int(binary.BigEndian.Uint32(stsc[12+i*12:]))
+		lastChunk := len(chunkOffsets)
+		if i+1 < n {
+			lastChunk = int(binary.BigEndian.Uint32(stsc[8+(i+1)*12:])) - 1
+		}
+		if firstChunk < 0 || firstChunk >= len(chunkOffsets) || lastChunk < firstChunk {
+			return nil, errInvalid
+		}
+		for chunk := firstChunk; chunk < lastChunk && chunk < len(chunkOffsets) && sample < numSamples; chunk++ {
+			offset := chunkOffsets[chunk]
+			for j := 0; j < samplesPerChunk && sample < numSamples; j++ {
+				track.sampleOffsets = append(track.sampleOffsets, offset)
+				offset += int64(track.sampleSizes[sample])
+				sample++
+			}
+		}
+	}
+	if len(track.sampleOffsets) != numSamples {
+		return nil, errInvalid
+	}
+	return track, nil
+}
+
+// decodeMP4Text decodes a text sample: a 16-bit length followed by UTF-8 or UTF-16 text.
+func decodeMP4Text(sample []byte) string {
+	if len(sample) < 2 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(sample))
+	sample = sample[2:]
+	if n < len(sample) {
+		sample = sample[:n]
+	}
+	if bytes.HasPrefix(sample, []byte{0xfe, 0xff}) && len(sample)%2 == 0 {
+		u := make([]uint16, 0, len(sample)/2-1)
+		for i := 2; i < len(sample); i += 2 {
+			u = append(u, binary.BigEndian.Uint16(sample[i:]))
+		}
+		return string(utf16.Decode(u))
+	}
+	return string(sample)
+}
+
+// readQuickTimeChapters reads chapters from a text track referenced by the tref/chap box of another track.
+func readQuickTimeChapters(r io.ReaderAt, moov []byte) ([]*Chapter, error) {
+	boxes, err := parseMP4Boxes(moov)
+	if err != nil {
+		return nil, err
+	}
+	var chapterTrackID uint32
+	traks := make(map[uint32][]byte)
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+		tkhd, ok := findMP4Box(box.data, "tkhd")
+		if !ok || len(tkhd) < 1 {
+			continue
+		}
+		idOffset := 12
+		if tkhd[0] == 1 {
+			idOffset = 20
+		}
+		if len(tkhd) < idOffset+4 {
+			continue
+		}
+		traks[binary.BigEndian.Uint32(tkhd[idOffset:])] = box.data
+		if chap, ok := findMP4Box(box.data, "tref", "chap"); ok && len(chap) >= 4 && chapterTrackID == 0 {
+			chapterTrackID = binary.BigEndian.Uint32(chap)
+		}
+	}
+	trak, ok := traks[chapterTrackID]
+	if chapterTrackID == 0 || !ok {
+		return nil, nil
+	}
+	track, err := parseMP4SampleTable(trak)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(track.sampleOffsets) == 0 {
+		return nil, nil
+	}
+
+	// Chapter titles are usually stored next to each other, read them at once to avoid a request per chapter.
+	start := track.sampleOffsets[0]
+	end := start
+	for i, offset := range track.sampleOffsets {
+		start = min(start, offset)
+		end = max(end, offset+int64(track.sampleSizes[i]))
+	}
+	var samples []byte
+	if end-start <= maxMP4ChapterTextSize {
+		samples = make([]byte, end-start)
+		if _, err := r.ReadAt(samples, start); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	}
+
+	var chapters []*Chapter
+	var t uint64
+	for i, offset := range track.sampleOffsets {
+		var sample []byte
+		if samples != nil {
+			sample = samples[offset-start : offset-start+int64(track.sampleSizes[i])]
+		} else {
+			if track.sampleSizes[i] > maxMP4ChapterTextSize {
+				// Titles can't be this large, the sample is skipped rather than read into memory.
+				t += uint64(track.sampleDeltas[i])
+				continue
+			}
+			sample = make([]byte, track.sampleSizes[i])
+			if _, err := r.ReadAt(sample, offset); err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+		}
+		chapters = append(chapters, &Chapter{
+			Title: decodeMP4Text(sample),
+			Start: time.Duration(t * uint64(time.Second) / uint64(track.timescale)),
+		})
+		t += uint64(track.sampleDeltas[i])
+	}
+	return chapters, nil
+}
+
+// ReadMP4Chapters returns chapters of an MP4 file. Both Nero (chpl) and QuickTime (chapter text track) chapters are supported.
+// It returns nil if the file doesn't have chapters.
+func ReadMP4Chapters(r io.ReaderAt, size int64) ([]*Chapter, error) {
+	moov, err := readMP4MovieBox(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var chapters []*Chapter
+	if chpl, ok := findMP4Box(moov, "udta", "chpl"); ok {
+		chapters, err = parseNeroChapters(chpl)
+	} else {
+		chapters, err = readQuickTimeChapters(r, moov)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(chapters, func(i, j int) bool {
+		return chapters[i].Start < chapters[j].Start
+	})
+	for i := 0; i < len(chapters)-1; i++ {
+		chapters[i].End = chapters[i+1].Start
+	}
+	return chapters, nil
+}
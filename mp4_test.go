@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func box(typ string, children ...[]byte) []byte {
+	content := bytes.Join(children, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	b = append(b, typ...)
+	return append(b, content...)
+}
+
+func u32(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func chpl(chapters ...*Chapter) []byte {
+	b := []byte{1, 0, 0, 0, 0, 0, 0, 0, byte(len(chapters))}
+	for _, c := range chapters {
+		b = binary.BigEndian.AppendUint64(b, uint64(c.Start/100))
+		b = append(b, byte(len(c.Title)))
+		b = append(b, c.Title...)
+	}
+	return box("chpl", b)
+}
+
+func TestReadMP4Chapters_Nero(t *testing.T) {
+	file := bytes.Join([][]byte{
+		box("ftyp", []byte("M4B ")),
+		box("mdat", make([]byte, 100)),
+		box("moov",
+			box("mvhd", make([]byte, 100)),
+			box("udta", chpl(
+				&Chapter{Title: "Prologue"},
+				&Chapter{Title: "Chapter 1", Start: 90 * time.Second},
+			)),
+		),
+	}, nil)
+
+	chapters, err := ReadMP4Chapters(bytes.NewReader(file), int64(len(file)))
+	assert.NoError(t, err)
+	assert.Equal(t, []*Chapter{
+		{Title: "Prologue", End: 90 * time.Second},
+		{Title: "Chapter 1", Start: 90 * time.Second},
+	}, chapters)
+}
+
+// chapterTrackMoov returns a moov box with a track referencing a chapter text track with the sample table boxes.
+func chapterTrackMoov(stbl ...[]byte) []byte {
+	tkhd := func(id uint32) []byte {
+		return box("tkhd", u32(0, 0, 0, id))
+	}
+	return box("moov",
+		box("trak",
+			tkhd(1),
+			box("tref", box("chap", u32(2))),
+		),
+		box("trak",
+			tkhd(2),
+			box("mdia",
+				box("mdhd", u32(0, 0, 0, 1000, 0)),
+				box("minf", box("stbl", stbl...)),
+			),
+		),
+	)
+}
+
+func TestReadMP4Chapters_QuickTime(t *testing.T) {
+	ftyp := box("ftyp", []byte("M4B "))
+	// Text samples: 16-bit length followed by the text.
+	samples := [][]byte{
+		append([]byte{0, 5}, "Intro"...),
+		append([]byte{0, 8, 0xfe, 0xff, 0, 'O', 0, 'n'}, 0, 'e'),
+	}
+	mdat := box("mdat", samples...)
+	sampleOffset := uint32(len(ftyp) + 8)
+
+	moov := chapterTrackMoov(
+		box("stts", u32(0, 2, 1, 60000, 1, 30000)),
+		box("stsz", u32(0, 0, 2, uint32(len(samples[0])), uint32(len(samples[1])))),
+		box("stsc", u32(0, 1, 1, 2, 1)),
+		box("stco", u32(0, 1, sampleOffset)),
+	)
+	file := bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+
+	chapters, err := ReadMP4Chapters(bytes.NewReader(file), int64(len(file)))
+	assert.NoError(t, err)
+	assert.Equal(t, []*Chapter{
+		{Title: "Intro", End: time.Minute},
+		{Title: "One", Start: time.Minute},
+	}, chapters)
+}
+
+func TestReadMP4Chapters_InvalidChunks(t *testing.T) {
+	ftyp := box("ftyp", []byte("M4B "))
+	mdat := box("mdat", append([]byte{0, 5}, "Intro"...))
+	sampleOffset := uint32(len(ftyp) + 8)
+
+	for _, stsc := range [][]byte{
+		u32(0, 1, 0, 1, 1),          // First chunks are numbered from 1.
+		u32(0, 1, 2, 1, 1),          // The first chunk is out of range.
+		u32(0, 2, 1, 1, 1, 0, 1, 1), // The next entry precedes the first chunk.
+	} {
+		moov := chapterTrackMoov(
+			box("stts", u32(0, 1, 1, 60000)),
+			box("stsz", u32(0, 7, 1)),
+			box("stsc", stsc),
+			box("stco", u32(0, 1, sampleOffset)),
+		)
+		file := bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+		_, err := ReadMP4Chapters(bytes.NewReader(file), int64(len(file)))
+		assert.Error(t, err)
+	}
+}
+
+func TestReadMP4Chapters_LargeSample(t *testing.T) {
+	ftyp := box("ftyp", []byte("M4B "))
+	mdat := box("mdat", append([]byte{0, 5}, "Intro"...))
+	sampleOffset := uint32(len(ftyp) + 8)
+
+	// The second sample claims to be almost 4 GiB.
+	moov := chapterTrackMoov(
+		box("stts", u32(0, 2, 1, 60000, 1, 30000)),
+		box("stsz", u32(0, 0, 2, 7, 0xfffffff0)),
+		box("stsc", u32(0, 1, 1, 1, 1)),
+		box("stco", u32(0, 2, sampleOffset, sampleOffset+7)),
+	)
+	file := bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+	chapters, err := ReadMP4Chapters(bytes.NewReader(file), int64(len(file)))
+	assert.NoError(t, err)
+	assert.Equal(t, []*Chapter{{Title: "Intro"}}, chapters)
+}
+
+func TestReadMP4Chapters_NoChapters(t *testing.T) {
+	file := bytes.Join([][]byte{
+		box("ftyp", []byte("M4A ")),
+		box("moov", box("mvhd", make([]byte, 100))),
+	}, nil)
+	chapters, err := ReadMP4Chapters(bytes.NewReader(file), int64(len(file)))
+	assert.NoError(t, err)
+	assert.Empty(t, chapters)
+
+	_, err = ReadMP4Chapters(bytes.NewReader(file[:12]), 12)
+	assert.ErrorIs(t, err, errNoMovieBox)
+
+	_, err = ReadMP4Chapters(bytes.NewReader(file[:20]), 20)
+	assert.Error(t, err)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mpdProtocolVersion is the MPD protocol version announced to clients.
+	mpdProtocolVersion = "0.23.0"
+
+	// mpdDefaultAddress only accepts local clients. Listening on other addresses should be combined with a password.
+	mpdDefaultAddress = "127.0.0.1:6600"
+
+	// mpdMaxLineLength limits the length of a command line.
+	mpdMaxLineLength = 64 * 1024
+)
+
+// MPD error codes returned in ACK responses.
+const (
+	mpdAckErrorArg        = 2
+	mpdAckErrorPassword   = 3
+	mpdAckErrorPermission = 4
+	mpdAckErrorUnknown    = 5
+	mpdAckErrorNoExist    = 50
+	mpdAckErrorSystem     = 52
+	mpdAckErrorExist      = 56
+)
+
+// mpdError is an error returned to the client in an ACK response.
+type mpdError struct {
+	Code    int
+	Message string
+}
+
+func (e *mpdError) Error() string {
+	return e.Message
+}
+
+func mpdArgError(format string, a ...any) error {
+	return &mpdError{Code: mpdAckErrorArg, Message: fmt.Sprintf(format, a...)}
+}
+
+// errMPDClose is returned by the close command to terminate the connection.
+var errMPDClose = errors.New("close")
+
+// MPDServer implements the MPD protocol backed by the media library.
+// Songs are identified by library paths, which clients stream through the HTTP /stream/ endpoint.
+type MPDServer struct {
+	cfg       MPDConfig
+	mediaLib  atomic.Pointer[MediaLibrary]
+	playlists atomic.Pointer[PlaylistStore]
+	queue     *mpdQueue
+	listings  *mpdListingCache
+	started   time.Time
+	// maxWalkDirectories limits directories visited by listall and find.
+	maxWalkDirectories int
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func NewMPDServer(cfg MPDConfig, mediaLib *MediaLibrary, playlists *PlaylistStore) *MPDServer {
+	if cfg.Address == "" {
+		cfg.Address = mpdDefaultAddress
+	}
+	m := &MPDServer{
+		cfg:                cfg,
+		queue:              newMPDQueue(),
+		listings:           newMPDListingCache(),
+		started:            time.Now(),
+		maxWalkDirectories: mpdMaxWalkDirectories,
+		conns:              make(map[net.Conn]struct{}),
+	}
+	m.SetLibrary(mediaLib, playlists)
+	return m
+}
+
+// SetLibrary replaces the library and playlists on config reloads. The queue and connections are kept.
+func (m *MPDServer) SetLibrary(mediaLib *MediaLibrary, playlists *PlaylistStore) {
+	m.mediaLib.Store(mediaLib)
+	m.playlists.Store(playlists)
+	m.listings.clear()
+}
+
+// Address returns the configured listen address.
+func (m *MPDServer) Address() string {
+	return m.cfg.Address
+}
+
+// ListenAndServe listens on the configured TCP address and serves MPD clients.
+func (m *MPDServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", m.cfg.Address)
+	if err != nil {
+		return err
+	}
+	if addr, ok := l.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && m.cfg.Password == "" {
+		slog.Warn("MPD server accepts remote clients without a password", slog.String("address", m.cfg.Address))
+	}
+	return m.Serve(l)
+}
+
+// Serve accepts MPD client connections on the listener until it's closed.
+func (m *MPDServer) Serve(l net.Listener) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	m.listener = l
+	m.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		m.mu.Lock()
+		m.conns[conn] = struct{}{}
+		m.mu.Unlock()
+		go func() {
+			m.serveConn(conn)
+			m.mu.Lock()
+			delete(m.conns, conn)
+			m.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections and closes all client connections.
+func (m *MPDServer) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for conn := range m.conns {
+		conn.Close()
+	}
+	if m.listener == nil {
+		return nil
+	}
+	return m.listener.Close()
+}
+
+// mpdConn is a client connection.
+type mpdConn struct {
+	server *MPDServer
+	w      *bufio.Writer
+	// buf accumulates the response to the current command or command list.
+	buf bytes.Buffer
+	// seq is the queue sequence number of the last change reported to the client.
+	seq int
+	// authorized is set when no password is configured or the client sent the password.
+	authorized bool
+}
+
+func (c *mpdConn) printf(format string, a ...any) {
+	fmt.Fprintf(&c.buf, format, a...)
+}
+
+// pair writes a "key: value" response line.
+func (c *mpdConn) pair(key string, value any) {
+	fmt.Fprintf(&c.buf, "%s: %v\n", key, value)
+}
+
+func (m *MPDServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 4096), mpdMaxLineLength)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	_, seq, _ := m.queue.Changes(0)
+	c := &mpdConn{
+		server:     m,
+		w:          bufio.NewWriter(conn),
+		seq:        seq,
+		authorized: m.cfg.Password == "",
+	}
+	fmt.Fprintf(c.w, "OK MPD %s\n", mpdProtocolVersion)
+	if err := c.w.Flush(); err != nil {
+		return
+	}
+
+	for line := range lines {
+		var err error
+		switch strings.TrimSpace(line) {
+		case "command_list_begin", "command_list_ok_begin":
+			var list []string
+			for l := range lines {
+				if strings.TrimSpace(l) == "command_list_end" {
+					break
+				}
+				list = append(list, l)
+			}
+			err = c.executeList(list, strings.TrimSpace(line) == "command_list_ok_begin")
+		default:
+			name, args, parseErr := parseMPDCommand(line)
+			if parseErr == nil && name == "idle" && c.authorized {
+				err = c.idle(args, lines)
+			} else {
+				err = c.executeList([]string{line}, false)
+			}
+		}
+		if _, werr := c.w.Write(c.buf.Bytes()); werr != nil {
+			return
+		}
+		c.buf.Reset()
+		if werr := c.w.Flush(); werr != nil || err != nil {
+			return
+		}
+	}
+}
+
+// executeList runs commands and appends the responses to the buffer.
+// It stops at the first failed command and reports its position in the list.
+// It only returns an error when the connection must be closed.
+func (c *mpdConn) executeList(list []string, listOK bool) error {
+	for i, line := range list {
+		name, args, err := parseMPDCommand(line)
+		if err == nil {
+			mark := c.buf.Len()
+			err = c.execute(name, args)
+			if err != nil {
+				c.buf.Truncate(mark)
+			}
+		}
+		if errors.Is(err, errMPDClose) {
+			return err
+		}
+		if err != nil {
+			var mpdErr *mpdError
+			if !errors.As(err, &mpdErr) {
+				slog.Error("failed executing MPD command", slog.Any("err", err), slog.String("command", name))
+				mpdErr = &mpdError{Code: mpdAckErrorSystem, Message: err.Error()}
+			}
+			c.printf("ACK [%d@%d] {%s} %s\n", mpdErr.Code, i, name, mpdErr.Message)
+			return nil
+		}
+		if listOK {
+			c.printf("list_OK\n")
+		}
+	}
+	c.printf("OK\n")
+	return nil
+}
+
+func (c *mpdConn) execute(name string, args []string) error {
+	if !c.permitted(name) {
+		return &mpdError{Code: mpdAckErrorPermission, Message: fmt.Sprintf("you don't have permission for \"%s\"", name)}
+	}
+	cmd, ok := mpdCommands[name]
+	if !ok {
+		return &mpdError{Code: mpdAckErrorUnknown, Message: fmt.Sprintf("unknown command \"%s\"", name)}
+	}
+	return cmd(c, args)
+}
+
+// idle waits until one of the subsystems changes or the client sends noidle.
+// Changes made since the previous command are reported immediately.
+func (c *mpdConn) idle(args []string, lines <-chan string) error {
+	match := func(changed []string) []string {
+		if len(args) == 0 {
+			return changed
+		}
+		var matched []string
+		for _, s := range changed {
+			for _, arg := range args {
+				if s == arg {
+					matched = append(matched, s)
+				}
+			}
+		}
+		return matched
+	}
+	for {
+		changed, seq, wait := c.server.queue.Changes(c.seq)
+		changed = match(changed)
+		if len(changed) > 0 {
+			c.seq = seq
+			for _, s := range changed {
+				c.pair("changed", s)
+			}
+			c.printf("OK\n")
+			return nil
+		}
+		select {
+		case <-wait:
+		case line, ok := <-lines:
+			if !ok || strings.TrimSpace(line) != "noidle" {
+				// Only noidle is allowed while idle.
+				return errMPDClose
+			}
+			c.seq = seq
+			c.printf("OK\n")
+			return nil
+		}
+	}
+}
+
+// parseMPDCommand splits a command line into the command name and arguments.
+// Arguments containing spaces are enclosed in double quotes, with quotes and backslashes escaped by a backslash.
+func parseMPDCommand(line string) (string, []string, error) {
+	var tokens []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '"':
+			var arg strings.Builder
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				arg.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return "", nil, mpdArgError("Missing closing '\"'")
+			}
+			i++
+			tokens = append(tokens, arg.String())
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' && line[j] != '\r' && line[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		}
+	}
+	if len(tokens) == 0 {
+		return "", nil, &mpdError{Code: mpdAckErrorUnknown, Message: "No command given"}
+	}
+	return strings.ToLower(tokens[0]), tokens[1:], nil
+}
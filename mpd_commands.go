@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type mpdCommand func(c *mpdConn, args []string) error
+
+var mpdCommands map[string]mpdCommand
+
+func init() {
+	mpdCommands = map[string]mpdCommand{
+		"ping":         func(c *mpdConn, args []string) error { return nil },
+		"close":        func(c *mpdConn, args []string) error { return errMPDClose },
+		"commands":     mpdListCommands,
+		"notcommands":  mpdNotCommands,
+		"password":     mpdPassword,
+		"tagtypes":     mpdTagTypes,
+		"outputs":      func(c *mpdConn, args []string) error { return nil },
+		"decoders":     func(c *mpdConn, args []string) error { return nil },
+		"urlhandlers":  func(c *mpdConn, args []string) error { return nil },
+		"update":       mpdUpdate,
+		"rescan":       mpdUpdate,
+		"status":       mpdStatusCommand,
+		"stats":        mpdStats,
+		"currentsong":  mpdCurrentSong,
+		"lsinfo":       mpdLsInfo,
+		"listall":      func(c *mpdConn, args []string) error { return mpdListAll(c, args, false) },
+		"listallinfo":  func(c *mpdConn, args []string) error { return mpdListAll(c, args, true) },
+		"find":         func(c *mpdConn, args []string) error { return mpdFind(c, args, false, false) },
+		"search":       func(c *mpdConn, args []string) error { return mpdFind(c, args, true, false) },
+		"findadd":      func(c *mpdConn, args []string) error { return mpdFind(c, args, false, true) },
+		"searchadd":    func(c *mpdConn, args []string) error { return mpdFind(c, args, true, true) },
+		"add":          mpdAdd,
+		"addid":        mpdAdd,
+		"clear":        mpdClear,
+		"delete":       mpdDelete,
+		"deleteid":     mpdDeleteID,
+		"move":         mpdMove,
+		"moveid":       mpdMoveID,
+		"playlistinfo": mpdPlaylistInfo,
+		"playlistid":   mpdPlaylistID,
+		"plchanges":    mpdPlaylistChanges,
+		"plchangesposid": func(c *mpdConn, args []string) error {
+			for i, song := range c.server.queue.Songs() {
+				c.pair("cpos", i)
+				c.pair("Id", song.ID)
+			}
+			return nil
+		},
+		"play":               mpdPlay,
+		"playid":             mpdPlayID,
+		"pause":              mpdPause,
+		"stop":               func(c *mpdConn, args []string) error { c.server.queue.Stop(); return nil },
+		"next":               func(c *mpdConn, args []string) error { c.server.queue.Skip(1); return nil },
+		"previous":           func(c *mpdConn, args []string) error { c.server.queue.Skip(-1); return nil },
+		"seek":               mpdSeek,
+		"seekid":             mpdSeekID,
+		"seekcur":            mpdSeekCur,
+		"setvol":             mpdSetVol,
+		"repeat":             mpdOption("repeat"),
+		"random":             mpdOption("random"),
+		"single":             mpdOption("single"),
+		"consume":            mpdOption("consume"),
+		"listplaylists":      mpdListPlaylists,
+		"listplaylist":       func(c *mpdConn, args []string) error { return mpdListPlaylist(c, args, false) },
+		"listplaylistinfo":   func(c *mpdConn, args []string) error { return mpdListPlaylist(c, args, true) },
+		"load":               mpdLoad,
+		"save":               mpdSave,
+		"rm":                 mpdRemovePlaylist,
+		"rename":             mpdRenamePlaylist,
+		"playlistadd":        mpdPlaylistAdd,
+		"playlistclear":      mpdPlaylistClear,
+		"playlistdelete":     mpdPlaylistDelete,
+		"playlistmove":       mpdPlaylistMove,
+		"replay_gain_status": func(c *mpdConn, args []string) error { c.pair("replay_gain_mode", "off"); return nil },
+	}
+}
+
+func mpdArgCount(args []string, min int, max int) error {
+	if len(args) < min || len(args) > max {
+		return mpdArgError("wrong number of arguments")
+	}
+	return nil
+}
+
+func parseMPDInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, mpdArgError("Integer expected: %s", s)
+	}
+	return n, nil
+}
+
+func parseMPDBool(s string) (bool, error) {
+	switch s {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, mpdArgError("Boolean (0/1) expected: %s", s)
+}
+
+func parseMPDTime(s string) (time.Duration, error) {
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil || sec < 0 {
+		return 0, mpdArgError("Number expected: %s", s)
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
+
+// parseMPDRange parses a "START:END" range or a single position. A missing end means the end of the list.
+func parseMPDRange(s string, length int) (int, int, error) {
+	startStr, endStr, isRange := strings.Cut(s, ":")
+	start, err := parseMPDInt(startStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := start + 1
+	if isRange {
+		end = length
+		if endStr != "" {
+			if end, err = parseMPDInt(endStr); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if start < 0 || end < start {
+		return 0, 0, mpdArgError("Bad song index")
+	}
+	return start, end, nil
+}
+
+// mpdPath converts a URI to a library path.
+func mpdPath(uri string) (string, error) {
+	p := strings.Trim(uri, Delimiter)
+	if !isValidPath(p) {
+		return "", &mpdError{Code: mpdAckErrorArg, Message: errInvalidPath.Error()}
+	}
+	return p, nil
+}
+
+var errMPDNoExist = &mpdError{Code: mpdAckErrorNoExist, Message: "No such file or directory"}
+
+func queueError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &mpdError{Code: mpdAckErrorArg, Message: err.Error()}
+}
+
+func (c *mpdConn) songInfo(f *StorageFile) {
+	c.pair("file", f.Path())
+	if !f.LastModified.IsZero() {
+		c.pair("Last-Modified", f.LastModified.UTC().Format(time.RFC3339))
+	}
+	c.pair("Title", f.FriendlyName())
+}
+
+func (c *mpdConn) queueSongInfo(pos int, song *mpdSong) {
+	c.songInfo(song.File)
+	c.pair("Pos", pos)
+	c.pair("Id", song.ID)
+}
+
+// mpdPublicCommands can be run before the client sends the password.
+var mpdPublicCommands = map[string]bool{
+	"close":       true,
+	"commands":    true,
+	"notcommands": true,
+	"password":    true,
+	"ping":        true,
+	"tagtypes":    true,
+}
+
+// permitted returns whether the client is allowed to run the command.
+func (c *mpdConn) permitted(name string) bool {
+	return c.authorized || mpdPublicCommands[name]
+}
+
+// listCommands lists commands the client is allowed or not allowed to run.
+func (c *mpdConn) listCommands(permitted bool) {
+	var names []string
+	for name := range mpdCommands {
+		if c.permitted(name) == permitted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.pair("command", name)
+	}
+}
+
+func mpdListCommands(c *mpdConn, args []string) error {
+	c.listCommands(true)
+	return nil
+}
+
+func mpdNotCommands(c *mpdConn, args []string) error {
+	c.listCommands(false)
+	return nil
+}
+
+func mpdPassword(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 1); err != nil {
+		return err
+	}
+	password := c.server.cfg.Password
+	if password == "" || subtle.ConstantTimeCompare([]byte(args[0]), []byte(password)) != 1 {
+		return &mpdError{Code: mpdAckErrorPassword, Message: "incorrect password"}
+	}
+	c.authorized = true
+	return nil
+}
+
+func mpdTagTypes(c *mpdConn, args []string) error {
+	// Only the title derived from the file name is supported. Subcommands enabling tags are accepted and ignored.
+	if len(args) == 0 {
+		c.pair("tagtype", "Title")
+	}
+	return nil
+}
+
+func mpdUpdate(c *mpdConn, args []string) error {
+	// There is no database. Directory listings cached for recursive walks are dropped.
+	c.server.listings.clear()
+	c.pair("updating_db", 1)
+	c.server.queue.Notify("update", "database")
+	return nil
+}
+
+func mpdStatusCommand(c *mpdConn, args []string) error {
+	st := c.server.queue.Status()
+	boolInt := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	c.pair("volume", st.volume)
+	c.pair("repeat", boolInt(st.options["repeat"]))
+	c.pair("random", boolInt(st.options["random"]))
+	c.pair("single", boolInt(st.options["single"]))
+	c.pair("consume", boolInt(st.options["consume"]))
+	c.pair("playlist", st.version)
+	c.pair("playlistlength", st.length)
+	c.pair("state", st.state)
+	if st.song != nil {
+		c.pair("song", st.current)
+		c.pair("songid", st.song.ID)
+		if st.state != mpdStateStop {
+			c.pair("time", fmt.Sprintf("%d:0", int(st.elapsed.Seconds())))
+			c.pair("elapsed", fmt.Sprintf("%.3f", st.elapsed.Seconds()))
+		}
+	}
+	if st.next != nil {
+		c.pair("nextsong", st.current+1)
+		c.pair("nextsongid", st.next.ID)
+	}
+	return nil
+}
+
+func mpdStats(c *mpdConn, args []string) error {
+	// Counting songs requires listing the whole bucket, so library statistics are left out
+	// rather than reported as an empty database.
+	c.pair("uptime", int(time.Since(c.server.started).Seconds()))
+	return nil
+}
+
+func mpdCurrentSong(c *mpdConn, args []string) error {
+	st := c.server.queue.Status()
+	if st.song != nil {
+		c.queueSongInfo(st.current, st.song)
+	}
+	return nil
+}
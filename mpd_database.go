@@ -0,0 +1,459 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// list lists the directory. The root directory of an empty bucket is empty rather than missing.
+func (m *MPDServer) list(p string) ([]*StorageDirectory, []*StorageFile, error) {
+	dirs, files, err := m.mediaLib.Load().store.List(p)
+	if p == "" && IsNotExist(err) {
+		return nil, nil, nil
+	}
+	return dirs, files, err
+}
+
+const (
+	// mpdListingTTL is how long recursive walks reuse directory listings.
+	mpdListingTTL = time.Minute
+	// mpdMaxCachedListings limits the listing cache size. The cache is cleared when it's full.
+	mpdMaxCachedListings = 10000
+	// mpdMaxWalkDirectories limits the number of directories visited by a single recursive walk.
+	mpdMaxWalkDirectories = 10000
+)
+
+var errMPDWalkLimit = &mpdError{Code: mpdAckErrorArg, Message: "Too many directories, narrow down the search"}
+
+type mpdListing struct {
+	dirs    []*StorageDirectory
+	files   []*StorageFile
+	expires time.Time
+}
+
+// mpdListingCache caches directory listings, so listall and find don't list the whole bucket on every call.
+type mpdListingCache struct {
+	mu      sync.Mutex
+	entries map[string]mpdListing
+}
+
+func newMPDListingCache() *mpdListingCache {
+	return &mpdListingCache{entries: make(map[string]mpdListing)}
+}
+
+func (lc *mpdListingCache) get(p string) (mpdListing, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	l, ok := lc.entries[p]
+	if !ok || time.Now().After(l.expires) {
+		return mpdListing{}, false
+	}
+	return l, true
+}
+
+func (lc *mpdListingCache) put(p string, dirs []*StorageDirectory, files []*StorageFile) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if len(lc.entries) >= mpdMaxCachedListings {
+		clear(lc.entries)
+	}
+	lc.entries[p] = mpdListing{dirs: dirs, files: files, expires: time.Now().Add(mpdListingTTL)}
+}
+
+func (lc *mpdListingCache) clear() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	clear(lc.entries)
+}
+
+// cachedList lists the directory, reusing recent listings.
+func (m *MPDServer) cachedList(p string) ([]*StorageDirectory, []*StorageFile, error) {
+	if l, ok := m.listings.get(p); ok {
+		return l.dirs, l.files, nil
+	}
+	dirs, files, err := m.list(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.listings.put(p, dirs, files)
+	return dirs, files, nil
+}
+
+// walk calls fn for every directory and audio file under the path, depth first.
+// It fails when the walk visits more than maxWalkDirectories directories.
+func (m *MPDServer) walk(p string, fn func(dir *StorageDirectory, f *StorageFile)) error {
+	visited := 0
+	var walkDir func(p string) error
+	walkDir = func(p string) error {
+		visited++
+		if visited > m.maxWalkDirectories {
+			return errMPDWalkLimit
+		}
+		dirs, files, err := m.cachedList(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if m.mediaLib.Load().media.IsAudioFile(f) {
+				fn(nil, f)
+			}
+		}
+		for _, dir := range dirs {
+			fn(dir, nil)
+			if err := walkDir(dir.Path()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walkDir(p)
+}
+
+// songs returns audio files under the URI, which can be either a directory or a single file.
+func (m *MPDServer) songs(uri string) ([]*StorageFile, error) {
+	p, err := mpdPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	var files []*StorageFile
+	err = m.walk(p, func(dir *StorageDirectory, f *StorageFile) {
+		if f != nil {
+			files = append(files, f)
+		}
+	})
+	if !IsNotExist(err) {
+		return files, err
+	}
+	f := NewStorageFile(p, 0)
+	if !m.mediaLib.Load().media.IsAudioFile(f) {
+		return nil, errMPDNoExist
+	}
+	if f.Size, err = m.mediaLib.Load().store.FileSize(p); err != nil {
+		if IsNotExist(err) {
+			return nil, errMPDNoExist
+		}
+		return nil, err
+	}
+	return []*StorageFile{f}, nil
+}
+
+func mpdLsInfo(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 0, 1); err != nil {
+		return err
+	}
+	var uri string
+	if len(args) == 1 {
+		uri = args[0]
+	}
+	p, err := mpdPath(uri)
+	if err != nil {
+		return err
+	}
+	dirs, files, err := c.server.list(p)
+	if IsNotExist(err) {
+		songs, err := c.server.songs(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range songs {
+			c.songInfo(f)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		c.pair("directory", dir.Path())
+	}
+	for _, f := range files {
+		if c.server.mediaLib.Load().media.IsAudioFile(f) {
+			c.songInfo(f)
+		}
+	}
+	if p == "" {
+		// Stored playlists are listed in the root directory for older clients.
+		return mpdListPlaylists(c, nil)
+	}
+	return nil
+}
+
+func mpdListAll(c *mpdConn, args []string, info bool) error {
+	if err := mpdArgCount(args, 0, 1); err != nil {
+		return err
+	}
+	var uri string
+	if len(args) == 1 {
+		uri = args[0]
+	}
+	p, err := mpdPath(uri)
+	if err != nil {
+		return err
+	}
+	return c.server.walk(p, func(dir *StorageDirectory, f *StorageFile) {
+		switch {
+		case dir != nil:
+			c.pair("directory", dir.Path())
+		case info:
+			c.songInfo(f)
+		default:
+			c.pair("file", f.Path())
+		}
+	})
+}
+
+// mpdTagValue returns the value of a song tag. Only tags derived from the file path are known.
+func mpdTagValue(f *StorageFile, tag string) (string, bool) {
+	switch strings.ToLower(tag) {
+	case "file", "any":
+		return f.Path(), true
+	case "filename":
+		return f.Name(), true
+	case "title":
+		return f.FriendlyName(), true
+	}
+	return "", false
+}
+
+type mpdMatcher func(f *StorageFile) bool
+
+// mpdFilter is a parsed find or search filter.
+type mpdFilter struct {
+	// base is the directory the search is limited to.
+	base  string
+	match mpdMatcher
+	// fold makes comparisons case-insensitive.
+	fold bool
+}
+
+func (flt *mpdFilter) compare(tag string, op string, value string) (mpdMatcher, error) {
+	if strings.EqualFold(tag, "base") {
+		p, err := mpdPath(value)
+		if err != nil {
+			return nil, err
+		}
+		flt.base = p
+		return func(*StorageFile) bool { return true }, nil
+	}
+	if flt.fold {
+		value = strings.ToLower(value)
+	}
+	var cmp func(actual string) bool
+	switch op {
+	case "==":
+		cmp = func(actual string) bool { return actual == value }
+	case "!=":
+		cmp = func(actual string) bool { return actual != value }
+	case "contains":
+		cmp = func(actual string) bool { return strings.Contains(actual, value) }
+	case "starts_with":
+		cmp = func(actual string) bool { return strings.HasPrefix(actual, value) }
+	default:
+		return nil, mpdArgError("Unknown filter operator: %s", op)
+	}
+	return func(f *StorageFile) bool {
+		actual, ok := mpdTagValue(f, tag)
+		if flt.fold {
+			actual = strings.ToLower(actual)
+		}
+		return ok && cmp(actual)
+	}, nil
+}
+
+// mpdExpressionParser parses filter expressions like "((title contains 'x') AND (!(base 'y')))".
+type mpdExpressionParser struct {
+	filter *mpdFilter
+	s      string
+	pos    int
+}
+
+var errMPDBadExpression = mpdArgError("Malformed filter expression")
+
+func (p *mpdExpressionParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *mpdExpressionParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *mpdExpressionParser) expect(c byte) error {
+	if p.peek() != c {
+		return errMPDBadExpression
+	}
+	p.pos++
+	return nil
+}
+
+func (p *mpdExpressionParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ' ' && p.s[p.pos] != ')' && p.s[p.pos] != '(' {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *mpdExpressionParser) quoted() (string, error) {
+	quote := p.peek()
+	if quote != '\'' && quote != '"' {
+		return "", errMPDBadExpression
+	}
+	var val strings.Builder
+	for p.pos++; p.pos < len(p.s) && p.s[p.pos] != quote; p.pos++ {
+		if p.s[p.pos] == '\\' && p.pos+1 < len(p.s) {
+			p.pos++
+		}
+		val.WriteByte(p.s[p.pos])
+	}
+	if p.pos == len(p.s) {
+		return "", errMPDBadExpression
+	}
+	p.pos++
+	return val.String(), nil
+}
+
+func (p *mpdExpressionParser) parse() (mpdMatcher, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	var m mpdMatcher
+	switch p.peek() {
+	case '!':
+		p.pos++
+		inner, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		m = func(f *StorageFile) bool { return !inner(f) }
+	case '(':
+		var matchers []mpdMatcher
+		for {
+			inner, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, inner)
+			if p.peek() == ')' {
+				break
+			}
+			if p.word() != "AND" {
+				return nil, errMPDBadExpression
+			}
+		}
+		m = func(f *StorageFile) bool {
+			for _, inner := range matchers {
+				if !inner(f) {
+					return false
+				}
+			}
+			return true
+		}
+	default:
+		tag := p.word()
+		var op string
+		if !strings.EqualFold(tag, "base") {
+			op = p.word()
+		}
+		value, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		if m, err = p.filter.compare(tag, op, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseMPDFilter parses either a filter expression or "TYPE VALUE" pairs.
+// Pairs match exact values for find and case-insensitive substrings for search.
+func parseMPDFilter(args []string, fold bool) (*mpdFilter, error) {
+	flt := &mpdFilter{fold: fold}
+	if len(args) == 1 && strings.HasPrefix(args[0], "(") {
+		p := &mpdExpressionParser{filter: flt, s: args[0]}
+		m, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != 0 {
+			return nil, errMPDBadExpression
+		}
+		flt.match = m
+		return flt, nil
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, mpdArgError("incorrect arguments")
+	}
+	op := "=="
+	if fold {
+		op = "contains"
+	}
+	var matchers []mpdMatcher
+	for i := 0; i < len(args); i += 2 {
+		m, err := flt.compare(args[i], op, args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	flt.match = func(f *StorageFile) bool {
+		for _, m := range matchers {
+			if !m(f) {
+				return false
+			}
+		}
+		return true
+	}
+	return flt, nil
+}
+
+func mpdFind(c *mpdConn, args []string, fold bool, add bool) error {
+	// Sorting isn't supported, results are returned in the library order.
+	if n := len(args); n > 2 && strings.EqualFold(args[n-2], "sort") {
+		args = args[:n-2]
+	}
+	start, end := 0, -1
+	if n := len(args); n > 2 && strings.EqualFold(args[n-2], "window") {
+		var err error
+		if start, end, err = parseMPDRange(args[n-1], -1); err != nil {
+			return err
+		}
+		args = args[:n-2]
+	}
+	flt, err := parseMPDFilter(args, fold)
+	if err != nil {
+		return err
+	}
+	var found []*StorageFile
+	err = c.server.walk(flt.base, func(dir *StorageDirectory, f *StorageFile) {
+		if f != nil && flt.match(f) {
+			found = append(found, f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if end < 0 || end > len(found) {
+		end = len(found)
+	}
+	found = found[min(start, end):end]
+	if add {
+		_, err := c.server.queue.Add(found, -1)
+		return queueError(err)
+	}
+	for _, f := range found {
+		c.songInfo(f)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import "strings"
+
+func mpdAdd(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 2); err != nil {
+		return err
+	}
+	songs, err := c.server.songs(args[0])
+	if err != nil {
+		return err
+	}
+	pos := -1
+	if len(args) == 2 {
+		if pos, err = parseMPDInt(args[1]); err != nil {
+			return err
+		}
+	}
+	ids, err := c.server.queue.Add(songs, pos)
+	if err != nil {
+		return queueError(err)
+	}
+	if len(ids) == 1 {
+		c.pair("Id", ids[0])
+	}
+	return nil
+}
+
+func mpdClear(c *mpdConn, args []string) error {
+	c.server.queue.Clear()
+	return nil
+}
+
+func mpdDelete(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 1); err != nil {
+		return err
+	}
+	start, end, err := parseMPDRange(args[0], len(c.server.queue.Songs()))
+	if err != nil {
+		return err
+	}
+	return queueError(c.server.queue.Delete(start, end))
+}
+
+func mpdDeleteID(c *mpdConn, args []string) error {
+	pos, err := mpdSongPosition(c, args, 1)
+	if err != nil {
+		return err
+	}
+	return queueError(c.server.queue.Delete(pos, pos+1))
+}
+
+// mpdSongPosition returns the queue position of the song with the ID in the first argument.
+func mpdSongPosition(c *mpdConn, args []string, argCount int) (int, error) {
+	if err := mpdArgCount(args, argCount, argCount); err != nil {
+		return 0, err
+	}
+	id, err := parseMPDInt(args[0])
+	if err != nil {
+		return 0, err
+	}
+	pos, err := c.server.queue.Position(id)
+	if err != nil {
+		return 0, &mpdError{Code: mpdAckErrorNoExist, Message: err.Error()}
+	}
+	return pos, nil
+}
+
+func mpdMove(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 2, 2); err != nil {
+		return err
+	}
+	from, err := parseMPDInt(args[0])
+	if err != nil {
+		return err
+	}
+	to, err := parseMPDInt(args[1])
+	if err != nil {
+		return err
+	}
+	return queueError(c.server.queue.Move(from, to))
+}
+
+func mpdMoveID(c *mpdConn, args []string) error {
+	from, err := mpdSongPosition(c, args, 2)
+	if err != nil {
+		return err
+	}
+	to, err := parseMPDInt(args[1])
+	if err != nil {
+		return err
+	}
+	return queueError(c.server.queue.Move(from, to))
+}
+
+func mpdPlaylistInfo(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 0, 1); err != nil {
+		return err
+	}
+	songs := c.server.queue.Songs()
+	start, end := 0, len(songs)
+	if len(args) == 1 {
+		var err error
+		if start, end, err = parseMPDRange(args[0], len(songs)); err != nil {
+			return err
+		}
+		if end > len(songs) {
+			return mpdArgError("Bad song index")
+		}
+	}
+	for i := start; i < end; i++ {
+		c.queueSongInfo(i, songs[i])
+	}
+	return nil
+}
+
+// mpdPlaylistChanges implements plchanges. Changes aren't tracked per song, so the whole queue is reported.
+func mpdPlaylistChanges(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 2); err != nil {
+		return err
+	}
+	if _, err := parseMPDInt(args[0]); err != nil {
+		return err
+	}
+	return mpdPlaylistInfo(c, nil)
+}
+
+func mpdPlaylistID(c *mpdConn, args []string) error {
+	if len(args) == 0 {
+		return mpdPlaylistInfo(c, nil)
+	}
+	pos, err := mpdSongPosition(c, args, 1)
+	if err != nil {
+		return err
+	}
+	songs := c.server.queue.Songs()
+	c.queueSongInfo(pos, songs[pos])
+	return nil
+}
+
+func mpdPlay(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 0, 1); err != nil {
+		return err
+	}
+	pos := -1
+	if len(args) == 1 {
+		var err error
+		if pos, err = parseMPDInt(args[0]); err != nil {
+			return err
+		}
+	}
+	return queueError(c.server.queue.Play(pos))
+}
+
+func mpdPlayID(c *mpdConn, args []string) error {
+	if len(args) == 0 {
+		return queueError(c.server.queue.Play(-1))
+	}
+	pos, err := mpdSongPosition(c, args, 1)
+	if err != nil {
+		return err
+	}
+	return queueError(c.server.queue.Play(pos))
+}
+
+func mpdPause(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 0, 1); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		c.server.queue.TogglePause()
+		return nil
+	}
+	pause, err := parseMPDBool(args[0])
+	if err != nil {
+		return err
+	}
+	c.server.queue.Pause(pause)
+	return nil
+}
+
+func mpdSeek(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 2, 2); err != nil {
+		return err
+	}
+	pos, err := parseMPDInt(args[0])
+	if err != nil {
+		return err
+	}
+	t, err := parseMPDTime(args[1])
+	if err != nil {
+		return err
+	}
+	return queueError(c.server.queue.Seek(pos, t))
+}
+
+func mpdSeekID(c *mpdConn, args []string) error {
+	pos, err := mpdSongPosition(c, args, 2)
+	if err != nil {
+		return err
+	}
+	t, err := parseMPDTime(args[1])
+	if err != nil {
+		return err
+	}
+	return queueError(c.server.queue.Seek(pos, t))
+}
+
+func mpdSeekCur(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 1); err != nil {
+		return err
+	}
+	st := c.server.queue.Status()
+	if st.song == nil {
+		return &mpdError{Code: mpdAckErrorNoExist, Message: "Not playing"}
+	}
+	arg := args[0]
+	t, err := parseMPDTime(strings.TrimLeft(arg, "+-"))
+	if err != nil {
+		return err
+	}
+	switch arg[0] {
+	case '+':
+		t = st.elapsed + t
+	case '-':
+		t = max(st.elapsed-t, 0)
+	}
+	return queueError(c.server.queue.Seek(st.current, t))
+}
+
+func mpdSetVol(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 1); err != nil {
+		return err
+	}
+	vol, err := parseMPDInt(args[0])
+	if err != nil {
+		return err
+	}
+	c.server.queue.SetVolume(vol)
+	return nil
+}
+
+func mpdOption(name string) mpdCommand {
+	return func(c *mpdConn, args []string) error {
+		if err := mpdArgCount(args, 1, 1); err != nil {
+			return err
+		}
+		v, err := parseMPDBool(args[0])
+		if err != nil {
+			return err
+		}
+		c.server.queue.SetOption(name, v)
+		return nil
+	}
+}
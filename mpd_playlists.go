@@ -0,0 +1,186 @@
+package main
+
+import "errors"
+
+var errMPDNoPlaylist = &mpdError{Code: mpdAckErrorNoExist, Message: "No such playlist"}
+
+// playlist returns the stored playlist with the name. Playlist names aren't unique, the first match is returned.
+func (m *MPDServer) playlist(name string) (*Playlist, error) {
+	playlists, err := m.playlists.Load().List()
+	if err != nil {
+		return nil, err
+	}
+	for _, pl := range playlists {
+		if pl.Name == name {
+			return pl, nil
+		}
+	}
+	return nil, errMPDNoPlaylist
+}
+
+// editPlaylist applies the edit to the stored playlist in the first argument and saves it.
+func (c *mpdConn) editPlaylist(args []string, argCount int, edit func(pl *Playlist) error) error {
+	if err := mpdArgCount(args, argCount, argCount); err != nil {
+		return err
+	}
+	pl, err := c.server.playlist(args[0])
+	if err != nil {
+		return err
+	}
+	if err := edit(pl); err != nil {
+		return err
+	}
+	if err := c.server.playlists.Load().Save(pl); err != nil {
+		return err
+	}
+	c.server.queue.Notify("stored_playlist")
+	return nil
+}
+
+func mpdListPlaylists(c *mpdConn, args []string) error {
+	playlists, err := c.server.playlists.Load().List()
+	if err != nil {
+		return err
+	}
+	for _, pl := range playlists {
+		c.pair("playlist", pl.Name)
+	}
+	return nil
+}
+
+func mpdListPlaylist(c *mpdConn, args []string, info bool) error {
+	if err := mpdArgCount(args, 1, 1); err != nil {
+		return err
+	}
+	pl, err := c.server.playlist(args[0])
+	if err != nil {
+		return err
+	}
+	for _, f := range pl.AudioTracks() {
+		if info {
+			c.songInfo(f)
+		} else {
+			c.pair("file", f.Path())
+		}
+	}
+	return nil
+}
+
+func mpdLoad(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 2); err != nil {
+		return err
+	}
+	pl, err := c.server.playlist(args[0])
+	if err != nil {
+		return err
+	}
+	tracks := pl.AudioTracks()
+	if len(args) == 2 {
+		start, end, err := parseMPDRange(args[1], len(tracks))
+		if err != nil {
+			return err
+		}
+		if end > len(tracks) {
+			return mpdArgError("Bad song index")
+		}
+		tracks = tracks[start:end]
+	}
+	_, err = c.server.queue.Add(tracks, -1)
+	return queueError(err)
+}
+
+func mpdSave(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 1); err != nil {
+		return err
+	}
+	if _, err := c.server.playlist(args[0]); !errors.Is(err, errMPDNoPlaylist) {
+		if err != nil {
+			return err
+		}
+		return &mpdError{Code: mpdAckErrorExist, Message: "Playlist already exists"}
+	}
+	pl, err := c.server.playlists.Load().Create(args[0])
+	if err != nil {
+		return err
+	}
+	for _, song := range c.server.queue.Songs() {
+		pl.Add(song.File.Path())
+	}
+	if err := c.server.playlists.Load().Save(pl); err != nil {
+		return err
+	}
+	c.server.queue.Notify("stored_playlist")
+	return nil
+}
+
+func mpdRemovePlaylist(c *mpdConn, args []string) error {
+	if err := mpdArgCount(args, 1, 1); err != nil {
+		return err
+	}
+	pl, err := c.server.playlist(args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.server.playlists.Load().Delete(pl.ID); err != nil {
+		return err
+	}
+	c.server.queue.Notify("stored_playlist")
+	return nil
+}
+
+func mpdRenamePlaylist(c *mpdConn, args []string) error {
+	return c.editPlaylist(args, 2, func(pl *Playlist) error {
+		if _, err := c.server.playlist(args[1]); !errors.Is(err, errMPDNoPlaylist) {
+			if err != nil {
+				return err
+			}
+			return &mpdError{Code: mpdAckErrorExist, Message: "Playlist already exists"}
+		}
+		pl.Name = args[1]
+		return nil
+	})
+}
+
+func mpdPlaylistAdd(c *mpdConn, args []string) error {
+	return c.editPlaylist(args, 2, func(pl *Playlist) error {
+		songs, err := c.server.songs(args[1])
+		if err != nil {
+			return err
+		}
+		for _, f := range songs {
+			pl.Add(f.Path())
+		}
+		return nil
+	})
+}
+
+func mpdPlaylistClear(c *mpdConn, args []string) error {
+	return c.editPlaylist(args, 1, func(pl *Playlist) error {
+		pl.Tracks = nil
+		return nil
+	})
+}
+
+func mpdPlaylistDelete(c *mpdConn, args []string) error {
+	return c.editPlaylist(args, 2, func(pl *Playlist) error {
+		pos, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		}
+		return queueError(pl.Remove(pos))
+	})
+}
+
+func mpdPlaylistMove(c *mpdConn, args []string) error {
+	return c.editPlaylist(args, 3, func(pl *Playlist) error {
+		from, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		}
+		to, err := parseMPDInt(args[2])
+		if err != nil {
+			return err
+		}
+		return queueError(pl.Move(from, to))
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mpdSong is a song in the playback queue.
+type mpdSong struct {
+	ID   int
+	File *StorageFile
+}
+
+type mpdPlayerState string
+
+const (
+	mpdStatePlay  mpdPlayerState = "play"
+	mpdStatePause mpdPlayerState = "pause"
+	mpdStateStop  mpdPlayerState = "stop"
+)
+
+var errMPDBadSongIndex = errors.New("Bad song index")
+
+// mpdQueue is the server-side playback queue and player state shared by all MPD clients.
+// Audio isn't played by the server, clients stream songs from the HTTP stream endpoint.
+type mpdQueue struct {
+	mu      sync.Mutex
+	songs   []*mpdSong
+	nextID  int
+	version int
+	current int
+	state   mpdPlayerState
+	// elapsed is the playback position at the time the song was started or paused.
+	elapsed   time.Duration
+	startedAt time.Time
+	volume    int
+	options   map[string]bool
+	// changed is closed and replaced on every change to wake up idle clients.
+	changed chan struct{}
+	// seq is incremented on every change. changedAt maps subsystems to the sequence number of their last change.
+	seq       int
+	changedAt map[string]int
+}
+
+func newMPDQueue() *mpdQueue {
+	return &mpdQueue{
+		nextID:    1,
+		version:   1,
+		current:   -1,
+		state:     mpdStateStop,
+		volume:    100,
+		options:   map[string]bool{"repeat": false, "random": false, "single": false, "consume": false},
+		changed:   make(chan struct{}),
+		changedAt: make(map[string]int),
+	}
+}
+
+// notify records changed subsystems and wakes up idle clients. It must be called with the lock held.
+func (q *mpdQueue) notify(subsystems ...string) {
+	q.seq++
+	for _, s := range subsystems {
+		if s == "playlist" {
+			q.version++
+		}
+		q.changedAt[s] = q.seq
+	}
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Notify records changes to subsystems not managed by the queue, like stored playlists.
+func (q *mpdQueue) Notify(subsystems ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.notify(subsystems...)
+}
+
+// Changes returns subsystems changed after the sequence number, the current sequence number
+// and a channel closed on the next change.
+func (q *mpdQueue) Changes(since int) ([]string, int, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var changed []string
+	for s, seq := range q.changedAt {
+		if seq > since {
+			changed = append(changed, s)
+		}
+	}
+	sort.Strings(changed)
+	return changed, q.seq, q.changed
+}
+
+func (q *mpdQueue) elapsedLocked() time.Duration {
+	if q.state == mpdStatePlay {
+		return q.elapsed + time.Since(q.startedAt)
+	}
+	return q.elapsed
+}
+
+// Add appends files to the queue and returns their IDs. A negative position appends to the end.
+func (q *mpdQueue) Add(files []*StorageFile, pos int) ([]int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pos > len(q.songs) {
+		return nil, errMPDBadSongIndex
+	}
+	if pos < 0 {
+		pos = len(q.songs)
+	}
+	var ids []int
+	var songs []*mpdSong
+	for _, f := range files {
+		songs = append(songs, &mpdSong{ID: q.nextID, File: f})
+		ids = append(ids, q.nextID)
+		q.nextID++
+	}
+	q.songs = slices.Insert(q.songs, pos, songs...)
+	if q.current >= pos {
+		q.current += len(songs)
+	}
+	q.notify("playlist")
+	return ids, nil
+}
+
+// Clear removes all songs and stops the playback.
+func (q *mpdQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.songs = nil
+	q.current = -1
+	q.state = mpdStateStop
+	q.elapsed = 0
+	q.notify("playlist", "player")
+}
+
+// Delete removes songs in the [start, end) range.
+func (q *mpdQueue) Delete(start int, end int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if start < 0 || end > len(q.songs) || start >= end {
+		return errMPDBadSongIndex
+	}
+	q.songs = slices.Delete(q.songs, start, end)
+	switch {
+	case q.current >= end:
+		q.current -= end - start
+	case q.current >= start:
+		// The current song was deleted.
+		q.current = -1
+		q.state = mpdStateStop
+		q.elapsed = 0
+	}
+	q.notify("playlist", "player")
+	return nil
+}
+
+// Position returns the queue position of the song with the given ID.
+func (q *mpdQueue) Position(id int) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, song := range q.songs {
+		if song.ID == id {
+			return i, nil
+		}
+	}
+	return 0, errors.New("No such song")
+}
+
+// Move moves the song at position from to position to.
+func (q *mpdQueue) Move(from int, to int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if from < 0 || from >= len(q.songs) || to < 0 || to >= len(q.songs) {
+		return errMPDBadSongIndex
+	}
+	var currentID int
+	if q.current != -1 {
+		currentID = q.songs[q.current].ID
+	}
+	song := q.songs[from]
+	q.songs = slices.Delete(q.songs, from, from+1)
+	q.songs = slices.Insert(q.songs, to, song)
+	if q.current != -1 {
+		q.current = slices.IndexFunc(q.songs, func(s *mpdSong) bool { return s.ID == currentID })
+	}
+	q.notify("playlist")
+	return nil
+}
+
+// Songs returns a copy of the queue.
+func (q *mpdQueue) Songs() []*mpdSong {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Clone(q.songs)
+}
+
+// Play starts playing the song at the position. A negative position resumes the current song or starts the first one.
+func (q *mpdQueue) Play(pos int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pos >= len(q.songs) {
+		return errMPDBadSongIndex
+	}
+	if pos < 0 {
+		if q.state == mpdStatePause {
+			q.state = mpdStatePlay
+			q.startedAt = time.Now()
+			q.notify("player")
+			return nil
+		}
+		pos = max(q.current, 0)
+		if len(q.songs) == 0 {
+			return nil
+		}
+	}
+	q.current = pos
+	q.state = mpdStatePlay
+	q.elapsed = 0
+	q.startedAt = time.Now()
+	q.notify("player")
+	return nil
+}
+
+// Pause pauses or resumes the playback.
+func (q *mpdQueue) Pause(pause bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case pause && q.state == mpdStatePlay:
+		q.elapsed = q.elapsedLocked()
+		q.state = mpdStatePause
+	case !pause && q.state == mpdStatePause:
+		q.state = mpdStatePlay
+		q.startedAt = time.Now()
+	default:
+		return
+	}
+	q.notify("player")
+}
+
+// TogglePause pauses the playback if it's playing and resumes it otherwise.
+func (q *mpdQueue) TogglePause() {
+	q.mu.Lock()
+	paused := q.state != mpdStatePlay
+	q.mu.Unlock()
+	q.Pause(!paused)
+}
+
+// Stop stops the playback.
+func (q *mpdQueue) Stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.state = mpdStateStop
+	q.elapsed = 0
+	q.notify("player")
+}
+
+// Skip moves the current song by delta positions.
+func (q *mpdQueue) Skip(delta int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current == -1 || q.state == mpdStateStop {
+		return
+	}
+	next := q.current + delta
+	if next < 0 || next >= len(q.songs) {
+		if !q.options["repeat"] || len(q.songs) == 0 {
+			q.state = mpdStateStop
+			q.elapsed = 0
+			q.notify("player")
+			return
+		}
+		next = (next + len(q.songs)) % len(q.songs)
+	}
+	q.current = next
+	q.elapsed = 0
+	q.startedAt = time.Now()
+	q.notify("player")
+}
+
+// Seek sets the playback position within the song at the position.
+func (q *mpdQueue) Seek(pos int, t time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pos < 0 || pos >= len(q.songs) {
+		return errMPDBadSongIndex
+	}
+	q.current = pos
+	if q.state == mpdStateStop {
+		q.state = mpdStatePlay
+	}
+	q.elapsed = t
+	q.startedAt = time.Now()
+	q.notify("player")
+	return nil
+}
+
+// SetOption sets one of the repeat, random, single or consume playback options.
+func (q *mpdQueue) SetOption(name string, v bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.options[name] = v
+	q.notify("options")
+}
+
+// SetVolume sets the volume reported to clients.
+func (q *mpdQueue) SetVolume(v int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.volume = min(max(v, 0), 100)
+	q.notify("mixer")
+}
+
+// mpdStatus is a snapshot of the player state.
+type mpdStatus struct {
+	state   mpdPlayerState
+	version int
+	length  int
+	current int
+	song    *mpdSong
+	next    *mpdSong
+	elapsed time.Duration
+	volume  int
+	options map[string]bool
+}
+
+func (q *mpdQueue) Status() mpdStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := mpdStatus{
+		state:   q.state,
+		version: q.version,
+		length:  len(q.songs),
+		current: q.current,
+		elapsed: q.elapsedLocked(),
+		volume:  q.volume,
+		options: make(map[string]bool, len(q.options)),
+	}
+	for k, v := range q.options {
+		st.options[k] = v
+	}
+	if q.current != -1 {
+		st.song = q.songs[q.current]
+		if q.current+1 < len(q.songs) {
+			st.next = q.songs[q.current+1]
+		}
+	}
+	return st
+}
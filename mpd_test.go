@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMPDCommand(t *testing.T) {
+	testCases := []struct {
+		line string
+		name string
+		args []string
+	}{
+		{"ping", "ping", []string{}},
+		{"  status\r", "status", []string{}},
+		{`lsinfo "Aphex Twin/Windowlicker"`, "lsinfo", []string{"Aphex Twin/Windowlicker"}},
+		{`find title "say \"hi\"" file a\b`, "find", []string{"title", `say "hi"`, "file", `a\b`}},
+		{`FIND any "a\\b"`, "find", []string{"any", `a\b`}},
+		{`add ""`, "add", []string{""}},
+	}
+	for _, tc := range testCases {
+		name, args, err := parseMPDCommand(tc.line)
+		if assert.NoError(t, err, tc.line) {
+			assert.Equal(t, tc.name, name, tc.line)
+			assert.Equal(t, tc.args, args, tc.line)
+		}
+	}
+
+	for _, line := range []string{"", "   ", `add "a`} {
+		_, _, err := parseMPDCommand(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseMPDFilter(t *testing.T) {
+	track := NewStorageFile("Aphex Twin/Windowlicker/01 Windowlicker.mp3", 1)
+
+	testCases := []struct {
+		args  []string
+		fold  bool
+		match bool
+		base  string
+	}{
+		{[]string{"title", "01 Windowlicker"}, false, true, ""},
+		{[]string{"title", "01 windowlicker"}, false, false, ""},
+		{[]string{"title", "windowlicker"}, true, true, ""},
+		{[]string{"any", "twin", "filename", ".mp3"}, true, true, ""},
+		{[]string{"artist", "Aphex Twin"}, false, false, ""},
+		{[]string{"base", "Aphex Twin/", "title", "win"}, true, true, "Aphex Twin"},
+		{[]string{"(title == '01 Windowlicker')"}, false, true, ""},
+		{[]string{"(title contains 'LICKER')"}, true, true, ""},
+		{[]string{"(file starts_with \"Aphex\")"}, false, true, ""},
+		{[]string{"(!(title contains 'Xtal'))"}, false, true, ""},
+		{[]string{"((base 'Aphex Twin') AND (title != 'Xtal') AND (filename contains 'mp3'))"}, false, true, "Aphex Twin"},
+		{[]string{"((title contains 'Xtal') AND (filename contains 'mp3'))"}, false, false, ""},
+		{[]string{`(title == 'it\'s')`}, false, false, ""},
+	}
+	for _, tc := range testCases {
+		flt, err := parseMPDFilter(tc.args, tc.fold)
+		if assert.NoError(t, err, tc.args) {
+			assert.Equal(t, tc.match, flt.match(track), tc.args)
+			assert.Equal(t, tc.base, flt.base, tc.args)
+		}
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"title"},
+		{"(title == 'a'"},
+		{"(title like 'a')"},
+		{"(title == a)"},
+		{"((title == 'a') OR (title == 'b'))"},
+		{"(title == 'a') x"},
+		{"base", "../secret"},
+	} {
+		_, err := parseMPDFilter(args, false)
+		assert.Error(t, err, args)
+	}
+}
+
+// mpdTestClient sends commands to the MPD server and reads responses until OK or ACK.
+type mpdTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *mpdTestClient) readResponse() string {
+	c.t.Helper()
+	var resp strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if !assert.NoError(c.t, err) {
+			return resp.String()
+		}
+		resp.WriteString(line)
+		if line == "OK\n" || strings.HasPrefix(line, "ACK ") {
+			return resp.String()
+		}
+	}
+}
+
+func (c *mpdTestClient) call(lines ...string) string {
+	c.t.Helper()
+	_, err := fmt.Fprint(c.conn, strings.Join(lines, "\n")+"\n")
+	assert.NoError(c.t, err)
+	return c.readResponse()
+}
+
+func dialTestMPD(t *testing.T, l net.Listener) *mpdTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c := &mpdTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "OK MPD 0.23.0\n", greeting)
+	return c
+}
+
+func TestMPDServer(t *testing.T) {
+	asrt := assert.New(t)
+
+	storage := newTestStorage(t, "test",
+		"Aphex Twin/Windowlicker/01 Windowlicker.mp3",
+		"Aphex Twin/Windowlicker/02 Equation.mp3",
+		"Aphex Twin/Windowlicker/cover.jpg",
+		"Aphex Twin/Xtal.mp3",
+	)
+
+	m := NewMPDServer(MPDConfig{}, NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{}), NewPlaylistStore(storage, "playlists/"))
+	asrt.Equal("127.0.0.1:6600", m.Address())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	asrt.NoError(err)
+	go m.Serve(l)
+	defer m.Close()
+
+	c := dialTestMPD(t, l)
+	defer c.conn.Close()
+
+	asrt.Equal("OK\n", c.call("ping"))
+	asrt.Equal("ACK [5@0] {foo} unknown command \"foo\"\n", c.call("foo"))
+	// Tag lists and library statistics aren't supported, clients fall back to browsing directories.
+	asrt.Equal("ACK [5@0] {list} unknown command \"list\"\n", c.call("list artist"))
+	resp := c.call("stats")
+	asrt.Contains(resp, "uptime: ")
+	asrt.NotContains(resp, "songs: ")
+
+	asrt.Equal("directory: Aphex Twin\nOK\n", c.call("lsinfo"))
+	resp = c.call(`lsinfo "Aphex Twin"`)
+	asrt.Contains(resp, "directory: Aphex Twin/Windowlicker\n")
+	asrt.Contains(resp, "file: Aphex Twin/Xtal.mp3\n")
+	asrt.Contains(resp, "Title: Xtal\n")
+	asrt.Contains(c.call(`lsinfo "Aphex Twin/Xtal.mp3"`), "file: Aphex Twin/Xtal.mp3\n")
+	asrt.Equal("ACK [50@0] {lsinfo} No such file or directory\n", c.call(`lsinfo "Boards of Canada"`))
+
+	asrt.Equal("file: Aphex Twin/Xtal.mp3\n"+
+		"directory: Aphex Twin/Windowlicker\n"+
+		"file: Aphex Twin/Windowlicker/01 Windowlicker.mp3\n"+
+		"file: Aphex Twin/Windowlicker/02 Equation.mp3\n"+
+		"OK\n", c.call(`listall "Aphex Twin"`))
+
+	asrt.Equal("file: Aphex Twin/Windowlicker/02 Equation.mp3\nTitle: 02 Equation\nOK\n",
+		clearMPDLastModified(c.call(`search title "equation"`)))
+	asrt.Equal("OK\n", c.call(`find title "equation"`))
+	asrt.Equal("file: Aphex Twin/Xtal.mp3\nTitle: Xtal\nOK\n",
+		clearMPDLastModified(c.call(`find "(title == 'Xtal')"`)))
+	asrt.Equal("ACK [2@0] {find} Malformed filter expression\n", c.call(`find "(title == 'Xtal'"`))
+
+	// Queue.
+	asrt.Equal("OK\n", c.call(`add "Aphex Twin/Windowlicker"`))
+	asrt.Equal("Id: 3\nOK\n", c.call(`addid "Aphex Twin/Xtal.mp3" 0`))
+	asrt.Equal("ACK [50@0] {add} No such file or directory\n", c.call(`add "Aphex Twin/missing.mp3"`))
+	asrt.Equal("file: Aphex Twin/Xtal.mp3\nTitle: Xtal\nPos: 0\nId: 3\n"+
+		"file: Aphex Twin/Windowlicker/01 Windowlicker.mp3\nTitle: 01 Windowlicker\nPos: 1\nId: 1\n"+
+		"file: Aphex Twin/Windowlicker/02 Equation.mp3\nTitle: 02 Equation\nPos: 2\nId: 2\n"+
+		"OK\n", clearMPDLastModified(c.call("playlistinfo")))
+
+	asrt.Equal("OK\n", c.call("play 1"))
+	resp = c.call("status")
+	asrt.Contains(resp, "state: play\n")
+	asrt.Contains(resp, "playlistlength: 3\n")
+	asrt.Contains(resp, "song: 1\nsongid: 1\n")
+	asrt.Contains(resp, "nextsong: 2\nnextsongid: 2\n")
+	asrt.Equal("OK\n", c.call("next"))
+	asrt.Contains(c.call("currentsong"), "Id: 2\n")
+	asrt.Equal("OK\n", c.call("moveid 2 0"))
+	asrt.Contains(c.call("status"), "song: 0\nsongid: 2\n")
+	asrt.Equal("OK\n", c.call("pause 1"))
+	asrt.Contains(c.call("status"), "state: pause\n")
+	asrt.Equal("OK\n", c.call("deleteid 2"))
+	asrt.Contains(c.call("status"), "state: stop\n")
+	asrt.Equal("ACK [50@0] {deleteid} No such song\n", c.call("deleteid 2"))
+	asrt.Equal("ACK [2@0] {delete} Bad song index\n", c.call("delete 5"))
+
+	// Command lists.
+	asrt.Equal("list_OK\nlist_OK\nOK\n", c.call("command_list_ok_begin", "repeat 1", "random 0", "command_list_end"))
+	asrt.Equal("ACK [2@1] {random} Boolean (0/1) expected: x\n", c.call("command_list_begin", "ping", "random x", "ping", "command_list_end"))
+
+	// Stored playlists.
+	asrt.Equal("OK\n", c.call(`save "Road trip"`))
+	asrt.Equal("ACK [56@0] {save} Playlist already exists\n", c.call(`save "Road trip"`))
+	asrt.Equal("playlist: Road trip\nOK\n", c.call("listplaylists"))
+	asrt.Equal("OK\n", c.call(`playlistadd "Road trip" "Aphex Twin/Windowlicker/02 Equation.mp3"`))
+	asrt.Equal("file: Aphex Twin/Xtal.mp3\n"+
+		"file: Aphex Twin/Windowlicker/01 Windowlicker.mp3\n"+
+		"file: Aphex Twin/Windowlicker/02 Equation.mp3\n"+
+		"OK\n", c.call(`listplaylist "Road trip"`))
+	asrt.Equal("OK\n", c.call("clear"))
+	asrt.Equal("OK\n", c.call(`load "Road trip" 1:`))
+	asrt.Contains(c.call("status"), "playlistlength: 2\n")
+	asrt.Equal("OK\n", c.call(`rename "Road trip" "Night drive"`))
+	asrt.Equal("ACK [50@0] {load} No such playlist\n", c.call(`load "Road trip"`))
+	asrt.Equal("OK\n", c.call(`rm "Night drive"`))
+	asrt.Equal("OK\n", c.call("listplaylists"))
+
+	// Idle reports changes made by other clients. Changes made before are reported right away.
+	asrt.Contains(c.call("idle"), "changed: playlist\n")
+	other := dialTestMPD(t, l)
+	defer other.conn.Close()
+	_, err = fmt.Fprint(c.conn, "idle playlist\n")
+	asrt.NoError(err)
+	asrt.Equal("OK\n", other.call("clear"))
+	asrt.Equal("changed: playlist\nOK\n", c.readResponse())
+	asrt.Equal("OK\n", c.call("idle player", "noidle"))
+
+	_, err = fmt.Fprint(c.conn, "close\n")
+	asrt.NoError(err)
+	_, err = c.r.ReadString('\n')
+	asrt.Error(err)
+}
+
+func TestMPDServer_Password(t *testing.T) {
+	asrt := assert.New(t)
+
+	storage := newTestStorage(t, "test")
+
+	m := NewMPDServer(MPDConfig{Password: "hunter2"}, NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{}), NewPlaylistStore(storage, "playlists/"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go m.Serve(l)
+	defer m.Close()
+
+	c := dialTestMPD(t, l)
+	defer c.conn.Close()
+
+	asrt.Equal("OK\n", c.call("ping"))
+	asrt.Equal("ACK [4@0] {save} you don't have permission for \"save\"\n", c.call(`save "Road trip"`))
+	asrt.Equal("ACK [4@0] {idle} you don't have permission for \"idle\"\n", c.call("idle"))
+	asrt.NotContains(c.call("commands"), "command: save\n")
+	asrt.Contains(c.call("notcommands"), "command: save\n")
+	asrt.Equal("ACK [3@0] {password} incorrect password\n", c.call("password wrong"))
+	asrt.Equal("ACK [4@0] {listplaylists} you don't have permission for \"listplaylists\"\n", c.call("listplaylists"))
+
+	asrt.Equal("OK\n", c.call("password hunter2"))
+	asrt.Equal("OK\n", c.call(`save "Road trip"`))
+	asrt.Equal("playlist: Road trip\nOK\n", c.call("listplaylists"))
+	asrt.Contains(c.call("commands"), "command: save\n")
+	asrt.Equal("OK\n", c.call("notcommands"))
+
+	// Other connections need the password too.
+	other := dialTestMPD(t, l)
+	defer other.conn.Close()
+	asrt.Equal("ACK [4@0] {clear} you don't have permission for \"clear\"\n", other.call("clear"))
+}
+
+func TestMPDServer_Walk(t *testing.T) {
+	asrt := assert.New(t)
+
+	storage := newTestStorage(t, "test", "Aphex Twin/Windowlicker/01 Windowlicker.mp3", "Aphex Twin/Xtal.mp3")
+
+	m := NewMPDServer(MPDConfig{}, NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{}), NewPlaylistStore(storage, "playlists/"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go m.Serve(l)
+	defer m.Close()
+
+	c := dialTestMPD(t, l)
+	defer c.conn.Close()
+
+	listAll := "directory: Aphex Twin\n" +
+		"file: Aphex Twin/Xtal.mp3\n" +
+		"directory: Aphex Twin/Windowlicker\n" +
+		"file: Aphex Twin/Windowlicker/01 Windowlicker.mp3\n" +
+		"OK\n"
+	asrt.Equal(listAll, c.call("listall"))
+
+	// Listings are reused until the database is updated.
+	require.NoError(t, storage.WriteObject("Aphex Twin/Windowlicker/02 Equation.mp3", []byte("1"), ""))
+	asrt.Equal(listAll, c.call("listall"))
+	asrt.Contains(c.call("update"), "updating_db: 1\n")
+	asrt.Contains(c.call("listall"), "file: Aphex Twin/Windowlicker/02 Equation.mp3\n")
+
+	m.maxWalkDirectories = 2
+	asrt.Equal("ACK [2@0] {listall} Too many directories, narrow down the search\n", c.call("listall"))
+	asrt.Equal("ACK [2@0] {search} Too many directories, narrow down the search\n", c.call(`search title "xtal"`))
+	asrt.Contains(c.call(`search base "Aphex Twin" title "xtal"`), "file: Aphex Twin/Xtal.mp3\n")
+}
+
+// clearMPDLastModified removes Last-Modified lines, which depend on the time the test objects were uploaded.
+func clearMPDLastModified(resp string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(resp, "\n") {
+		if !strings.HasPrefix(line, "Last-Modified: ") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
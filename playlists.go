@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Playlist is a user-defined ordered list of audio tracks.
+type Playlist struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Tracks []string `json:"tracks"`
+}
+
+// AudioTracks returns playlist tracks as storage files.
+func (pl *Playlist) AudioTracks() []*StorageFile {
+	var tracks []*StorageFile
+	for _, p := range pl.Tracks {
+		tracks = append(tracks, NewStorageFile(p, 0))
+	}
+	return tracks
+}
+
+// Add appends tracks to the end of the playlist.
+func (pl *Playlist) Add(paths ...string) {
+	pl.Tracks = append(pl.Tracks, paths...)
+}
+
+var errTrackIndex = errors.New("track index out of range")
+
+// Remove removes the track at the given position.
+func (pl *Playlist) Remove(idx int) error {
+	if idx < 0 || idx >= len(pl.Tracks) {
+		return errTrackIndex
+	}
+	pl.Tracks = slices.Delete(pl.Tracks, idx, idx+1)
+	return nil
+}
+
+// Move moves the track at position from to position to, shifting the tracks in between.
+func (pl *Playlist) Move(from int, to int) error {
+	if from < 0 || from >= len(pl.Tracks) || to < 0 || to >= len(pl.Tracks) {
+		return errTrackIndex
+	}
+	track := pl.Tracks[from]
+	pl.Tracks = slices.Delete(pl.Tracks, from, from+1)
+	pl.Tracks = slices.Insert(pl.Tracks, to, track)
+	return nil
+}
+
+var errInvalidPlaylistID = errors.New("invalid playlist id")
+
+var playlistIDRe = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// PlaylistStore keeps playlists as JSON objects under a prefix in the S3 bucket.
+type PlaylistStore struct {
+	store  *S3Storage
+	prefix string
+}
+
+func NewPlaylistStore(store *S3Storage, prefix string) *PlaylistStore {
+	return &PlaylistStore{
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+// WithContext returns a store making storage requests with the context.
+func (ps *PlaylistStore) WithContext(ctx context.Context) *PlaylistStore {
+	return &PlaylistStore{
+		store:  ps.store.withContext(ctx),
+		prefix: ps.prefix,
+	}
+}
+
+func (ps *PlaylistStore) key(id string) string {
+	return ps.prefix + id + ".json"
+}
+
+// List returns all playlists sorted by name.
+func (ps *PlaylistStore) List() ([]*Playlist, error) {
+	keys, err := ps.store.ListKeys(ps.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var playlists []*Playlist
+	for _, key := range keys {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(key, ps.prefix), ".json")
+		if !ok || !playlistIDRe.MatchString(id) {
+			continue
+		}
+		pl, err := ps.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, pl)
+	}
+	sort.SliceStable(playlists, func(i, j int) bool {
+		return strings.ToLower(playlists[i].Name) < strings.ToLower(playlists[j].Name)
+	})
+	return playlists, nil
+}
+
+// Get returns the playlist with the given ID.
+func (ps *PlaylistStore) Get(id string) (*Playlist, error) {
+	if !playlistIDRe.MatchString(id) {
+		return nil, errInvalidPlaylistID
+	}
+	data, err := ps.store.ReadObject(ps.key(id))
+	if err != nil {
+		return nil, err
+	}
+	pl := &Playlist{}
+	if err := json.Unmarshal(data, pl); err != nil {
+		return nil, err
+	}
+	pl.ID = id
+	return pl, nil
+}
+
+// Create creates a new empty playlist.
+func (ps *PlaylistStore) Create(name string) (*Playlist, error) {
+	pl := &Playlist{
+		ID:   fmt.Sprintf("%x", rand.Uint64()),
+		Name: name,
+	}
+	if err := ps.Save(pl); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// Save creates or replaces the playlist.
+func (ps *PlaylistStore) Save(pl *Playlist) error {
+	if !playlistIDRe.MatchString(pl.ID) {
+		return errInvalidPlaylistID
+	}
+	data, err := json.Marshal(pl)
+	if err != nil {
+		return err
+	}
+	return ps.store.WriteObject(ps.key(pl.ID), data, "application/json")
+}
+
+// Delete deletes the playlist with the given ID.
+func (ps *PlaylistStore) Delete(id string) error {
+	if !playlistIDRe.MatchString(id) {
+		return errInvalidPlaylistID
+	}
+	return ps.store.DeleteObject(ps.key(id))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlaylist_Edit(t *testing.T) {
+	asrt := assert.New(t)
+
+	pl := &Playlist{}
+	pl.Add("a", "b", "c", "d")
+
+	asrt.NoError(pl.Move(0, 2))
+	asrt.Equal([]string{"b", "c", "a", "d"}, pl.Tracks)
+	asrt.NoError(pl.Move(3, 0))
+	asrt.Equal([]string{"d", "b", "c", "a"}, pl.Tracks)
+	asrt.ErrorIs(pl.Move(0, -1), errTrackIndex)
+	asrt.ErrorIs(pl.Move(0, 4), errTrackIndex)
+
+	asrt.NoError(pl.Remove(1))
+	asrt.Equal([]string{"d", "c", "a"}, pl.Tracks)
+	asrt.ErrorIs(pl.Remove(3), errTrackIndex)
+}
+
+func TestPlaylistStore(t *testing.T) {
+	asrt := assert.New(t)
+
+	storage := newTestStorage(t, "test")
+
+	ps := NewPlaylistStore(storage, "playlists/")
+
+	playlists, err := ps.List()
+	asrt.NoError(err)
+	asrt.Empty(playlists)
+
+	road, err := ps.Create("Road trip")
+	asrt.NoError(err)
+	asrt.NotEmpty(road.ID)
+	ambient, err := ps.Create("ambient")
+	asrt.NoError(err)
+
+	road.Add("a/1.mp3", "a/2.mp3")
+	asrt.NoError(ps.Save(road))
+
+	pl, err := ps.Get(road.ID)
+	asrt.NoError(err)
+	asrt.Equal(road, pl)
+
+	playlists, err = ps.List()
+	asrt.NoError(err)
+	asrt.Equal([]*Playlist{ambient, road}, playlists)
+
+	asrt.NoError(ps.Delete(ambient.ID))
+	_, err = ps.Get(ambient.ID)
+	asrt.True(IsNotExist(err))
+
+	playlists, err = ps.List()
+	asrt.NoError(err)
+	asrt.Equal([]*Playlist{road}, playlists)
+
+	// Invalid IDs must not escape the prefix.
+	_, err = ps.Get("../music/1")
+	asrt.ErrorIs(err, errInvalidPlaylistID)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// Position is a playback position within a directory.
+type Position struct {
+	// Track is a path of the audio track.
+	Track string `json:"track"`
+	// Time is an offset in seconds from the beginning of the track.
+	Time      float64   `json:"time"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PositionStore keeps playback positions of each user as JSON objects under a prefix in the S3 bucket.
+type PositionStore struct {
+	store  *S3Storage
+	prefix string
+}
+
+func NewPositionStore(store *S3Storage, prefix string) *PositionStore {
+	return &PositionStore{
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+// WithContext returns a store making storage requests with the context.
+func (ps *PositionStore) WithContext(ctx context.Context) *PositionStore {
+	return &PositionStore{
+		store:  ps.store.withContext(ctx),
+		prefix: ps.prefix,
+	}
+}
+
+var errInvalidUser = errors.New("invalid user name")
+
+// key returns the object key of the position. User names are escaped, so they can't contain delimiters,
+// and dot segments are rejected, since S3 clients clean them from paths.
+func (ps *PositionStore) key(user string, dir string) (string, error) {
+	if user == "" || user == "." || user == ".." {
+		return "", errInvalidUser
+	}
+	return ps.prefix + url.PathEscape(user) + Delimiter + dir + ".json", nil
+}
+
+// Get returns the last saved position of the user in the directory.
+func (ps *PositionStore) Get(user string, dir string) (*Position, error) {
+	key, err := ps.key(user, dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ps.store.ReadObject(key)
+	if err != nil {
+		return nil, err
+	}
+	pos := &Position{}
+	if err := json.Unmarshal(data, pos); err != nil {
+		return nil, err
+	}
+	return pos, nil
+}
+
+// Save saves the position of the user in the directory.
+func (ps *PositionStore) Save(user string, dir string, pos *Position) error {
+	key, err := ps.key(user, dir)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return ps.store.WriteObject(key, data, "application/json")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPositionStore(t *testing.T) {
+	asrt := assert.New(t)
+
+	storage := newTestStorage(t, "test")
+
+	ps := NewPositionStore(storage, "positions/")
+
+	_, err := ps.Get("alice", "Books/Dune")
+	asrt.True(IsNotExist(err))
+
+	pos := &Position{
+		Track:     "Books/Dune/01.m4b",
+		Time:      123.5,
+		UpdatedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	asrt.NoError(ps.Save("alice", "Books/Dune", pos))
+
+	actual, err := ps.Get("alice", "Books/Dune")
+	asrt.NoError(err)
+	asrt.Equal(pos, actual)
+
+	// Positions are per user.
+	_, err = ps.Get("bob", "Books/Dune")
+	asrt.True(IsNotExist(err))
+
+	// User names can't escape the user prefix.
+	key, err := ps.key("../bob", "Books/Dune")
+	asrt.NoError(err)
+	asrt.Equal("positions/..%2Fbob/Books/Dune.json", key)
+	for _, user := range []string{"", ".", ".."} {
+		_, err = ps.key(user, "Books/Dune")
+		asrt.ErrorIs(err, errInvalidUser)
+		asrt.ErrorIs(ps.Save(user, "Books/Dune", pos), errInvalidUser)
+	}
+	_, err = ps.Get("..", "Books/Dune")
+	asrt.ErrorIs(err, errInvalidUser)
+}
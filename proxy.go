@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies derives the client IP address, scheme and host from forwarding headers
+// set by reverse proxies. Headers are only used for requests from trusted proxy addresses.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies parses CIDRs and IP addresses of trusted proxies.
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	for _, s := range cidrs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", s, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		tp.prefixes = append(tp.prefixes, prefix.Masked())
+	}
+	return tp, nil
+}
+
+func (tp *TrustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range tp.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHop is what a proxy recorded about the connection it received.
+type forwardedHop struct {
+	// addr is invalid when the proxy recorded an unknown or obfuscated address.
+	addr  netip.Addr
+	proto string
+	host  string
+}
+
+// parseForwardedAddr parses a node address of the Forwarded or X-Forwarded-For header with an optional port.
+func parseForwardedAddr(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr()
+	}
+	addr, _ := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return addr
+}
+
+// parseForwarded parses RFC 7239 Forwarded header values into hops ordered from the client to the nearest proxy.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				v = strings.Trim(v, `"`)
+				switch strings.ToLower(k) {
+				case "for":
+					hop.addr = parseForwardedAddr(v)
+				case "proto":
+					hop.proto = v
+				case "host":
+					hop.host = v
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+func splitHeaderList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	return items
+}
+
+// parseXForwarded parses X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers into hops.
+// Proto and host lists matching the address list are set per hop. Otherwise, the last proto and host
+// are returned separately, they were set by the nearest proxy and apply to whichever hop is the client.
+func parseXForwarded(h http.Header) (hops []forwardedHop, proto string, host string) {
+	addrs := splitHeaderList(h.Values("X-Forwarded-For"))
+	protos := splitHeaderList(h.Values("X-Forwarded-Proto"))
+	hosts := splitHeaderList(h.Values("X-Forwarded-Host"))
+	hops = make([]forwardedHop, len(addrs))
+	for i, addr := range addrs {
+		hops[i].addr = parseForwardedAddr(addr)
+		if len(protos) == len(addrs) {
+			hops[i].proto = protos[i]
+		}
+		if len(hosts) == len(addrs) {
+			hops[i].host = hosts[i]
+		}
+	}
+	if len(protos) > 0 && len(protos) != len(addrs) {
+		proto = protos[len(protos)-1]
+	}
+	if len(hosts) > 0 && len(hosts) != len(addrs) {
+		host = hosts[len(hosts)-1]
+	}
+	return hops, proto, host
+}
+
+// isValidForwardedHost returns whether the host can be used in URLs.
+func isValidForwardedHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, " \t/\\?#@\"'<>")
+}
+
+type forwardedSchemeKey struct{}
+
+type trustedProxyKey struct{}
+
+// fromTrustedProxy returns whether the request was sent by a trusted proxy.
+func fromTrustedProxy(r *http.Request) bool {
+	trusted, _ := r.Context().Value(trustedProxyKey{}).(bool)
+	return trusted
+}
+
+// proxyUser returns the user name a trusted proxy set in the header.
+// Clients connecting directly could set any name, so their headers are ignored.
+func proxyUser(r *http.Request, header string) string {
+	if header == "" || !fromTrustedProxy(r) {
+		return ""
+	}
+	return r.Header.Get(header)
+}
+
+// requestScheme returns the scheme the client used, as reported by a trusted proxy or from the connection.
+func requestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(forwardedSchemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientHop returns the hop of the client: the nearest address not belonging to a trusted proxy.
+// Addresses are checked from the nearest proxy, so clients can't spoof addresses added by trusted proxies.
+func (tp *TrustedProxies) clientHop(hops []forwardedHop) (forwardedHop, bool) {
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !hops[i].addr.IsValid() {
+			return forwardedHop{}, false
+		}
+		if !tp.trusted(hops[i].addr) || i == 0 {
+			return hops[i], true
+		}
+	}
+	return forwardedHop{}, false
+}
+
+// Handler replaces the remote address and the host of requests from trusted proxies with the client's ones,
+// and makes the scheme the client used available to requestScheme. Requests from trusted proxies are marked
+// for fromTrustedProxy.
+func (tp *TrustedProxies) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := parseForwardedAddr(r.RemoteAddr)
+		if !peer.IsValid() || !tp.trusted(peer) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), trustedProxyKey{}, true))
+		hops := parseForwarded(r.Header.Values("Forwarded"))
+		var proto, host string
+		if len(hops) == 0 {
+			hops, proto, host = parseXForwarded(r.Header)
+		}
+		hop, ok := tp.clientHop(hops)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if hop.proto == "" {
+			hop.proto = proto
+		}
+		if hop.host == "" {
+			hop.host = host
+		}
+		ctx := r.Context()
+		if hop.proto == "http" || hop.proto == "https" {
+			ctx = context.WithValue(ctx, forwardedSchemeKey{}, hop.proto)
+		}
+		r = r.WithContext(ctx)
+		r.RemoteAddr = net.JoinHostPort(hop.addr.Unmap().String(), "0")
+		if isValidForwardedHost(hop.host) {
+			r.Host = hop.host
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := NewTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		remoteIP   string
+		baseURL    string
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "203.0.113.5:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+			},
+			remoteIP: "203.0.113.5",
+			baseURL:  "http://example.com",
+		},
+		{
+			name:       "no headers",
+			remoteAddr: "127.0.0.1:1234",
+			remoteIP:   "127.0.0.1",
+			baseURL:    "http://example.com",
+		},
+		{
+			name:       "x-forwarded",
+			remoteAddr: "127.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"music.example"},
+			},
+			remoteIP: "198.51.100.1",
+			baseURL:  "https://music.example",
+		},
+		{
+			name:       "spoofed x-forwarded-for",
+			remoteAddr: "127.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For": {"1.2.3.4, 198.51.100.1", "10.0.0.2"},
+			},
+			remoteIP: "198.51.100.1",
+			baseURL:  "http://example.com",
+		},
+		{
+			name:       "spoofed x-forwarded-for with a single proto and host",
+			remoteAddr: "127.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4, 198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"music.example"},
+			},
+			remoteIP: "198.51.100.1",
+			baseURL:  "https://music.example",
+		},
+		{
+			name:       "only trusted proxies",
+			remoteAddr: "[::1]:1234",
+			header: http.Header{
+				"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"},
+			},
+			remoteIP: "10.0.0.3",
+			baseURL:  "http://example.com",
+		},
+		{
+			name:       "forwarded",
+			remoteAddr: "127.0.0.1:1234",
+			header: http.Header{
+				"Forwarded":       {`for=1.2.3.4, for="[2001:db8::1]:4711";proto=https;host=music.example`, "for=10.0.0.2;proto=http"},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			remoteIP: "2001:db8::1",
+			baseURL:  "https://music.example",
+		},
+		{
+			name:       "unknown address",
+			remoteAddr: "127.0.0.1:1234",
+			header: http.Header{
+				"Forwarded": {"for=unknown;proto=https"},
+			},
+			remoteIP: "127.0.0.1",
+			baseURL:  "http://example.com",
+		},
+		{
+			name:       "invalid proto and host",
+			remoteAddr: "127.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"javascript"},
+				"X-Forwarded-Host":  {"evil.example/path"},
+			},
+			remoteIP: "198.51.100.1",
+			baseURL:  "http://example.com",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var remoteIPActual, baseURLActual string
+			h := proxies.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteIPActual = remoteIP(r)
+				baseURLActual = requestBaseURL(r).String()
+			}))
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/library/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			assert.Equal(t, tc.remoteIP, remoteIPActual)
+			assert.Equal(t, tc.baseURL, baseURLActual)
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"unicode/utf8"
+)
+
+// radioMetaInt is the number of audio bytes between ICY metadata blocks.
+const radioMetaInt = 16000
+
+type radioFormat struct {
+	contentType string
+	extensions  StringSet
+}
+
+// Tracks in different formats can't be mixed in a single stream.
+var radioFormats = map[string]radioFormat{
+	"mp3": {contentType: "audio/mpeg", extensions: NewStringSet("mp3")},
+	"ogg": {contentType: "audio/ogg", extensions: NewStringSet("ogg", "oga")},
+}
+
+var (
+	errRadioFormat   = errors.New("unsupported radio format")
+	errRadioNoTracks = errors.New("no tracks to play")
+)
+
+// Radio plays audio tracks from a directory tree as an endless stream.
+type Radio struct {
+	store   Storage
+	format  radioFormat
+	tracks  []*StorageFile
+	shuffle bool
+}
+
+// NewRadio creates a radio playing tracks under the path in the given format.
+// If the format is empty, MP3 is preferred over Ogg.
+func NewRadio(mediaLib *MediaLibrary, p string, format string, shuffle bool) (*Radio, error) {
+	if format != "" {
+		if _, ok := radioFormats[format]; !ok {
+			return nil, errRadioFormat
+		}
+	}
+	all, err := mediaLib.AudioTracksTree(p)
+	if err != nil {
+		return nil, err
+	}
+	tracksByFormat := make(map[string][]*StorageFile)
+	for _, track := range all {
+		_, ext := splitNameExt(strings.ToLower(track.Name()))
+		for name, f := range radioFormats {
+			if f.extensions.Contains(ext) {
+				tracksByFormat[name] = append(tracksByFormat[name], track)
+			}
+		}
+	}
+	if format == "" {
+		format = "mp3"
+		if len(tracksByFormat["mp3"]) == 0 {
+			format = "ogg"
+		}
+	}
+	if len(tracksByFormat[format]) == 0 {
+		return nil, errRadioNoTracks
+	}
+	return &Radio{
+		store:   mediaLib.store,
+		format:  radioFormats[format],
+		tracks:  tracksByFormat[format],
+		shuffle: shuffle,
+	}, nil
+}
+
+// ContentType returns the MIME type of the stream.
+func (r *Radio) ContentType() string {
+	return r.format.contentType
+}
+
+// Stream writes tracks one after another, starting over after the last one, until writing fails or the context is done.
+// The callback is called before each track.
+func (r *Radio) Stream(ctx context.Context, w io.Writer, onTrack func(track *StorageFile)) error {
+	tracks := append([]*StorageFile(nil), r.tracks...)
+	for {
+		if r.shuffle {
+			rand.Shuffle(len(tracks), func(i, j int) {
+				tracks[i], tracks[j] = tracks[j], tracks[i]
+			})
+		}
+		played := 0
+		for _, track := range tracks {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			onTrack(track)
+			err := r.copyTrack(w, track)
+			var writeErr *radioWriteError
+			if errors.As(err, &writeErr) {
+				return writeErr.err
+			}
+			if err != nil {
+				slog.Warn("failed streaming radio track", slog.Any("err", err), slog.String("path", track.Path()))
+				continue
+			}
+			played++
+		}
+		if played == 0 {
+			return errRadioNoTracks
+		}
+	}
+}
+
+// radioWriteError wraps errors writing to the listener, as opposed to errors reading tracks.
+type radioWriteError struct {
+	err error
+}
+
+func (e *radioWriteError) Error() string {
+	return e.err.Error()
+}
+
+type radioWriter struct {
+	w io.Writer
+}
+
+func (rw radioWriter) Write(b []byte) (int, error) {
+	n, err := rw.w.Write(b)
+	if err != nil {
+		err = &radioWriteError{err: err}
+	}
+	return n, err
+}
+
+func (r *Radio) copyTrack(w io.Writer, track *StorageFile) error {
+	rc, err := r.store.OpenFile(track.Path())
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	br := bufio.NewReader(rc)
+	if r.format.contentType == "audio/mpeg" {
+		if err := skipID3v2(br); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(radioWriter{w: w}, br)
+	return err
+}
+
+// skipID3v2 discards an ID3v2 tag at the beginning of an MP3 file.
+// Otherwise, tags with embedded artwork end up in the middle of the stream.
+func skipID3v2(r *bufio.Reader) error {
+	header, err := r.Peek(10)
+	if err != nil || string(header[:3]) != "ID3" {
+		// Files shorter than the header are streamed as is.
+		return nil
+	}
+	size := int(header[6]&0x7f)<<21 | int(header[7]&0x7f)<<14 | int(header[8]&0x7f)<<7 | int(header[9]&0x7f)
+	if header[5]&0x10 != 0 {
+		// Footer present.
+		size += 10
+	}
+	_, err = r.Discard(10 + size)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// icyWriter interleaves audio with ICY metadata blocks announcing the current title.
+type icyWriter struct {
+	w       io.Writer
+	metaInt int
+	// remaining is the number of audio bytes before the next metadata block.
+	remaining int
+	title     string
+	// sent is the title in the last metadata block. Unchanged titles are sent as empty blocks.
+	sent string
+}
+
+func newICYWriter(w io.Writer, metaInt int) *icyWriter {
+	return &icyWriter{
+		w:         w,
+		metaInt:   metaInt,
+		remaining: metaInt,
+	}
+}
+
+// SetTitle sets the title sent in the next metadata block.
+func (iw *icyWriter) SetTitle(title string) {
+	iw.title = title
+}
+
+func (iw *icyWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n, err := iw.w.Write(b[:min(len(b), iw.remaining)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+		iw.remaining -= n
+		if iw.remaining > 0 {
+			continue
+		}
+		meta := []byte{0}
+		if iw.title != iw.sent {
+			meta = icyMetadata(iw.title)
+			iw.sent = iw.title
+		}
+		if _, err := iw.w.Write(meta); err != nil {
+			return written, err
+		}
+		iw.remaining = iw.metaInt
+	}
+	return written, nil
+}
+
+// icyMetadata returns a metadata block: the length in 16-byte units followed by the zero-padded metadata.
+// Quotes in the title can't be escaped, so they're replaced with typographic apostrophes.
+// Long titles are truncated at a character boundary.
+func icyMetadata(title string) []byte {
+	const format = "StreamTitle='%s';"
+	title = strings.ReplaceAll(title, "'", "\u2019")
+	if maxLen := 255*16 - len(format) + 2; len(title) > maxLen {
+		for maxLen > 0 && !utf8.RuneStart(title[maxLen]) {
+			maxLen--
+		}
+		title = title[:maxLen]
+	}
+	meta := fmt.Sprintf(format, title)
+	n := (len(meta) + 15) / 16
+	block := make([]byte, 1+n*16)
+	block[0] = byte(n)
+	copy(block[1:], meta)
+	return block
+}
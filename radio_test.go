@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestICYMetadata(t *testing.T) {
+	block := icyMetadata("Xtal")
+	assert.Equal(t, byte(2), block[0])
+	assert.Len(t, block, 33)
+	assert.Equal(t, "StreamTitle='Xtal';", string(bytes.TrimRight(block[1:], "\x00")))
+
+	assert.Equal(t, "StreamTitle='It\u2019s';", string(bytes.TrimRight(icyMetadata("It's")[1:], "\x00")))
+
+	block = icyMetadata(strings.Repeat("a", 5000))
+	assert.Len(t, block, 1+255*16)
+	assert.True(t, strings.HasSuffix(string(block), "a';"))
+
+	// Multi-byte characters aren't split.
+	block = icyMetadata(strings.Repeat("é", 2500))
+	meta := string(bytes.TrimRight(block[1:], "\x00"))
+	assert.True(t, utf8.ValidString(meta))
+	assert.True(t, strings.HasSuffix(meta, "é';"))
+	assert.LessOrEqual(t, len(meta), 255*16)
+}
+
+func TestICYWriter(t *testing.T) {
+	var buf bytes.Buffer
+	iw := newICYWriter(&buf, 4)
+	iw.SetTitle("a")
+	n, err := iw.Write([]byte("123456"))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	n, err = iw.Write([]byte("78"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	iw.SetTitle("b")
+	_, err = iw.Write([]byte("9012"))
+	assert.NoError(t, err)
+
+	var expected bytes.Buffer
+	expected.WriteString("1234")
+	expected.Write(icyMetadata("a"))
+	expected.WriteString("5678")
+	// Unchanged title.
+	expected.WriteByte(0)
+	expected.WriteString("9012")
+	expected.Write(icyMetadata("b"))
+	assert.Equal(t, expected.Bytes(), buf.Bytes())
+}
+
+func TestSkipID3v2(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{"\xff\xfbaudio", "\xff\xfbaudio"},
+		{"ID3\x04\x00\x00\x00\x00\x00\x03tagaudio", "audio"},
+		// Tag size is a syncsafe integer: 0x01 0x00 is 128 bytes.
+		{"ID3\x04\x00\x00\x00\x00\x01\x00" + strings.Repeat("t", 128) + "audio", "audio"},
+		// Footer.
+		{"ID3\x04\x00\x10\x00\x00\x00\x01t3DI\x04\x00\x10\x00\x00\x00\x01audio", "audio"},
+		{"ID3", "ID3"},
+		{"ID3\x04\x00\x00\x00\x00\x00\x7ftruncated", ""},
+	}
+	for _, tc := range testCases {
+		r := bufio.NewReader(strings.NewReader(tc.in))
+		assert.NoError(t, skipID3v2(r), tc.in)
+		rest, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(rest), tc.in)
+	}
+}
+
+// limitedWriter fails after writing the limit.
+type limitedWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+var errWriterLimit = errors.New("limit reached")
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	if w.Len()+len(b) > w.limit {
+		n, _ := w.Buffer.Write(b[:w.limit-w.Len()])
+		return n, errWriterLimit
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestRadio(t *testing.T) {
+	asrt := assert.New(t)
+
+	storage := newTestStorage(t, "test")
+	for key, content := range map[string]string{
+		"Aphex Twin/Windowlicker/01 Windowlicker.mp3": "ID3\x04\x00\x00\x00\x00\x00\x01tW",
+		"Aphex Twin/Windowlicker/cover.jpg":           "C",
+		"Aphex Twin/Xtal.mp3":                         "X",
+		"Aphex Twin/Ageispolis.ogg":                   "A",
+	} {
+		asrt.NoError(storage.WriteObject(key, []byte(content), ""))
+	}
+	mediaLib := NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{})
+
+	radio, err := NewRadio(mediaLib, "Aphex Twin", "", false)
+	asrt.NoError(err)
+	asrt.Equal("audio/mpeg", radio.ContentType())
+	w := &limitedWriter{limit: 5}
+	var titles []string
+	err = radio.Stream(context.Background(), w, func(track *StorageFile) {
+		titles = append(titles, track.FriendlyName())
+	})
+	asrt.ErrorIs(err, errWriterLimit)
+	// Files come before subdirectories, the stream starts over after the last track.
+	asrt.Equal("XWXWX", w.String())
+	asrt.Equal([]string{"Xtal", "01 Windowlicker", "Xtal", "01 Windowlicker", "Xtal", "01 Windowlicker"}, titles)
+
+	radio, err = NewRadio(mediaLib, "Aphex Twin", "ogg", true)
+	asrt.NoError(err)
+	asrt.Equal("audio/ogg", radio.ContentType())
+	w = &limitedWriter{limit: 3}
+	err = radio.Stream(context.Background(), w, func(*StorageFile) {})
+	asrt.ErrorIs(err, errWriterLimit)
+	asrt.Equal("AAA", w.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = radio.Stream(ctx, io.Discard, func(*StorageFile) {})
+	asrt.ErrorIs(err, context.Canceled)
+
+	_, err = NewRadio(mediaLib, "Aphex Twin/Windowlicker", "ogg", false)
+	asrt.ErrorIs(err, errRadioNoTracks)
+	_, err = NewRadio(mediaLib, "Aphex Twin", "wav", false)
+	asrt.ErrorIs(err, errRadioFormat)
+	_, err = NewRadio(mediaLib, "Boards of Canada", "", false)
+	asrt.True(IsNotExist(err))
+}
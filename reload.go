@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// components are built from the config and replaced together when the config is reloaded.
+type components struct {
+	mediaLib   *MediaLibrary
+	playlists  *PlaylistStore
+	positions  *PositionStore
+	transcoder *Transcoder
+	readiness  *Readiness
+}
+
+func newComponents(cfg *Config) (*components, error) {
+	store, state, err := NewStorage(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing S3 storage: %w", err)
+	}
+	readiness := NewReadiness(store)
+	store, err = NewIgnoreStorage(store, cfg.Media.Ignore, cfg.Media.IgnoreFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing ignore patterns: %w", err)
+	}
+	media, err := NewMediaDetector(cfg.Media)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing media detector: %w", err)
+	}
+	c := &components{
+		mediaLib:  NewMediaLibrary(store, media, cfg.Audiobooks),
+		playlists: NewPlaylistStore(state, state.cfg.PlaylistsPrefix),
+		positions: NewPositionStore(state, state.cfg.PositionsPrefix),
+		readiness: readiness,
+	}
+	if cfg.Transcoding.Enabled {
+		c.transcoder, err = NewTranscoder(cfg.Transcoding)
+		if err != nil {
+			return nil, fmt.Errorf("failed initializing transcoder: %w", err)
+		}
+	}
+	return c, nil
+}
+
+type handlerBox struct {
+	http.Handler
+}
+
+// ReloadableHandler serves requests with a handler that can be replaced at any time.
+// Requests in progress finish with the handler they started with.
+type ReloadableHandler struct {
+	h atomic.Pointer[handlerBox]
+}
+
+func (rh *ReloadableHandler) Store(h http.Handler) {
+	rh.h.Store(&handlerBox{h})
+}
+
+func (rh *ReloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.h.Load().ServeHTTP(w, r)
+}
+
+// configChange is a changed config value. Secret values are redacted.
+type configChange struct {
+	Key string
+	Old string
+	New string
+}
+
+const redactedValue = "<redacted>"
+
+// isSecretKey returns whether the config key holds a secret, e.g. "s3.credentials.secret" or "server.share_secret".
+func isSecretKey(key string) bool {
+	return strings.HasSuffix(key, "secret") || strings.HasSuffix(key, "password") || strings.HasSuffix(key, "credentials.token")
+}
+
+// flattenConfig returns config values by their dotted keys.
+func flattenConfig(v reflect.Value, key string, values map[string]string) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			flattenConfig(v.Elem(), key, values)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if name := tomlName(f); f.IsExported() && name != "-" {
+				flattenConfig(v.Field(i), joinKey(key, name), values)
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				flattenConfig(v.Index(i), joinKey(key, strconv.Itoa(i)), values)
+			}
+			return
+		}
+		values[key] = fmt.Sprint(v.Interface())
+	default:
+		if d, ok := v.Interface().(Duration); ok {
+			values[key] = time.Duration(d).String()
+			return
+		}
+		values[key] = fmt.Sprint(v.Interface())
+	}
+}
+
+// diffConfig returns changed config values sorted by key.
+func diffConfig(old *Config, cfg *Config) []configChange {
+	oldValues := make(map[string]string)
+	flattenConfig(reflect.ValueOf(old), "", oldValues)
+	values := make(map[string]string)
+	flattenConfig(reflect.ValueOf(cfg), "", values)
+	keys := make(ConfigSources)
+	for k := range oldValues {
+		keys[k] = ""
+	}
+	for k := range values {
+		keys[k] = ""
+	}
+	var changes []configChange
+	for _, k := range keys.Keys() {
+		oldValue, oldOK := oldValues[k]
+		value, ok := values[k]
+		if oldOK == ok && oldValue == value {
+			continue
+		}
+		if isSecretKey(k) {
+			oldValue, value = redactedValue, redactedValue
+		}
+		changes = append(changes, configChange{Key: k, Old: oldValue, New: value})
+	}
+	return changes
+}
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+// restartKeys are config keys and sections that can't be changed without a restart.
+var restartKeys = []string{
+	"upnp.",
+	"mpd.",
+	"server.read_timeout",
+	"server.read_header_timeout",
+	"server.write_timeout",
+	"server.idle_timeout",
+	"server.max_header_bytes",
+	"server.shutdown_timeout",
+	// UPnP announcements include the base path.
+	"server.base_path",
+	"server.trusted_proxies",
+	"tls.",
+	"access_log.",
+}
+
+// Reloader rereads the config and replaces components built from it.
+// The UPnP and MPD servers keep running and switch to the new library.
+type Reloader struct {
+	path    string
+	handler *ReloadableHandler
+	upnp    *UPnPServer
+	mpd     *MPDServer
+
+	mu  sync.Mutex
+	cfg *Config
+}
+
+// NewReloader creates a reloader for the running servers built from the config. UPnP and MPD servers can be nil.
+func NewReloader(path string, cfg *Config, handler *ReloadableHandler, upnp *UPnPServer, mpd *MPDServer) *Reloader {
+	return &Reloader{
+		path:    path,
+		cfg:     cfg,
+		handler: handler,
+		upnp:    upnp,
+		mpd:     mpd,
+	}
+}
+
+// Reload rereads the config. An invalid config is rejected and the current components are kept.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	cfg, _, err := NewConfig(rl.path)
+	if err != nil {
+		return err
+	}
+	changes := diffConfig(rl.cfg, cfg)
+	if len(changes) == 0 {
+		return nil
+	}
+	for _, change := range changes {
+		slog.Info("config value changed", slog.String("key", change.Key), slog.String("old", change.Old), slog.String("new", change.New))
+		for _, key := range restartKeys {
+			if strings.HasPrefix(change.Key, key) {
+				slog.Warn("config value change requires a restart", slog.String("key", change.Key))
+			}
+		}
+	}
+	c, err := newComponents(cfg)
+	if err != nil {
+		return err
+	}
+	srv, err := NewServer(c.mediaLib, c.playlists, c.positions, c.transcoder, c.readiness, cfg.Server)
+	if err != nil {
+		return err
+	}
+	h, err := srv.Handler(rl.upnp)
+	if err != nil {
+		return err
+	}
+	if rl.upnp != nil {
+		rl.upnp.SetMediaLibrary(c.mediaLib)
+	}
+	if rl.mpd != nil {
+		rl.mpd.SetLibrary(c.mediaLib, c.playlists)
+	}
+	rl.handler.Store(h)
+	rl.cfg = cfg
+	slog.Info("reloaded config", slog.String("path", rl.path))
+	return nil
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFileVersion(p string) (fileVersion, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// Watch reloads the config when the file changes and on every signal.
+// The file is polled at the interval, as editors often replace files rather than write them in place.
+func (rl *Reloader) Watch(signals <-chan os.Signal, interval time.Duration) {
+	reload := func(reason string) {
+		if err := rl.Reload(); err != nil {
+			slog.Error("failed reloading config", slog.Any("err", err), slog.String("path", rl.path), slog.String("reason", reason))
+		}
+	}
+	var version fileVersion
+	if rl.path != "" {
+		version, _ = statFileVersion(rl.path)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			reload(sig.String())
+		case <-ticker.C:
+			if rl.path == "" {
+				continue
+			}
+			v, err := statFileVersion(rl.path)
+			if err != nil || v == version {
+				continue
+			}
+			version = v
+			reload("file changed")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old, _, err := newConfig(strings.NewReader(`[s3]
+		bucket = "foo"
+		credentials = { id = "id", secret = "secret1" }
+		[audiobooks]
+		prefixes = ["Audiobooks"]`), nil)
+	require.NoError(t, err)
+	cfg, _, err := newConfig(strings.NewReader(`[s3]
+		bucket = "bar"
+		credentials = { id = "id", secret = "secret2", token = "token2" }
+		[server]
+		share_secret = "secret3"
+		[audiobooks]
+		prefixes = ["Audiobooks", "Lectures"]
+		[mpd]
+		password = "password"`), nil)
+	require.NoError(t, err)
+
+	assert.Empty(t, diffConfig(old, old))
+	assert.Equal(t, []configChange{
+		{Key: "audiobooks.prefixes", Old: "[Audiobooks]", New: "[Audiobooks Lectures]"},
+		{Key: "mpd.password", Old: redactedValue, New: redactedValue},
+		{Key: "s3.bucket", Old: "foo", New: "bar"},
+		{Key: "s3.credentials.secret", Old: redactedValue, New: redactedValue},
+		{Key: "s3.credentials.token", Old: redactedValue, New: redactedValue},
+		{Key: "server.share_secret", Old: redactedValue, New: redactedValue},
+	}, diffConfig(old, cfg))
+}
+
+func TestReloadableHandler(t *testing.T) {
+	handler := &ReloadableHandler{}
+	respond := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+	}
+	get := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Body.String()
+	}
+	handler.Store(respond("a"))
+	assert.Equal(t, "a", get())
+	handler.Store(respond("b"))
+	assert.Equal(t, "b", get())
+}
+
+func TestReloader(t *testing.T) {
+	s3cfg, closeS3 := newTestS3Config()
+	defer closeS3()
+	s, err := NewS3Storage(s3cfg)
+	require.NoError(t, err)
+	for _, bucket := range []string{"foo", "bar"} {
+		_, err = s.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)})
+		require.NoError(t, err)
+		_, err = s.s3.PutObject(&s3.PutObjectInput{
+			Body:   strings.NewReader("test"),
+			Bucket: aws.String(bucket),
+			Key:    aws.String(bucket + "-album/1.mp3"),
+		})
+		require.NoError(t, err)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	writeConfig := func(bucket string) {
+		t.Helper()
+		data := fmt.Sprintf(`[s3]
+			bucket = %q
+			region = "test"
+			endpoint = %q
+			force_path_style = true
+			credentials = { id = "id1", secret = "secret1" }`, bucket, *s3cfg.Endpoint)
+		require.NoError(t, os.WriteFile(configPath, []byte(data), 0o600))
+	}
+	writeConfig("foo")
+	cfg, _, err := NewConfig(configPath)
+	require.NoError(t, err)
+	c, err := newComponents(cfg)
+	require.NoError(t, err)
+	srv, err := NewServer(c.mediaLib, c.playlists, c.positions, c.transcoder, c.readiness, cfg.Server)
+	require.NoError(t, err)
+	h, err := srv.Handler(nil)
+	require.NoError(t, err)
+	handler := &ReloadableHandler{}
+	handler.Store(h)
+	reloader := NewReloader(configPath, cfg, handler, nil, nil)
+
+	list := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/library/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	assert.Contains(t, list(), "foo-album")
+
+	writeConfig("bar")
+	require.NoError(t, reloader.Reload())
+	body := list()
+	assert.Contains(t, body, "bar-album")
+	assert.NotContains(t, body, "foo-album")
+
+	// Invalid configs keep the current components.
+	require.NoError(t, os.WriteFile(configPath, []byte(`[s3]`), 0o600))
+	assert.Error(t, reloader.Reload())
+	assert.Contains(t, list(), "bar-album")
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 //go:embed templates static
@@ -17,24 +26,38 @@ var embedFS embed.FS
 
 type Server struct {
 	mediaLib      *MediaLibrary
+	playlists     *PlaylistStore
+	positions     *PositionStore
+	transcoder    *Transcoder
+	readiness     *Readiness
+	shares        *ShareSigner
+	cfg           ServerConfig
 	tmpl          *template.Template
 	staticVersion string
+	// generation changes with every config load, so cached pages are revalidated after reloads.
+	generation string
 }
 
 func httpError(r *http.Request, w http.ResponseWriter, err error, code int) {
 	http.Error(w, err.Error(), code)
 	slog.Error("failed request",
-		err,
+		slog.Any("err", err),
 		slog.String("url", r.URL.String()),
 		slog.Int("code", code),
 	)
 }
 
+var errInvalidPath = errors.New("invalid path")
+
+func isValidPath(p string) bool {
+	return !strings.Contains(p, "./") && !strings.Contains(p, ".\\")
+}
+
 // ValidatePath provides a basic protection from the path traversal vulnerability.
 func ValidatePath(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if strings.Contains(r.URL.Path, "./") || strings.Contains(r.URL.Path, ".\\") {
-			httpError(r, w, errors.New("invalid path"), http.StatusBadRequest)
+		if !isValidPath(r.URL.Path) {
+			httpError(r, w, errInvalidPath, http.StatusBadRequest)
 			return
 		}
 		h(w, r)
@@ -60,19 +83,77 @@ func DisableFileListing(h http.Handler) http.Handler {
 	})
 }
 
+// CacheForever lets browsers cache responses without revalidation. URLs must change when the content does.
+func CacheForever(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		h.ServeHTTP(w, r)
+	})
+}
+
 type TemplateData struct {
 	StaticVersion string
+	// HLS is true when tracks can be streamed with HLS.
+	HLS bool
+	// Sharing is true when share links can be created.
+	Sharing bool
 	*MediaListing
 }
 
+// listingETag returns a weak ETag of the listing page computed from keys, sizes and ETags of the entries.
+func (s *Server) listingETag(entries *ListingEntries) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%q\n", s.generation, entries.Path)
+	for _, d := range entries.Directories {
+		fmt.Fprintf(h, "d %q\n", d.Path())
+	}
+	files := entries.Files
+	if entries.Cover != nil {
+		files = append(files[:len(files):len(files)], entries.Cover)
+	}
+	for _, f := range files {
+		fmt.Fprintf(h, "f %q %d %q %d\n", f.Path(), f.Size, f.ETag, f.LastModified.UnixNano())
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum(nil)[:16])
+}
+
+// etagMatches returns whether the If-None-Match header matches the ETag using the weak comparison.
+func etagMatches(r *http.Request, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *Server) ListingHandler(w http.ResponseWriter, r *http.Request) {
-	listing, err := s.mediaLib.List(r.URL.Path)
+	entries, err := s.mediaLib.ListEntries(r.URL.Path)
+	if err != nil {
+		httpError(r, w, err, http.StatusInternalServerError)
+		return
+	}
+	// Pages are revalidated on every request, an unchanged listing skips reading CUE sheets and chapters.
+	etag := s.listingETag(entries)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	listing, err := s.mediaLib.Listing(entries)
 	if err != nil {
 		httpError(r, w, err, http.StatusInternalServerError)
 		return
 	}
 	tmplData := TemplateData{
 		StaticVersion: s.staticVersion,
+		HLS:           s.transcoder != nil,
+		Sharing:       s.shares != nil,
 		MediaListing:  listing,
 	}
 	if err := s.tmpl.ExecuteTemplate(w, "listing.gohtml", tmplData); err != nil {
@@ -90,42 +171,690 @@ func (s *Server) StreamHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-// Don't include sprig just for one function.
-var templateFunctions = map[string]any{
-	"defaultString": func(s string, def string) string {
-		if s == "" {
-			return def
+// shareEntry is a file or directory in a shared listing. The path is relative to the shared directory.
+type shareEntry struct {
+	Rel  string
+	Name string
+}
+
+type ShareTemplateData struct {
+	StaticVersion string
+	// URL is the share link. Entry paths are relative to it.
+	URL         string
+	Name        string
+	Expires     time.Time
+	Parents     []shareEntry
+	Cover       *shareEntry
+	Directories []shareEntry
+	AudioTracks []shareEntry
+	Files       []shareEntry
+}
+
+// shareExpiry is a choice of how long a share link stays valid.
+type shareExpiry struct {
+	Value string
+	Label string
+}
+
+var shareExpiries = []shareExpiry{
+	{"24h", "1 day"},
+	{"168h", "1 week"},
+	{"720h", "30 days"},
+}
+
+type NewShareTemplateData struct {
+	StaticVersion string
+	Path          string
+	Expiries      []shareExpiry
+	Link          string
+	Expires       time.Time
+}
+
+func shareErrorCode(err error) int {
+	switch {
+	case errors.Is(err, errShareInvalid), errors.Is(err, errShareExpired):
+		return http.StatusForbidden
+	case errors.Is(err, errShareExpiry), errors.Is(err, errInvalidPath):
+		return http.StatusBadRequest
+	case IsNotExist(err):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// NewShareHandler renders a form creating a share link for the path and creates the link.
+func (s *Server) NewShareHandler(w http.ResponseWriter, r *http.Request) {
+	tmplData := NewShareTemplateData{
+		StaticVersion: s.staticVersion,
+		Path:          r.URL.Path,
+		Expiries:      shareExpiries,
+	}
+	if r.Method == http.MethodPost {
+		link, expires, err := s.createShare(r)
+		if err != nil {
+			httpError(r, w, err, shareErrorCode(err))
+			return
 		}
-		return s
-	},
+		tmplData.Link = link
+		tmplData.Expires = expires
+	}
+	if err := s.tmpl.ExecuteTemplate(w, "share.gohtml", tmplData); err != nil {
+		httpError(r, w, err, http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) createShare(r *http.Request) (string, time.Time, error) {
+	expiry, err := parseShareExpiry(r.FormValue("expiry"))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	p := r.URL.Path
+	file := false
+	if _, err := s.mediaLib.List(p); err != nil {
+		if !IsNotExist(err) {
+			return "", time.Time{}, err
+		}
+		if _, err := s.mediaLib.store.FileSize(p); err != nil {
+			return "", time.Time{}, err
+		}
+		file = true
+	}
+	expires := time.Now().Add(expiry)
+	token := s.shares.Sign(p, file, expires)
+	return s.baseURL(r).String() + "/share/" + token + "/", expires, nil
+}
+
+// ShareHandler renders a read-only listing of a shared directory or file and streams files within it.
+// The path is the token followed by a path relative to the shared directory. For a shared file,
+// the directory is its parent directory limited to the file.
+func (s *Server) ShareHandler(w http.ResponseWriter, r *http.Request) {
+	token, rel, _ := strings.Cut(r.URL.Path, Delimiter)
+	share, err := s.shares.Verify(token, time.Now())
+	if err != nil {
+		httpError(r, w, err, shareErrorCode(err))
+		return
+	}
+	shareURL := s.cfg.BasePath + "/share/" + token + "/"
+	if share.File {
+		f := NewStorageFile(share.Path, 0)
+		switch rel {
+		case "":
+			listing := &MediaListing{CurrentDirectory: NewStorageDirectory(share.Path)}
+			if s.mediaLib.media.IsAudioFile(f) {
+				listing.AudioTracks = []*StorageFile{f}
+			} else {
+				listing.Files = []*StorageFile{f}
+			}
+			err = s.renderShare(w, share, shareURL, "", listing)
+		case f.Name():
+			err = s.redirectToContent(w, r, share.Path)
+		default:
+			err = errNoDirectory
+		}
+		if err != nil {
+			httpError(r, w, err, shareErrorCode(err))
+		}
+		return
+	}
+	p, err := sharePath(share.Path, rel)
+	if err != nil {
+		httpError(r, w, err, shareErrorCode(err))
+		return
+	}
+	listing, err := s.mediaLib.List(p)
+	switch {
+	case err == nil:
+		err = s.renderShare(w, share, shareURL, strings.Trim(rel, Delimiter), listing)
+	case IsNotExist(err):
+		err = s.redirectToContent(w, r, p)
+	}
+	if err != nil {
+		httpError(r, w, err, shareErrorCode(err))
+	}
 }
 
-// StartServer starts HTTP server.
-func StartServer(mediaLib *MediaLibrary, addr string) error {
-	tmpl, err := template.New("").Funcs(templateFunctions).ParseFS(embedFS, "templates/*.gohtml")
+func (s *Server) redirectToContent(w http.ResponseWriter, r *http.Request, p string) error {
+	url, err := s.mediaLib.ContentURL(p)
 	if err != nil {
 		return err
 	}
+	http.Redirect(w, r, url, http.StatusFound)
+	return nil
+}
 
-	mux := http.NewServeMux()
+func (s *Server) renderShare(w http.ResponseWriter, share *Share, shareURL string, rel string, listing *MediaListing) error {
+	root := share.Path
+	name := defaultString(NewStorageDirectory(root).Name(), "Music")
+	if share.File {
+		root = path.Dir(root)
+		if root == "." {
+			root = ""
+		}
+		name = NewStorageFile(share.Path, 0).FriendlyName()
+	}
+	tmplData := ShareTemplateData{
+		StaticVersion: s.staticVersion,
+		URL:           shareURL,
+		Name:          name,
+		Expires:       share.Expires,
+	}
+	if rel != "" {
+		tmplData.Parents = append(tmplData.Parents, shareEntry{Name: name})
+		segments := strings.Split(rel, Delimiter)
+		for i, segment := range segments[:len(segments)-1] {
+			tmplData.Parents = append(tmplData.Parents, shareEntry{
+				Rel:  strings.Join(segments[:i+1], Delimiter),
+				Name: segment,
+			})
+		}
+		tmplData.Name = segments[len(segments)-1]
+	}
+	if listing.Cover != nil {
+		tmplData.Cover = &shareEntry{Rel: shareRel(root, listing.Cover.Path()), Name: listing.Cover.Name()}
+	}
+	for _, dir := range listing.Directories {
+		tmplData.Directories = append(tmplData.Directories, shareEntry{Rel: shareRel(root, dir.Path()), Name: dir.Name()})
+	}
+	for _, track := range listing.AudioTracks {
+		tmplData.AudioTracks = append(tmplData.AudioTracks, shareEntry{Rel: shareRel(root, track.Path()), Name: track.FriendlyName()})
+	}
+	for _, f := range listing.Files {
+		tmplData.Files = append(tmplData.Files, shareEntry{Rel: shareRel(root, f.Path()), Name: f.Name()})
+	}
+	return s.tmpl.ExecuteTemplate(w, "shared.gohtml", tmplData)
+}
 
-	mux.Handle("/", http.RedirectHandler("/library/", http.StatusMovedPermanently))
+// HLSHandler returns HLS playlists for "<track path>.m3u8" paths and transcoded segments for "<track path>/<index>.ts" paths.
+func (s *Server) HLSHandler(w http.ResponseWriter, r *http.Request) {
+	track, isPlaylist := strings.CutSuffix(r.URL.Path, ".m3u8")
+	idx := 0
+	if !isPlaylist {
+		var ok bool
+		if track, idx, ok = parseHLSSegmentPath(r.URL.Path); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if !s.mediaLib.media.IsAudioFile(NewStorageFile(track, 0)) {
+		http.NotFound(w, r)
+		return
+	}
+	contentURL, err := s.mediaLib.ContentURL(track)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if IsNotExist(err) {
+			code = http.StatusNotFound
+		}
+		httpError(r, w, err, code)
+		return
+	}
+	duration, err := s.transcoder.Duration(r.Context(), track, contentURL)
+	if errors.Is(err, errTranscoderBusy) {
+		w.Header().Set("Retry-After", "1")
+		httpError(r, w, err, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		httpError(r, w, err, http.StatusInternalServerError)
+		return
+	}
+	segment := s.transcoder.SegmentDuration()
+	if isPlaylist {
+		w.Header().Set("Content-Type", hlsPlaylistContentType)
+		io.WriteString(w, hlsPlaylist(NewStorageFile(track, 0).Name(), duration, segment))
+		return
+	}
+	if idx >= hlsSegmentCount(duration, segment) {
+		http.NotFound(w, r)
+		return
+	}
+	start := time.Duration(idx) * segment
+	// Transcoding can be slower than the write timeout on busy servers.
+	disableWriteTimeout(w)
+	w.Header().Set("Content-Type", hlsSegmentContentType)
+	err = s.transcoder.Segment(r.Context(), w, contentURL, start, min(segment, duration-start))
+	if errors.Is(err, errTranscoderBusy) {
+		// Nothing has been written yet.
+		w.Header().Set("Retry-After", "1")
+		httpError(r, w, err, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil && r.Context().Err() == nil {
+		// The response has already started, the error can only be logged.
+		slog.Error("failed transcoding HLS segment", slog.Any("err", err), slog.String("url", r.URL.String()))
+	}
+}
 
-	staticVersion := fmt.Sprintf("%x", rand.Uint64())
-	staticFS, err := fs.Sub(embedFS, "static")
+// RadioHandler streams audio tracks from the directory tree as an endless Icecast-compatible stream.
+// The shuffle query parameter plays tracks in random order, the format parameter selects mp3 or ogg tracks.
+func (s *Server) RadioHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	radio, err := NewRadio(s.mediaLib, r.URL.Path, q.Get("format"), q.Get("shuffle") == "1")
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errRadioFormat):
+			code = http.StatusBadRequest
+		case errors.Is(err, errRadioNoTracks), IsNotExist(err):
+			code = http.StatusNotFound
+		}
+		httpError(r, w, err, code)
+		return
+	}
+	disableWriteTimeout(w)
+	w.Header().Set("Content-Type", radio.ContentType())
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("icy-name", defaultString(NewStorageDirectory(r.URL.Path).Name(), "Music"))
+	var out io.Writer = w
+	setTitle := func(string) {}
+	if r.Header.Get("Icy-MetaData") == "1" {
+		w.Header().Set("icy-metaint", strconv.Itoa(radioMetaInt))
+		icy := newICYWriter(w, radioMetaInt)
+		out = icy
+		setTitle = icy.SetTitle
+	}
+	w.WriteHeader(http.StatusOK)
+	err = radio.Stream(r.Context(), out, func(track *StorageFile) {
+		setTitle(track.FriendlyName())
+	})
+	if err != nil && r.Context().Err() == nil {
+		slog.Warn("radio stream stopped", slog.Any("err", err), slog.String("url", r.URL.String()))
+	}
+}
+
+// requestBaseURL returns the scheme and host the request was made to.
+func requestBaseURL(r *http.Request) *url.URL {
+	return &url.URL{
+		Scheme: requestScheme(r),
+		Host:   r.Host,
+	}
+}
+
+// baseURL returns the URL of the base path on the host the request was made to.
+func (s *Server) baseURL(r *http.Request) *url.URL {
+	u := requestBaseURL(r)
+	u.Path = s.cfg.BasePath
+	return u
+}
+
+// FeedHandler returns a podcast RSS feed for the directory. The path must have the .xml suffix.
+func (s *Server) FeedHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := strings.CutSuffix(r.URL.Path, ".xml")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	listing, err := s.mediaLib.List(p)
+	if err != nil {
+		httpError(r, w, err, http.StatusInternalServerError)
+		return
+	}
+	feed := NewPodcastFeed(listing, s.baseURL(r))
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		httpError(r, w, err, http.StatusInternalServerError)
+	}
+}
+
+type lyricsLineJSON struct {
+	Time float64 `json:"time"`
+	Text string  `json:"text"`
+}
+
+type lyricsJSON struct {
+	Synced bool             `json:"synced"`
+	Lines  []lyricsLineJSON `json:"lines"`
+}
+
+// LyricsHandler returns lyrics of the track as JSON. Line times are in seconds.
+func (s *Server) LyricsHandler(w http.ResponseWriter, r *http.Request) {
+	lyrics, err := s.mediaLib.Lyrics(r.URL.Path)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errNoLyrics) {
+			code = http.StatusNotFound
+		}
+		httpError(r, w, err, code)
+		return
+	}
+	resp := lyricsJSON{
+		Synced: lyrics.Synced,
+		Lines:  make([]lyricsLineJSON, 0, len(lyrics.Lines)),
+	}
+	for _, line := range lyrics.Lines {
+		resp.Lines = append(resp.Lines, lyricsLineJSON{
+			Time: line.Time.Seconds(),
+			Text: line.Text,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		httpError(r, w, err, http.StatusInternalServerError)
+	}
+}
+
+// user returns the name of the user authenticated by a reverse proxy.
+func (s *Server) user(r *http.Request) string {
+	if user := proxyUser(r, s.cfg.UserHeader); user != "" {
+		return user
+	}
+	return "default"
+}
+
+func positionErrorCode(err error) int {
+	if errors.Is(err, errInvalidUser) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// PositionHandler loads and saves the playback position of the current user in an audiobook directory.
+func (s *Server) PositionHandler(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Path
+	user := s.user(r)
+	switch r.Method {
+	case http.MethodGet:
+		pos, err := s.positions.Get(user, dir)
+		if IsNotExist(err) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			httpError(r, w, err, positionErrorCode(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(pos); err != nil {
+			httpError(r, w, err, http.StatusInternalServerError)
+		}
+	case http.MethodPut, http.MethodPost:
+		pos := &Position{}
+		if err := json.NewDecoder(r.Body).Decode(pos); err != nil {
+			httpError(r, w, err, http.StatusBadRequest)
+			return
+		}
+		if !isValidPath(pos.Track) || (dir != "" && !strings.HasPrefix(pos.Track, dir+Delimiter)) {
+			httpError(r, w, errInvalidPath, http.StatusBadRequest)
+			return
+		}
+		pos.UpdatedAt = time.Now().UTC()
+		if err := s.positions.Save(user, dir, pos); err != nil {
+			httpError(r, w, err, positionErrorCode(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+type PlaylistsTemplateData struct {
+	StaticVersion string
+	Playlists     []*Playlist
+	Add           string
+}
+
+type PlaylistTemplateData struct {
+	StaticVersion string
+	HLS           bool
+	*Playlist
+}
+
+var errInvalidTrackIndex = errors.New("invalid track index")
+
+func playlistErrorCode(err error) int {
+	switch {
+	case IsNotExist(err):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidPlaylistID), errors.Is(err, errInvalidPath), errors.Is(err, errTrackIndex), errors.Is(err, errInvalidTrackIndex):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// PlaylistsHandler renders and edits playlists. The root path lists all playlists, any other path is a playlist ID.
+func (s *Server) PlaylistsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch {
+	case r.URL.Path == "" && r.Method == http.MethodPost:
+		err = s.createPlaylist(w, r)
+	case r.URL.Path == "":
+		err = s.listPlaylists(w, r)
+	case r.Method == http.MethodPost:
+		err = s.editPlaylist(w, r)
+	default:
+		err = s.showPlaylist(w, r)
+	}
+	if err != nil {
+		httpError(r, w, err, playlistErrorCode(err))
+	}
+}
+
+func (s *Server) listPlaylists(w http.ResponseWriter, r *http.Request) error {
+	add := r.URL.Query().Get("add")
+	if !isValidPath(add) {
+		return errInvalidPath
+	}
+	playlists, err := s.playlists.List()
+	if err != nil {
+		return err
+	}
+	tmplData := PlaylistsTemplateData{
+		StaticVersion: s.staticVersion,
+		Playlists:     playlists,
+		Add:           add,
+	}
+	return s.tmpl.ExecuteTemplate(w, "playlists.gohtml", tmplData)
+}
+
+func (s *Server) showPlaylist(w http.ResponseWriter, r *http.Request) error {
+	pl, err := s.playlists.Get(r.URL.Path)
 	if err != nil {
 		return err
 	}
-	staticPath := fmt.Sprintf("/static/%s/", staticVersion)
-	mux.Handle(staticPath, DisableFileListing(http.StripPrefix(staticPath, http.FileServer(http.FS(staticFS)))))
+	tmplData := PlaylistTemplateData{
+		StaticVersion: s.staticVersion,
+		HLS:           s.transcoder != nil,
+		Playlist:      pl,
+	}
+	return s.tmpl.ExecuteTemplate(w, "playlist.gohtml", tmplData)
+}
 
-	s := Server{
+// addTracks appends audio tracks found under the path from the request form to the playlist.
+func (s *Server) addTracks(r *http.Request, pl *Playlist) error {
+	p := r.FormValue("path")
+	if !isValidPath(p) {
+		return errInvalidPath
+	}
+	tracks, err := s.mediaLib.AudioTracks(p)
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		pl.Add(track.Path())
+	}
+	return nil
+}
+
+func (s *Server) createPlaylist(w http.ResponseWriter, r *http.Request) error {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return errors.New("playlist name is required")
+	}
+	pl, err := s.playlists.Create(name)
+	if err != nil {
+		return err
+	}
+	if r.FormValue("path") != "" {
+		if err := s.addTracks(r, pl); err != nil {
+			return err
+		}
+		if err := s.playlists.Save(pl); err != nil {
+			return err
+		}
+	}
+	http.Redirect(w, r, s.cfg.BasePath+"/playlists/"+pl.ID, http.StatusSeeOther)
+	return nil
+}
+
+func (s *Server) editPlaylist(w http.ResponseWriter, r *http.Request) error {
+	pl, err := s.playlists.Get(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	action := r.FormValue("action")
+	if action == "delete" {
+		if err := s.playlists.Delete(pl.ID); err != nil {
+			return err
+		}
+		http.Redirect(w, r, s.cfg.BasePath+"/playlists/", http.StatusSeeOther)
+		return nil
+	}
+	var index int
+	if action == "remove" || action == "up" || action == "down" {
+		if index, err = strconv.Atoi(r.FormValue("index")); err != nil {
+			return errInvalidTrackIndex
+		}
+	}
+	switch action {
+	case "add":
+		err = s.addTracks(r, pl)
+	case "remove":
+		err = pl.Remove(index)
+	case "up":
+		err = pl.Move(index, index-1)
+	case "down":
+		err = pl.Move(index, index+1)
+	case "rename":
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			return errors.New("playlist name is required")
+		}
+		pl.Name = name
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.playlists.Save(pl); err != nil {
+		return err
+	}
+	http.Redirect(w, r, s.cfg.BasePath+"/playlists/"+pl.ID, http.StatusSeeOther)
+	return nil
+}
+
+func defaultString(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// Don't include sprig just for two functions.
+var templateFunctions = map[string]any{
+	"defaultString": defaultString,
+	"inc": func(i int) int {
+		return i + 1
+	},
+}
+
+// staticVersion is a part of static file URLs changing between restarts to bust browser caches.
+// It stays the same on config reloads, so pages opened before a reload keep working.
+var staticVersion = fmt.Sprintf("%x", rand.Uint64())
+
+// NewServer creates an HTTP server for the library. The transcoder and readiness checks are optional and can be nil.
+func NewServer(mediaLib *MediaLibrary, playlists *PlaylistStore, positions *PositionStore, transcoder *Transcoder, readiness *Readiness, cfg ServerConfig) (*Server, error) {
+	// Templates prefix URLs with basePath.
+	basePath := template.FuncMap{
+		"basePath": func() string {
+			return cfg.BasePath
+		},
+	}
+	tmpl, err := template.New("").Funcs(templateFunctions).Funcs(basePath).ParseFS(embedFS, "templates/*.gohtml")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
 		mediaLib:      mediaLib,
+		playlists:     playlists,
+		positions:     positions,
+		transcoder:    transcoder,
+		readiness:     readiness,
+		cfg:           cfg,
 		tmpl:          tmpl,
 		staticVersion: staticVersion,
+		generation:    fmt.Sprintf("%x", rand.Uint64()),
+	}
+	if cfg.ShareSecret != "" {
+		s.shares = NewShareSigner(cfg.ShareSecret)
+	}
+	if s.cfg.MaxBodyBytes <= 0 {
+		s.cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	return s, nil
+}
+
+// withContext returns a copy of the server making storage requests with the context.
+func (s *Server) withContext(ctx context.Context) *Server {
+	c := *s
+	c.mediaLib = s.mediaLib.WithContext(ctx)
+	c.playlists = s.playlists.WithContext(ctx)
+	c.positions = s.positions.WithContext(ctx)
+	return &c
+}
+
+// requestHandler calls the handler on a copy of the server bound to the request context,
+// so storage requests are cancelled with the request and counted in the access log.
+func (s *Server) requestHandler(h func(*Server, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(s.withContext(r.Context()), w, r)
+	}
+}
+
+// handle registers the handler for the route under the base path. The route is stripped from request paths.
+func (s *Server) handle(mux *http.ServeMux, route string, h http.Handler) {
+	pattern := s.cfg.BasePath + route
+	mux.Handle(pattern, http.StripPrefix(pattern, h))
+}
+
+// Handler returns the HTTP handler serving all endpoints.
+// The UPnP server is optional and can be nil.
+func (s *Server) Handler(upnp *UPnPServer) (http.Handler, error) {
+	mux := http.NewServeMux()
+
+	mux.Handle(s.cfg.BasePath+"/", http.RedirectHandler(s.cfg.BasePath+"/library/", http.StatusMovedPermanently))
+
+	staticFS, err := fs.Sub(embedFS, "static")
+	if err != nil {
+		return nil, err
+	}
+	s.handle(mux, fmt.Sprintf("/static/%s/", s.staticVersion), CacheForever(DisableFileListing(http.FileServer(http.FS(staticFS)))))
+
+	s.handle(mux, "/library/", ValidatePath(NormalizePath(s.requestHandler((*Server).ListingHandler))))
+	s.handle(mux, "/stream/", ValidatePath(NormalizePath(s.requestHandler((*Server).StreamHandler))))
+	s.handle(mux, "/feed/", ValidatePath(NormalizePath(s.requestHandler((*Server).FeedHandler))))
+	s.handle(mux, "/radio/", ValidatePath(NormalizePath(s.requestHandler((*Server).RadioHandler))))
+	s.handle(mux, "/lyrics/", ValidatePath(NormalizePath(s.requestHandler((*Server).LyricsHandler))))
+	s.handle(mux, "/position/", ValidatePath(NormalizePath(s.requestHandler((*Server).PositionHandler))))
+	s.handle(mux, "/playlists/", ValidatePath(NormalizePath(s.requestHandler((*Server).PlaylistsHandler))))
+	if s.shares != nil {
+		s.handle(mux, "/shares/", ValidatePath(NormalizePath(s.requestHandler((*Server).NewShareHandler))))
+		s.handle(mux, "/share/", ValidatePath(s.requestHandler((*Server).ShareHandler)))
+	}
+	s.handle(mux, "/healthz", http.HandlerFunc(HealthHandler))
+	if s.readiness != nil {
+		s.handle(mux, "/readyz", s.readiness.Handler())
+	}
+	if s.transcoder != nil {
+		s.handle(mux, "/hls/", ValidatePath(NormalizePath(s.requestHandler((*Server).HLSHandler))))
+	}
+	if upnp != nil {
+		upnp.RegisterHandlers(mux)
 	}
-	mux.Handle("/library/", http.StripPrefix("/library/", ValidatePath(NormalizePath(s.ListingHandler))))
-	mux.Handle("/stream/", http.StripPrefix("/stream/", ValidatePath(NormalizePath(s.StreamHandler))))
 
-	return http.ListenAndServe(addr, mux)
+	return Gzip(LimitRequestBody(mux, s.cfg.MaxBodyBytes)), nil
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_BasePath(t *testing.T) {
+	store := newTestStorage(t, "test", "Album/1.mp3")
+
+	mediaLib := NewMediaLibrary(store, newTestMediaDetector(t), AudiobooksConfig{})
+	srv, err := NewServer(mediaLib, NewPlaylistStore(store, "playlists/"), NewPositionStore(store, "positions/"), nil, nil, ServerConfig{
+		BasePath:    "/music",
+		ShareSecret: "secret",
+	})
+	require.NoError(t, err)
+	h, err := srv.Handler(nil)
+	require.NoError(t, err)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	rec := get("/music/")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/music/library/", rec.Header().Get("Location"))
+
+	rec = get("/music/library/Album")
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, `href="/music/static/`+srv.staticVersion+`/style.css"`)
+	assert.Contains(t, body, `href="/music/library/"`)
+	assert.Contains(t, body, `data-url="/music/stream/Album/1.mp3"`)
+	assert.Contains(t, body, `href="/music/shares/Album"`)
+	assert.NotContains(t, body, `="/library/`)
+
+	rec = get("/music/static/" + srv.staticVersion + "/player.js")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = get("/music/feed/Album.xml")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "http://example.com/music/stream/Album/1.mp3")
+
+	assert.Equal(t, http.StatusNotFound, get("/library/Album").Code)
+}
+
+func TestServer_ListingCaching(t *testing.T) {
+	store := newTestStorage(t, "test", "Album/1.mp3")
+
+	mediaLib := NewMediaLibrary(store, newTestMediaDetector(t), AudiobooksConfig{})
+	srv, err := NewServer(mediaLib, NewPlaylistStore(store, "playlists/"), NewPositionStore(store, "positions/"), nil, nil, ServerConfig{})
+	require.NoError(t, err)
+	h, err := srv.Handler(nil)
+	require.NoError(t, err)
+
+	get := func(url string, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := get("/library/Album", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`))
+	assert.Equal(t, "private, no-cache", rec.Header().Get("Cache-Control"))
+
+	rec = get("/library/Album", etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	rec = get("/library/Album", `"other", `+strings.TrimPrefix(etag, "W/"))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Changed objects change the ETag.
+	require.NoError(t, store.WriteObject("Album/1.mp3", []byte("11"), ""))
+	rec = get("/library/Album", etag)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+
+	rec = get("/static/"+srv.staticVersion+"/style.css", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Cache-Control"), "immutable")
+}
+
+func TestServer_EditPlaylist(t *testing.T) {
+	store := newTestStorage(t, "test")
+
+	playlists := NewPlaylistStore(store, "playlists/")
+	pl, err := playlists.Create("Road trip")
+	require.NoError(t, err)
+	pl.Add("a.mp3", "b.mp3")
+	require.NoError(t, playlists.Save(pl))
+
+	mediaLib := NewMediaLibrary(store, newTestMediaDetector(t), AudiobooksConfig{})
+	srv, err := NewServer(mediaLib, playlists, NewPositionStore(store, "positions/"), nil, nil, ServerConfig{})
+	require.NoError(t, err)
+	h, err := srv.Handler(nil)
+	require.NoError(t, err)
+
+	post := func(form string) int {
+		r := httptest.NewRequest(http.MethodPost, "/playlists/"+pl.ID, strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	tracks := func() []string {
+		pl, err := playlists.Get(pl.ID)
+		require.NoError(t, err)
+		return pl.Tracks
+	}
+
+	// Missing and malformed indexes don't edit the first track.
+	assert.Equal(t, http.StatusBadRequest, post("action=remove"))
+	assert.Equal(t, http.StatusBadRequest, post("action=down&index=x"))
+	assert.Equal(t, []string{"a.mp3", "b.mp3"}, tracks())
+
+	assert.Equal(t, http.StatusSeeOther, post("action=remove&index=1"))
+	assert.Equal(t, []string{"a.mp3"}, tracks())
+}
+
+func TestServer_PositionUser(t *testing.T) {
+	store := newTestStorage(t, "test")
+
+	positions := NewPositionStore(store, "positions/")
+	mediaLib := NewMediaLibrary(store, newTestMediaDetector(t), AudiobooksConfig{})
+	srv, err := NewServer(mediaLib, NewPlaylistStore(store, "playlists/"), positions, nil, nil, ServerConfig{UserHeader: "Remote-User"})
+	require.NoError(t, err)
+	h, err := srv.Handler(nil)
+	require.NoError(t, err)
+	proxies, err := NewTrustedProxies([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	h = proxies.Handler(h)
+
+	save := func(remoteAddr string, user string, track string) int {
+		r := httptest.NewRequest(http.MethodPut, "/position/Dune", strings.NewReader(`{"track":"`+track+`","time":1}`))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Remote-User", user)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	track := func(user string) string {
+		pos, err := positions.Get(user, "Dune")
+		require.NoError(t, err)
+		return pos.Track
+	}
+
+	assert.Equal(t, http.StatusNoContent, save("127.0.0.1:1234", "alice", "Dune/1.m4b"))
+	assert.Equal(t, "Dune/1.m4b", track("alice"))
+
+	// Clients connecting directly can't pick the user.
+	assert.Equal(t, http.StatusNoContent, save("192.0.2.1:1234", "alice", "Dune/2.m4b"))
+	assert.Equal(t, "Dune/1.m4b", track("alice"))
+	assert.Equal(t, "Dune/2.m4b", track("default"))
+
+	assert.Equal(t, http.StatusBadRequest, save("127.0.0.1:1234", "..", "Dune/3.m4b"))
+}
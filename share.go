@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	errShareInvalid = errors.New("invalid share link")
+	errShareExpired = errors.New("share link expired")
+	errShareExpiry  = errors.New("share link expiry must be between 1 hour and 1 year")
+)
+
+const (
+	minShareExpiry = time.Hour
+	maxShareExpiry = 365 * 24 * time.Hour
+)
+
+// shareToken is the signed payload of a share link.
+type shareToken struct {
+	Path string `json:"p"`
+	// File is true when the path is a single file rather than a directory.
+	File    bool  `json:"f,omitempty"`
+	Expires int64 `json:"e"`
+}
+
+// Share is a verified share link.
+type Share struct {
+	Path    string
+	File    bool
+	Expires time.Time
+}
+
+// ShareSigner mints and verifies share tokens signed with HMAC-SHA256.
+type ShareSigner struct {
+	secret []byte
+}
+
+func NewShareSigner(secret string) *ShareSigner {
+	return &ShareSigner{
+		secret: []byte(secret),
+	}
+}
+
+func (s *ShareSigner) signature(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns a token granting access to the path until the expiry time.
+func (s *ShareSigner) Sign(p string, file bool, expires time.Time) string {
+	data, _ := json.Marshal(shareToken{Path: p, File: file, Expires: expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.signature(payload)
+}
+
+// Verify checks the token signature and expiry.
+func (s *ShareSigner) Verify(token string, now time.Time) (*Share, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.signature(payload))) {
+		return nil, errShareInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errShareInvalid
+	}
+	var t shareToken
+	if err := json.Unmarshal(data, &t); err != nil || !isValidPath(t.Path) {
+		return nil, errShareInvalid
+	}
+	expires := time.Unix(t.Expires, 0)
+	if !now.Before(expires) {
+		return nil, errShareExpired
+	}
+	return &Share{Path: t.Path, File: t.File, Expires: expires}, nil
+}
+
+// parseShareExpiry parses how long a share link stays valid.
+func parseShareExpiry(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < minShareExpiry || d > maxShareExpiry {
+		return 0, errShareExpiry
+	}
+	return d, nil
+}
+
+// sharePath returns the library path for a path relative to the shared root directory.
+// Relative paths can't contain dot segments, so they never point outside the shared directory.
+func sharePath(root string, rel string) (string, error) {
+	rel = strings.Trim(rel, Delimiter)
+	if rel == "" {
+		return root, nil
+	}
+	for _, segment := range strings.Split(rel, Delimiter) {
+		if segment == "." || segment == ".." || segment == "" {
+			return "", errInvalidPath
+		}
+	}
+	if root == "" {
+		return rel, nil
+	}
+	return root + Delimiter + rel, nil
+}
+
+// shareRel returns the path relative to the shared root directory.
+func shareRel(root string, p string) string {
+	if root == "" {
+		return p
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(p, root), Delimiter)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareSigner(t *testing.T) {
+	signer := NewShareSigner("secret")
+	now := time.Unix(1700000000, 0)
+	expires := now.Add(time.Hour)
+
+	token := signer.Sign("Music/Aphex Twin", false, expires)
+	share, err := signer.Verify(token, now)
+	require.NoError(t, err)
+	assert.Equal(t, &Share{Path: "Music/Aphex Twin", Expires: expires}, share)
+
+	token = signer.Sign("Music/Aphex Twin/01 Windowlicker.mp3", true, expires)
+	share, err = signer.Verify(token, now)
+	require.NoError(t, err)
+	assert.Equal(t, &Share{Path: "Music/Aphex Twin/01 Windowlicker.mp3", File: true, Expires: expires}, share)
+
+	_, err = signer.Verify(token, expires)
+	assert.Equal(t, errShareExpired, err)
+
+	_, err = NewShareSigner("other").Verify(token, now)
+	assert.Equal(t, errShareInvalid, err)
+
+	// Payload of another path with the original signature.
+	other := signer.Sign("Music", false, expires)
+	_, sig, _ := strings.Cut(token, ".")
+	payload, _, _ := strings.Cut(other, ".")
+	_, err = signer.Verify(payload+"."+sig, now)
+	assert.Equal(t, errShareInvalid, err)
+
+	for _, token := range []string{"", ".", "foo", "foo.bar"} {
+		_, err = signer.Verify(token, now)
+		assert.Equal(t, errShareInvalid, err, token)
+	}
+
+	_, err = signer.Verify(signer.Sign("Music/../Private", false, expires), now)
+	assert.Equal(t, errShareInvalid, err)
+}
+
+func TestParseShareExpiry(t *testing.T) {
+	d, err := parseShareExpiry("24h")
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, d)
+
+	for _, s := range []string{"", "foo", "59m", "8761h"} {
+		_, err := parseShareExpiry(s)
+		assert.Equal(t, errShareExpiry, err, s)
+	}
+}
+
+func TestSharePath(t *testing.T) {
+	testCases := []struct {
+		root     string
+		rel      string
+		expected string
+		err      error
+	}{
+		{root: "Music", rel: "", expected: "Music"},
+		{root: "Music", rel: "/", expected: "Music"},
+		{root: "Music", rel: "Album/01.mp3", expected: "Music/Album/01.mp3"},
+		{root: "Music", rel: "Album/", expected: "Music/Album"},
+		{root: "", rel: "Album", expected: "Album"},
+		{root: "Music", rel: "..", err: errInvalidPath},
+		{root: "Music", rel: "Album/../../Private", err: errInvalidPath},
+		{root: "Music", rel: "./Album", err: errInvalidPath},
+		{root: "Music", rel: "Album//01.mp3", err: errInvalidPath},
+	}
+	for _, tc := range testCases {
+		p, err := sharePath(tc.root, tc.rel)
+		assert.Equal(t, tc.err, err, tc.rel)
+		assert.Equal(t, tc.expected, p, tc.rel)
+	}
+
+	assert.Equal(t, "Album/01.mp3", shareRel("Music", "Music/Album/01.mp3"))
+	assert.Equal(t, "Album", shareRel("", "Album"))
+}
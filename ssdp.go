@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	// ssdpMaxAge is how long in seconds control points cache announcements.
+	ssdpMaxAge = 1800
+	ssdpServer = "Linux/1.0 UPnP/1.0 bsimp/1.0"
+)
+
+// SSDPServer announces a UPnP device and answers discovery requests.
+type SSDPServer struct {
+	uuid    string
+	targets []string
+	// location returns the device description URL reachable through the local IP.
+	location func(local net.IP) string
+
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	done   chan struct{}
+	closed bool
+	// announced is true when the device was announced to the multicast group.
+	announced bool
+}
+
+// NewSSDPServer creates a server announcing the device with the given UUID and device/service types.
+func NewSSDPServer(uuid string, types []string, location func(local net.IP) string) *SSDPServer {
+	targets := append([]string{"upnp:rootdevice", "uuid:" + uuid}, types...)
+	return &SSDPServer{
+		uuid:     uuid,
+		targets:  targets,
+		location: location,
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *SSDPServer) usn(target string) string {
+	if target == "uuid:"+s.uuid {
+		return target
+	}
+	return "uuid:" + s.uuid + "::" + target
+}
+
+// searchResponses returns responses to an M-SEARCH request, or nil if the request doesn't match the device.
+func (s *SSDPServer) searchResponses(msg []byte, local net.IP) [][]byte {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+		return nil
+	}
+	st := req.Header.Get("St")
+	var matched []string
+	for _, target := range s.targets {
+		if st == "ssdp:all" || st == target {
+			matched = append(matched, target)
+		}
+	}
+	var responses [][]byte
+	for _, target := range matched {
+		resp := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"DATE: %s\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n"+
+			"\r\n",
+			ssdpMaxAge, time.Now().UTC().Format(http.TimeFormat), s.location(local), ssdpServer, target, s.usn(target))
+		responses = append(responses, []byte(resp))
+	}
+	return responses
+}
+
+// notifyMessage returns an ssdp:alive or ssdp:byebye announcement.
+func (s *SSDPServer) notifyMessage(target string, nts string, local net.IP) []byte {
+	msg := "NOTIFY * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"NT: " + target + "\r\n" +
+		"NTS: " + nts + "\r\n" +
+		"USN: " + s.usn(target) + "\r\n"
+	if nts == "ssdp:alive" {
+		msg += fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+			"LOCATION: " + s.location(local) + "\r\n" +
+			"SERVER: " + ssdpServer + "\r\n"
+	}
+	return []byte(msg + "\r\n")
+}
+
+// localIPFor returns the local IP used to reach the remote address.
+func localIPFor(remote *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// multicastIPs returns IPv4 addresses of the network interfaces that support multicast.
+func multicastIPs() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// notify sends announcements to the multicast group from every network interface.
+func (s *SSDPServer) notify(nts string) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return
+	}
+	for _, ip := range multicastIPs() {
+		conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: ip}, group)
+		if err != nil {
+			slog.Warn("failed sending SSDP announcement", slog.Any("err", err), slog.String("ip", ip.String()))
+			continue
+		}
+		for _, target := range s.targets {
+			if _, err := conn.Write(s.notifyMessage(target, nts, ip)); err != nil {
+				slog.Warn("failed sending SSDP announcement", slog.Any("err", err), slog.String("ip", ip.String()))
+				break
+			}
+		}
+		conn.Close()
+	}
+}
+
+// Serve answers discovery requests received on the connection until it's closed.
+func (s *SSDPServer) Serve(conn *net.UDPConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		responses := s.searchResponses(buf[:n], localIPFor(remote))
+		for _, resp := range responses {
+			if _, err := conn.WriteToUDP(resp, remote); err != nil {
+				slog.Warn("failed answering SSDP search", slog.Any("err", err), slog.String("remote", remote.String()))
+				break
+			}
+		}
+	}
+}
+
+// ListenAndServe joins the SSDP multicast group, periodically announces the device and answers discovery requests.
+func (s *SSDPServer) ListenAndServe() error {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.announced = true
+	s.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(ssdpMaxAge / 2 * time.Second)
+		defer ticker.Stop()
+		for {
+			s.notify("ssdp:alive")
+			select {
+			case <-ticker.C:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s.Serve(conn)
+}
+
+// Close stops the server and announces that the device is leaving the network.
+func (s *SSDPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn == nil {
+		return nil
+	}
+	if s.announced {
+		s.notify("ssdp:byebye")
+	}
+	return s.conn.Close()
+}
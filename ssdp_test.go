@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSDPServer(t *testing.T) {
+	asrt := assert.New(t)
+
+	types := []string{upnpMediaServerType, upnpContentDirectoryType}
+	s := NewSSDPServer("1234", types, func(local net.IP) string {
+		return "http://" + local.String() + ":8080/upnp/device.xml"
+	})
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	asrt.NoError(err)
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(conn)
+	}()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	asrt.NoError(err)
+	defer client.Close()
+
+	search := func(st string) []*http.Response {
+		t.Helper()
+		_, err := client.Write([]byte("M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 1\r\n" +
+			"ST: " + st + "\r\n\r\n"))
+		asrt.NoError(err)
+		var responses []*http.Response
+		buf := make([]byte, 2048)
+		for {
+			asrt.NoError(client.SetReadDeadline(time.Now().Add(200 * time.Millisecond)))
+			n, err := client.Read(buf)
+			if err != nil {
+				return responses
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			asrt.NoError(err)
+			responses = append(responses, resp)
+		}
+	}
+
+	responses := search(upnpMediaServerType)
+	if asrt.Len(responses, 1) {
+		resp := responses[0]
+		asrt.Equal(http.StatusOK, resp.StatusCode)
+		asrt.Equal("http://127.0.0.1:8080/upnp/device.xml", resp.Header.Get("Location"))
+		asrt.Equal(upnpMediaServerType, resp.Header.Get("St"))
+		asrt.Equal("uuid:1234::"+upnpMediaServerType, resp.Header.Get("Usn"))
+		asrt.Equal("max-age=1800", resp.Header.Get("Cache-Control"))
+	}
+
+	responses = search("uuid:1234")
+	if asrt.Len(responses, 1) {
+		asrt.Equal("uuid:1234", responses[0].Header.Get("Usn"))
+	}
+
+	// The root device, the UUID and each type.
+	asrt.Len(search("ssdp:all"), 4)
+
+	asrt.Empty(search("urn:schemas-upnp-org:device:MediaRenderer:1"))
+
+	asrt.NoError(s.Close())
+	asrt.NoError(<-served)
+}
+
+func TestSSDPServer_notifyMessage(t *testing.T) {
+	s := NewSSDPServer("1234", nil, func(local net.IP) string {
+		return "http://" + local.String() + "/device.xml"
+	})
+	alive := string(s.notifyMessage("upnp:rootdevice", "ssdp:alive", net.IPv4(10, 0, 0, 1)))
+	assert.Contains(t, alive, "NOTIFY * HTTP/1.1\r\n")
+	assert.Contains(t, alive, "NTS: ssdp:alive\r\n")
+	assert.Contains(t, alive, "USN: uuid:1234::upnp:rootdevice\r\n")
+	assert.Contains(t, alive, "LOCATION: http://10.0.0.1/device.xml\r\n")
+
+	byebye := string(s.notifyMessage("upnp:rootdevice", "ssdp:byebye", net.IPv4(10, 0, 0, 1)))
+	assert.Contains(t, byebye, "NTS: ssdp:byebye\r\n")
+	assert.NotContains(t, byebye, "LOCATION")
+}
@@ -15,6 +15,7 @@ function initPlayer() {
   const buttonPrevEl = document.querySelector(".button-prev");
   const buttonNextEl = document.querySelector(".button-next");
   const coverImgEl = document.querySelector(".cover > img");
+  const lyricsEl = document.querySelector(".lyrics");
   const trackEls = document.querySelectorAll(".track");
   if (trackEls.length == 0) {
     return;
@@ -27,11 +28,101 @@ function initPlayer() {
 
   const audio = new Audio();
 
-  function setTrack(idx) {
+  // HLS is only used when the browser plays it natively.
+  const hlsSupported = audio.canPlayType("application/vnd.apple.mpegurl") != "";
+
+  function trackURL(trackEl) {
+    const url = (hlsSupported && trackEl.dataset.hlsUrl) || trackEl.dataset.url;
+    return new URL(url, document.baseURI).href;
+  }
+
+  // Tracks split by CUE sheets share the same audio file and have start/end offsets in seconds.
+  // End offset 0 means the track lasts until the end of the file.
+  function trackStart(idx) {
+    return parseFloat(trackEls[idx].dataset.start) || 0;
+  }
+
+  function trackEnd(idx) {
+    return parseFloat(trackEls[idx].dataset.end) || audio.duration || 0;
+  }
+
+  function seek(t) {
+    if (audio.readyState > 0) {
+      audio.currentTime = t;
+    } else {
+      audio.addEventListener("loadedmetadata", () => {
+        audio.currentTime = t;
+      }, { once: true });
+    }
+  }
+
+  // Lyrics of the current track. Each line is {time, text, el}.
+  var lyrics = null;
+
+  // Pages without the lyrics element, like playlists, don't show lyrics.
+  function loadLyrics(trackEl) {
+    lyrics = null;
+    if (!lyricsEl) {
+      return;
+    }
+    lyricsEl.replaceChildren();
+    if (!trackEl.dataset.lyrics) {
+      return;
+    }
+    const url = trackEl.dataset.lyrics;
+    fetch(url)
+      .then(resp => resp.ok ? resp.json() : Promise.reject(resp.statusText))
+      .then(data => {
+        if (trackEls[currentTrackIdx].dataset.lyrics != url) {
+          // The track changed while loading.
+          return;
+        }
+        lyrics = data;
+        lyrics.lines.forEach(line => {
+          line.el = document.createElement("div");
+          line.el.textContent = line.text;
+          lyricsEl.appendChild(line.el);
+        });
+      })
+      .catch(err => console.error("failed loading lyrics", err));
+  }
+
+  function highlightLyrics(t) {
+    if (!lyrics || !lyrics.synced) {
+      return;
+    }
+    var current = null;
+    lyrics.lines.forEach(line => {
+      if (line.time <= t) {
+        current = line;
+      }
+    });
+    if (current == lyrics.current) {
+      return;
+    }
+    if (lyrics.current) {
+      lyrics.current.el.classList.remove("current");
+    }
+    lyrics.current = current;
+    if (current) {
+      current.el.classList.add("current");
+      current.el.scrollIntoView({ block: "nearest" });
+    }
+  }
+
+  // setTrack switches to the track at idx. When the track continues the current file, the playback is not interrupted.
+  function setTrack(idx, continuous) {
     currentTrackIdx = idx;
     const trackEl = trackEls[idx];
-    audio.src = trackEl.dataset.url;
+    const url = trackURL(trackEl);
+    if (audio.src != url) {
+      audio.src = url;
+      seek(trackStart(idx));
+    } else if (!continuous) {
+      seek(trackStart(idx));
+    }
     titleEl.innerText = trackEl.dataset.title;
+    loadLyrics(trackEl);
 
     if (idx == 0) {
       buttonPrevEl.classList.add("disabled");
@@ -72,18 +163,83 @@ function initPlayer() {
 
   setTrack(0);
 
+  // Audiobooks remember the playback position on the server.
+  const positionURL = document.querySelector(".table").dataset.positionUrl;
+  let lastSavedPosition = 0;
+
+  function savePosition(beacon) {
+    if (!positionURL || !audio.currentTime) {
+      return;
+    }
+    const body = JSON.stringify({
+      track: trackEls[currentTrackIdx].dataset.path,
+      time: audio.currentTime
+    });
+    lastSavedPosition = audio.currentTime;
+    if (beacon) {
+      navigator.sendBeacon(positionURL, body);
+      return;
+    }
+    fetch(positionURL, { method: "PUT", body: body })
+      .catch(err => console.error("failed saving position", err));
+  }
+
+  function restorePosition(pos) {
+    // Find the last track or chapter of the file that starts before the saved position.
+    var idx = -1;
+    trackEls.forEach((el, i) => {
+      if (el.dataset.path == pos.track && trackStart(i) <= pos.time) {
+        idx = i;
+      }
+    });
+    if (idx == -1) {
+      return;
+    }
+    setTrack(idx);
+    seek(pos.time);
+    lastSavedPosition = pos.time;
+  }
+
+  if (positionURL) {
+    fetch(positionURL)
+      .then(resp => resp.status == 200 ? resp.json() : null)
+      .then(pos => {
+        if (pos && audio.paused) {
+          restorePosition(pos);
+        }
+      })
+      .catch(err => console.error("failed loading position", err));
+    window.addEventListener("pagehide", () => savePosition(true));
+  }
+
   let mouseDownOnSlider = false;
 
   audio.addEventListener("loadeddata", () => {
     progressEl.value = 0;
   });
   audio.addEventListener("timeupdate", () => {
-    if (mouseDownOnSlider || !audio.duration) {
+    if (!audio.duration) {
+      return;
+    }
+    const start = trackStart(currentTrackIdx);
+    const end = trackEnd(currentTrackIdx);
+    if (audio.currentTime >= end && end < audio.duration && currentTrackIdx < trackEls.length - 1) {
+      // Reached the boundary of a CUE sheet track.
+      trackEls[currentTrackIdx].classList.remove("playing");
+      setTrack(currentTrackIdx + 1, true);
+      trackEls[currentTrackIdx].classList.add("playing");
+      return;
+    }
+    highlightLyrics(audio.currentTime - start);
+    if (Math.abs(audio.currentTime - lastSavedPosition) > 15) {
+      savePosition(false);
+    }
+    if (mouseDownOnSlider) {
       return;
     }
-    progressEl.value = audio.currentTime / audio.duration * 100;
-    timeElapsedEl.textContent = fmtTime(audio.currentTime);
-    timeTotalEl.textContent = fmtTime(audio.duration);
+    progressEl.value = (audio.currentTime - start) / (end - start) * 100;
+    timeElapsedEl.textContent = fmtTime(Math.max(audio.currentTime - start, 0));
+    timeTotalEl.textContent = fmtTime(end - start);
   });
   audio.addEventListener("ended", () => {
     pause();
@@ -93,6 +249,7 @@ function initPlayer() {
     }
   });
   audio.addEventListener("pause", () => {
+    savePosition(false);
     buttonPlayPauseEl.classList.remove("playing");
     trackEls[currentTrackIdx].classList.remove("playing");
   });
@@ -111,7 +268,8 @@ function initPlayer() {
 
   progressEl.addEventListener("change", () => {
     const pct = progressEl.value / 100;
-    audio.currentTime = (audio.duration || 0) * pct;
+    const start = trackStart(currentTrackIdx);
+    audio.currentTime = start + (trackEnd(currentTrackIdx) - start) * pct;
   });
   progressEl.addEventListener("mousedown", () => {
     mouseDownOnSlider = true;
@@ -149,8 +307,10 @@ function initPlayer() {
   }
 
   trackEls.forEach(el => el.addEventListener("click", event => {
-    const trackEl = event.currentTarget;
-    const targetIdx = parseInt(trackEl.dataset.index, 10);
+    if (event.target.closest(".track-actions")) {
+      return;
+    }
+    const targetIdx = Array.prototype.indexOf.call(trackEls, event.currentTarget);
     if (targetIdx == currentTrackIdx) {
       if (audio.paused) {
         audio.play();
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 type storageEntry struct {
@@ -75,7 +83,10 @@ func (e *StorageDirectory) Parents() []*StorageDirectory {
 
 type StorageFile struct {
 	storageEntry
-	Size int64
+	Size         int64
+	LastModified time.Time
+	// ETag is the S3 object ETag. It's empty when unknown.
+	ETag string
 }
 
 func NewStorageFile(p string, size int64) *StorageFile {
@@ -93,33 +104,116 @@ func (e *StorageFile) FriendlyName() string {
 	return name
 }
 
+// Storage is a tree of media files. Paths are relative to the tree root.
+type Storage interface {
+	List(p string) ([]*StorageDirectory, []*StorageFile, error)
+	FileSize(p string) (int64, error)
+	ReadFile(p string) ([]byte, error)
+	OpenFile(p string) (io.ReadCloser, error)
+	ReadFileAt(p string, b []byte, off int64) (int, error)
+	FileContentURL(p string) (string, error)
+	// WithContext returns a storage making requests with the context.
+	WithContext(ctx context.Context) Storage
+}
+
 type S3Storage struct {
 	s3  *s3.S3
 	cfg S3Config
+	ctx context.Context
+	// urls is shared by copies of the storage with different contexts.
+	urls *presignCache
+	// cdn is optional and can be nil.
+	cdn *CDNSigner
+	// hidden are raw key prefixes of objects that aren't media files, e.g. playlists.
+	// They're excluded from the tree of media files.
+	hidden []string
 }
 
+const defaultRoleSessionName = "bsimp"
+
+// roleCredentials returns credentials of the role from the config. Without a role, it returns nil.
+// The role is assumed with a web identity token or with the session credentials.
+func roleCredentials(sess *session.Session, cfg S3Config) *credentials.Credentials {
+	if cfg.AssumeRoleARN == "" {
+		return nil
+	}
+	sessionName := cfg.AssumeRoleSessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	stsClient := sts.New(sess, &aws.Config{Endpoint: cfg.STSEndpoint})
+	if cfg.WebIdentityTokenFile != "" {
+		return credentials.NewCredentials(stscreds.NewWebIdentityRoleProviderWithOptions(
+			stsClient, cfg.AssumeRoleARN, sessionName, stscreds.FetchTokenPath(cfg.WebIdentityTokenFile)))
+	}
+	provider := &stscreds.AssumeRoleProvider{
+		Client:          stsClient,
+		RoleARN:         cfg.AssumeRoleARN,
+		RoleSessionName: sessionName,
+		Duration:        stscreds.DefaultDuration,
+		ExpiryWindow:    time.Minute,
+	}
+	if cfg.AssumeRoleExternalID != "" {
+		provider.ExternalID = aws.String(cfg.AssumeRoleExternalID)
+	}
+	return credentials.NewCredentials(provider)
+}
+
+// NewS3Storage creates a storage for the bucket. Without static credentials, a profile or a role,
+// the credentials come from the default AWS SDK chain: environment variables, shared files and instance roles.
 func NewS3Storage(cfg S3Config) (*S3Storage, error) {
 	awsConfig := aws.Config{
-		Region:   cfg.Region,
-		Endpoint: cfg.Endpoint,
+		Region: cfg.Region,
 	}
 	if cfg.Credentials != nil {
 		awsConfig.Credentials = credentials.NewStaticCredentials(cfg.Credentials.ID, cfg.Credentials.Secret, cfg.Credentials.Token)
 	}
-	if cfg.ForcePathStyle {
-		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	opts := session.Options{
+		Config:  awsConfig,
+		Profile: cfg.Profile,
+	}
+	if cfg.Profile != "" {
+		opts.SharedConfigState = session.SharedConfigEnable
 	}
-	sess, err := session.NewSession(&awsConfig)
+	sess, err := session.NewSessionWithOptions(opts)
 	if err != nil {
 		return nil, err
 	}
+	// The endpoint is S3-specific, it doesn't apply to STS.
+	s3Config := &aws.Config{
+		Endpoint:    cfg.Endpoint,
+		Credentials: roleCredentials(sess, cfg),
+	}
+	if cfg.ForcePathStyle {
+		s3Config.S3ForcePathStyle = aws.Bool(true)
+	}
 	store := S3Storage{
-		s3:  s3.New(sess),
-		cfg: cfg,
+		s3:   s3.New(sess, s3Config),
+		cfg:  cfg,
+		ctx:  context.Background(),
+		urls: newPresignCache(time.Duration(cfg.RequestPresignExpiry)),
+	}
+	store.s3.Handlers.Send.PushBack(countS3Request)
+	if cfg.CDN != nil {
+		store.cdn, err = NewCDNSigner(*cfg.CDN)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &store, nil
 }
 
+// WithContext returns a storage making requests with the context.
+func (store *S3Storage) WithContext(ctx context.Context) Storage {
+	return store.withContext(ctx)
+}
+
+func (store *S3Storage) withContext(ctx context.Context) *S3Storage {
+	c := *store
+	c.ctx = ctx
+	return &c
+}
+
 // prefix returns an S3 prefix from a public user-provided path.
 // prefix can be the entire key.
 func (store *S3Storage) prefix(p string) string {
@@ -135,6 +229,38 @@ func (store *S3Storage) path(key string) string {
 	)
 }
 
+var (
+	errNoDirectory = errors.New("directory doesn't exist")
+	errHiddenKey   = errors.New("object isn't a media file")
+)
+
+// hide excludes objects under the raw key prefixes from the tree of media files.
+func (store *S3Storage) hide(prefixes ...string) {
+	for _, prefix := range prefixes {
+		if prefix != "" {
+			store.hidden = append(store.hidden, prefix)
+		}
+	}
+}
+
+func (store *S3Storage) isHidden(key string) bool {
+	for _, prefix := range store.hidden {
+		if strings.HasPrefix(key, prefix) || key+Delimiter == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// fileKey returns the S3 key of the file under the given path.
+func (store *S3Storage) fileKey(p string) (string, error) {
+	key := store.prefix(p)
+	if store.isHidden(key) {
+		return "", errHiddenKey
+	}
+	return key, nil
+}
+
 // List returns slices of directories and files under the given path.
 func (store *S3Storage) List(p string) ([]*StorageDirectory, []*StorageFile, error) {
 	input := &s3.ListObjectsV2Input{
@@ -148,11 +274,15 @@ func (store *S3Storage) List(p string) ([]*StorageDirectory, []*StorageFile, err
 
 	var prefixes []*s3.CommonPrefix
 	var objects []*s3.Object
-	err := store.s3.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-		prefixes = append(prefixes, page.CommonPrefixes...)
+	err := store.s3.ListObjectsV2PagesWithContext(store.ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, prefix := range page.CommonPrefixes {
+			if !store.isHidden(*prefix.Prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
 		for _, object := range page.Contents {
 			// Ignore empty objects used to emulate empty directories.
-			if *object.Size != 0 {
+			if *object.Size != 0 && !store.isHidden(*object.Key) {
 				objects = append(objects, object)
 			}
 		}
@@ -163,7 +293,7 @@ func (store *S3Storage) List(p string) ([]*StorageDirectory, []*StorageFile, err
 	}
 
 	if len(prefixes) == 0 && len(objects) == 0 {
-		return nil, nil, errors.New("directory doesn't exist")
+		return nil, nil, errNoDirectory
 	}
 
 	var dirs []*StorageDirectory
@@ -174,7 +304,14 @@ func (store *S3Storage) List(p string) ([]*StorageDirectory, []*StorageFile, err
 	}
 
 	for _, object := range objects {
-		files = append(files, NewStorageFile(store.path(*object.Key), *object.Size))
+		f := NewStorageFile(store.path(*object.Key), *object.Size)
+		if object.LastModified != nil {
+			f.LastModified = *object.LastModified
+		}
+		if object.ETag != nil {
+			f.ETag = *object.ETag
+		}
+		files = append(files, f)
 	}
 
 	return dirs, files, nil
@@ -182,19 +319,153 @@ func (store *S3Storage) List(p string) ([]*StorageDirectory, []*StorageFile, err
 
 // FileSize returns size of the file under the given path.
 func (store *S3Storage) FileSize(p string) (int64, error) {
+	key, err := store.fileKey(p)
+	if err != nil {
+		return 0, err
+	}
 	input := &s3.HeadObjectInput{
 		Bucket: aws.String(store.cfg.Bucket),
-		Key:    aws.String(store.prefix(p)),
+		Key:    aws.String(key),
 	}
-	resp, err := store.s3.HeadObject(input)
+	resp, err := store.s3.HeadObjectWithContext(store.ctx, input)
 	if err != nil {
 		return 0, err
 	}
 	return *resp.ContentLength, nil
 }
 
+// ReadFile returns content of the file under the given path.
+func (store *S3Storage) ReadFile(p string) ([]byte, error) {
+	key, err := store.fileKey(p)
+	if err != nil {
+		return nil, err
+	}
+	return store.ReadObject(key)
+}
+
+// OpenFile returns a reader streaming content of the file under the given path.
+func (store *S3Storage) OpenFile(p string) (io.ReadCloser, error) {
+	key, err := store.fileKey(p)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := store.s3.GetObjectWithContext(store.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.cfg.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ReadFileAt reads len(b) bytes of the file under the given path starting at the offset.
+func (store *S3Storage) ReadFileAt(p string, b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	key, err := store.fileKey(p)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := store.s3.GetObjectWithContext(store.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.cfg.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, b)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// storageFileReader implements io.ReaderAt for a file using ranged requests.
+type storageFileReader struct {
+	store Storage
+	path  string
+}
+
+func (r *storageFileReader) ReadAt(b []byte, off int64) (int, error) {
+	return r.store.ReadFileAt(r.path, b, off)
+}
+
+// maxPresignCacheEntries limits the number of cached presigned URLs.
+const maxPresignCacheEntries = 10000
+
+type presignedURL struct {
+	url     string
+	expires time.Time
+}
+
+// presignCache keeps presigned URLs until half of their lifetime has passed,
+// so a URL handed out to a player stays valid for at least half of the expiry.
+// Reusing URLs saves S3 requests and lets browsers cache media files.
+type presignCache struct {
+	expiry time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]presignedURL
+}
+
+func newPresignCache(expiry time.Duration) *presignCache {
+	return &presignCache{
+		expiry:  expiry,
+		now:     time.Now,
+		entries: make(map[string]presignedURL),
+	}
+}
+
+// get returns a cached URL of the key that doesn't expire within half of the expiry.
+func (c *presignCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || c.now().Add(c.expiry/2).After(e.expires) {
+		return "", false
+	}
+	return e.url, true
+}
+
+func (c *presignCache) put(key string, url string, signed time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxPresignCacheEntries {
+		now := c.now()
+		for k, e := range c.entries {
+			if now.Add(c.expiry / 2).After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxPresignCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = presignedURL{url: url, expires: signed.Add(c.expiry)}
+}
+
+func (c *presignCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
 // FileContentURL returns a publicly accessible URL for the file under the given path.
+// URLs are presigned S3 URLs or CDN URLs when a CDN is configured.
+// URLs are cached, the object is checked only when a new URL is signed.
 func (store *S3Storage) FileContentURL(p string) (string, error) {
+	key, err := store.fileKey(p)
+	if err != nil {
+		return "", err
+	}
+	if url, ok := store.urls.get(key); ok {
+		return url, nil
+	}
 	size, err := store.FileSize(p)
 	if err != nil {
 		return "", err
@@ -202,9 +473,96 @@ func (store *S3Storage) FileContentURL(p string) (string, error) {
 	if size == 0 {
 		return "", errors.New("no content")
 	}
-	req, _ := store.s3.GetObjectRequest(&s3.GetObjectInput{
+	signed := store.urls.now()
+	var url string
+	if store.cdn != nil {
+		url, err = store.cdn.URL(key, signed.Add(store.urls.expiry))
+	} else {
+		req, _ := store.s3.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(store.cfg.Bucket),
+			Key:    aws.String(key),
+		})
+		url, err = req.Presign(store.urls.expiry)
+	}
+	if err != nil {
+		return "", err
+	}
+	store.urls.put(key, url, signed)
+	return url, nil
+}
+
+// IsNotExist returns whether the error is caused by a missing object or directory.
+func IsNotExist(err error) bool {
+	if errors.Is(err, errNoDirectory) || errors.Is(err, errHiddenKey) || errors.Is(err, errNoLibrary) || errors.Is(err, errIgnored) {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// ListKeys returns all object keys under the given raw S3 prefix.
+// Unlike List, the prefix isn't relative to the base prefix.
+func (store *S3Storage) ListKeys(prefix string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.cfg.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	var keys []string
+	err := store.s3.ListObjectsV2PagesWithContext(store.ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ReadObject returns content of the object under the given raw S3 key.
+func (store *S3Storage) ReadObject(key string) ([]byte, error) {
+	resp, err := store.s3.GetObjectWithContext(store.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.cfg.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// WriteObject creates or replaces the object under the given raw S3 key.
+func (store *S3Storage) WriteObject(key string, data []byte, contentType string) error {
+	_, err := store.s3.PutObjectWithContext(store.ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(store.cfg.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+// DeleteObject deletes the object under the given raw S3 key.
+func (store *S3Storage) DeleteObject(key string) error {
+	_, err := store.s3.DeleteObjectWithContext(store.ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(store.cfg.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Ping checks that the bucket exists and is accessible with the credentials.
+func (store *S3Storage) Ping() error {
+	_, err := store.s3.HeadBucketWithContext(store.ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(store.cfg.Bucket),
-		Key:    aws.String(store.prefix(p)),
 	})
-	return req.Presign(time.Duration(store.cfg.RequestPresignExpiry))
+	return err
 }
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -11,6 +18,7 @@ import (
 	"github.com/johannesboyne/gofakes3"
 	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func files(paths ...string) []*StorageFile {
@@ -76,6 +84,22 @@ func newTestS3Config() (S3Config, func()) {
 	}, ts.Close
 }
 
+// newTestStorage returns a storage backed by a fake S3 bucket holding the files with "1" as the content.
+func newTestStorage(t *testing.T, bucket string, files ...string) *S3Storage {
+	t.Helper()
+	cfg, closeS3 := newTestS3Config()
+	t.Cleanup(closeS3)
+	cfg.Bucket = bucket
+	s, err := NewS3Storage(cfg)
+	require.NoError(t, err)
+	_, err = s.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	require.NoError(t, err)
+	for _, p := range files {
+		require.NoError(t, s.WriteObject(p, []byte("1"), ""))
+	}
+	return s
+}
+
 func TestS3Storage(t *testing.T) {
 	asrt := assert.New(t)
 
@@ -205,6 +229,18 @@ func TestS3Storage(t *testing.T) {
 	_, err = s.FileSize("dir2/dir22/file5.jpg")
 	asrt.Error(err)
 
+	// Ranged reads.
+	b := make([]byte, 2)
+	n, err := s.ReadFileAt("dir2/dir22/file4.jpg", b, 1)
+	asrt.NoError(err)
+	asrt.Equal(2, n)
+	asrt.Equal("23", string(b))
+
+	n, err = s.ReadFileAt("dir2/dir22/file4.jpg", b, 3)
+	asrt.ErrorIs(err, io.EOF)
+	asrt.Equal(1, n)
+	asrt.Equal("4", string(b[:n]))
+
 	// Base prefix dir1.
 	s.cfg.BasePrefix = "dir1/"
 	dirs, files, err = s.List("")
@@ -235,3 +271,115 @@ func TestS3Storage(t *testing.T) {
 	_, _, err = s.List("")
 	asrt.Error(err)
 }
+
+func TestS3Storage_FileContentURLCache(t *testing.T) {
+	s := newTestStorage(t, "test", "a.mp3")
+	now := time.Now()
+	s.urls.now = func() time.Time { return now }
+
+	contentURL := func() (string, int64) {
+		ctx, stats := withRequestStats(context.Background())
+		url, err := s.WithContext(ctx).FileContentURL("a.mp3")
+		require.NoError(t, err)
+		return url, stats.s3Requests.Load()
+	}
+
+	url1, requests := contentURL()
+	assert.EqualValues(t, 1, requests)
+	url2, requests := contentURL()
+	assert.EqualValues(t, 0, requests)
+	assert.Equal(t, url1, url2)
+
+	// URLs are renewed when less than half of the expiry is left.
+	now = now.Add(31 * time.Second)
+	_, requests = contentURL()
+	assert.EqualValues(t, 1, requests)
+	_, requests = contentURL()
+	assert.EqualValues(t, 0, requests)
+	assert.Equal(t, 1, s.urls.len())
+
+	// Missing files aren't cached.
+	_, err := s.FileContentURL("b.mp3")
+	assert.Error(t, err)
+	assert.Equal(t, 1, s.urls.len())
+}
+
+// newTestSTSServer returns a fake STS endpoint issuing session credentials for any role.
+func newTestSTSServer(t *testing.T) (*httptest.Server, *url.Values) {
+	form := &url.Values{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		*form = r.PostForm
+		action := r.PostForm.Get("Action")
+		fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>role-id</AccessKeyId>
+      <SecretAccessKey>role-secret</SecretAccessKey>
+      <SessionToken>role-token</SessionToken>
+      <Expiration>%[2]s</Expiration>
+    </Credentials>
+  </%[1]sResult>
+</%[1]sResponse>`, action, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	return ts, form
+}
+
+func TestNewS3Storage_AssumeRole(t *testing.T) {
+	sts, form := newTestSTSServer(t)
+	defer sts.Close()
+
+	cfg, closeS3 := newTestS3Config()
+	defer closeS3()
+	cfg.STSEndpoint = &sts.URL
+	cfg.AssumeRoleARN = "arn:aws:iam::123456789012:role/bsimp-read"
+	cfg.AssumeRoleExternalID = "external"
+	s, err := NewS3Storage(cfg)
+	require.NoError(t, err)
+	creds, err := s.s3.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "role-id", creds.AccessKeyID)
+	assert.Equal(t, "role-token", creds.SessionToken)
+	assert.Equal(t, "AssumeRole", form.Get("Action"))
+	assert.Equal(t, cfg.AssumeRoleARN, form.Get("RoleArn"))
+	assert.Equal(t, "external", form.Get("ExternalId"))
+	assert.Equal(t, "bsimp", form.Get("RoleSessionName"))
+
+	// Role credentials are used for S3 requests.
+	_, err = s.s3.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("test")})
+	assert.NoError(t, err)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("oidc-token"), 0o600))
+	cfg.Credentials = nil
+	cfg.AssumeRoleExternalID = ""
+	cfg.AssumeRoleSessionName = "pod"
+	cfg.WebIdentityTokenFile = tokenFile
+	s, err = NewS3Storage(cfg)
+	require.NoError(t, err)
+	creds, err = s.s3.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "role-id", creds.AccessKeyID)
+	assert.Equal(t, "AssumeRoleWithWebIdentity", form.Get("Action"))
+	assert.Equal(t, "oidc-token", form.Get("WebIdentityToken"))
+	assert.Equal(t, "pod", form.Get("RoleSessionName"))
+}
+
+func TestNewS3Storage_Profile(t *testing.T) {
+	dir := t.TempDir()
+	credsFile := filepath.Join(dir, "credentials")
+	require.NoError(t, os.WriteFile(credsFile, []byte("[music]\naws_access_key_id = profile-id\naws_secret_access_key = profile-secret\n"), 0o600))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+
+	cfg, closeS3 := newTestS3Config()
+	defer closeS3()
+	cfg.Credentials = nil
+	cfg.Profile = "music"
+	s, err := NewS3Storage(cfg)
+	require.NoError(t, err)
+	creds, err := s.s3.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "profile-id", creds.AccessKeyID)
+	assert.Equal(t, "profile-secret", creds.SecretAccessKey)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoClientCAs = errors.New("no certificates found in tls client_ca_file")
+
+// TLSCertificates provides the TLS config of the HTTPS server.
+// The certificate, the key and client CAs are reloaded when their files change, new connections use the new files.
+type TLSCertificates struct {
+	cfg  TLSConfig
+	conf atomic.Pointer[tls.Config]
+
+	mu       sync.Mutex
+	versions []fileVersion
+}
+
+// NewTLSCertificates loads the certificate, the key and client CAs.
+func NewTLSCertificates(cfg TLSConfig) (*TLSCertificates, error) {
+	c := &TLSCertificates{cfg: cfg}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *TLSCertificates) files() []string {
+	files := []string{c.cfg.CertFile, c.cfg.KeyFile}
+	if c.cfg.ClientCAFile != "" {
+		files = append(files, c.cfg.ClientCAFile)
+	}
+	return files
+}
+
+func (c *TLSCertificates) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if c.cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, errNoClientCAs
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// Reload loads the files if they changed since the last load and returns whether they did.
+// On errors, the previous files stay in use until the files change again.
+func (c *TLSCertificates) Reload() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var versions []fileVersion
+	for _, p := range c.files() {
+		v, err := statFileVersion(p)
+		if err != nil {
+			return false, err
+		}
+		versions = append(versions, v)
+	}
+	if slices.Equal(versions, c.versions) {
+		return false, nil
+	}
+	c.versions = versions
+	conf, err := c.load()
+	if err != nil {
+		return false, err
+	}
+	c.conf.Store(conf)
+	return true, nil
+}
+
+// Watch reloads the files when they change. The files are polled at the interval.
+func (c *TLSCertificates) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := c.Reload()
+		if err != nil {
+			slog.Error("failed reloading TLS certificate", slog.Any("err", err), slog.String("cert_file", c.cfg.CertFile))
+			continue
+		}
+		if changed {
+			slog.Info("reloaded TLS certificate", slog.String("cert_file", c.cfg.CertFile))
+		}
+	}
+}
+
+// Config returns the server TLS config picking up reloaded files.
+func (c *TLSCertificates) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.conf.Load(), nil
+		},
+		// The server requires a certificate source in the base config.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &c.conf.Load().Certificates[0], nil
+		},
+	}
+}
+
+// RedirectToHTTPS redirects requests to the same URL on the HTTPS server listening on httpsAddr.
+func RedirectToHTTPS(httpsAddr string) (http.Handler, error) {
+	_, port, err := net.SplitHostPort(httpsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// The host has no port, IPv6 addresses are in brackets.
+			hostname = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+		}
+		host := strings.TrimSuffix(net.JoinHostPort(hostname, port), ":443")
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}), nil
+}
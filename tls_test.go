@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert creates a certificate signed by the parent, or a self-signed CA when the parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.pem, c.keyPEM(t))
+	require.NoError(t, err)
+	return cert
+}
+
+func writeTestCert(t *testing.T, cfg TLSConfig, c *testCert) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(cfg.CertFile, c.pem, 0o600))
+	require.NoError(t, os.WriteFile(cfg.KeyFile, c.keyPEM(t), 0o600))
+}
+
+func TestTLSCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	cfg := TLSConfig{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	require.NoError(t, os.WriteFile(cfg.ClientCAFile, ca.pem, 0o600))
+	writeTestCert(t, cfg, newTestCert(t, "server1", ca))
+
+	certs, err := NewTLSCertificates(cfg)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = certs.Config()
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(clientCert *testCert) (string, string, error) {
+		conf := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			conf.Certificates = []tls.Certificate{clientCert.tlsCertificate(t)}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, string(body), err
+	}
+
+	// Clients must present a certificate signed by the CA.
+	_, _, err = get(nil)
+	assert.Error(t, err)
+	_, _, err = get(newTestCert(t, "stranger", newTestCert(t, "other ca", nil)))
+	assert.Error(t, err)
+	server, client, err := get(newTestCert(t, "client", ca))
+	require.NoError(t, err)
+	assert.Equal(t, "server1", server)
+	assert.Equal(t, "client", client)
+
+	// Changed files are picked up by new connections.
+	writeTestCert(t, cfg, newTestCert(t, "server2", ca))
+	changed, err := certs.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = certs.Reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+	server, _, err = get(newTestCert(t, "client", ca))
+	require.NoError(t, err)
+	assert.Equal(t, "server2", server)
+
+	// Invalid files keep the previous certificate.
+	require.NoError(t, os.WriteFile(cfg.KeyFile, []byte("invalid"), 0o600))
+	_, err = certs.Reload()
+	assert.Error(t, err)
+	server, _, err = get(newTestCert(t, "client", ca))
+	require.NoError(t, err)
+	assert.Equal(t, "server2", server)
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	testCases := []struct {
+		addr     string
+		url      string
+		expected string
+	}{
+		{":443", "http://example.com/library/foo?bar=1", "https://example.com/library/foo?bar=1"},
+		{":443", "http://example.com:80/", "https://example.com/"},
+		{":8443", "http://example.com:8080/stream/a%20b.mp3", "https://example.com:8443/stream/a%20b.mp3"},
+		{"127.0.0.1:8443", "http://[::1]/", "https://[::1]:8443/"},
+		{":443", "http://[::1]:80/", "https://[::1]/"},
+	}
+	for _, tc := range testCases {
+		h, err := RedirectToHTTPS(tc.addr)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.url, nil))
+		assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+		assert.Equal(t, tc.expected, rec.Header().Get("Location"))
+	}
+
+	_, err := RedirectToHTTPS("8443")
+	assert.Error(t, err)
+}
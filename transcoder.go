@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTranscodingBitrate         = "128k"
+	defaultTranscodingSegmentDuration = 10 * time.Second
+	defaultTranscodingMaxProcesses    = 4
+	// transcodingTimeout limits how long a single ffmpeg or ffprobe process can run.
+	transcodingTimeout = 2 * time.Minute
+
+	// transcoderMaxCachedDurations limits the number of cached track durations.
+	transcoderMaxCachedDurations = 10000
+)
+
+// Transcoder converts audio tracks to AAC in MPEG-TS segments using ffmpeg.
+// Tracks are read by ffmpeg directly from presigned S3 URLs.
+type Transcoder struct {
+	cfg TranscodingConfig
+	// processes is a semaphore limiting concurrent processes.
+	processes chan struct{}
+
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+// NewTranscoder creates a transcoder and checks that ffmpeg and ffprobe are available.
+func NewTranscoder(cfg TranscodingConfig) (*Transcoder, error) {
+	if cfg.FFmpeg == "" {
+		cfg.FFmpeg = "ffmpeg"
+	}
+	if cfg.FFprobe == "" {
+		cfg.FFprobe = "ffprobe"
+	}
+	if cfg.Bitrate == "" {
+		cfg.Bitrate = defaultTranscodingBitrate
+	}
+	if cfg.SegmentDuration <= 0 {
+		cfg.SegmentDuration = Duration(defaultTranscodingSegmentDuration)
+	}
+	if cfg.MaxProcesses <= 0 {
+		cfg.MaxProcesses = defaultTranscodingMaxProcesses
+	}
+	for _, name := range []string{cfg.FFmpeg, cfg.FFprobe} {
+		if _, err := exec.LookPath(name); err != nil {
+			return nil, err
+		}
+	}
+	return &Transcoder{
+		cfg:       cfg,
+		processes: make(chan struct{}, cfg.MaxProcesses),
+		durations: make(map[string]time.Duration),
+	}, nil
+}
+
+// SegmentDuration returns the duration of HLS segments.
+func (t *Transcoder) SegmentDuration() time.Duration {
+	return time.Duration(t.cfg.SegmentDuration)
+}
+
+func ffprobeArgs(url string) []string {
+	return []string{"-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", url}
+}
+
+var errUnknownDuration = errors.New("unknown track duration")
+
+func parseFFprobeDuration(out []byte) (time.Duration, error) {
+	sec, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || sec <= 0 {
+		return 0, errUnknownDuration
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
+
+// formatSeconds formats the duration as seconds with millisecond precision.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func ffmpegSegmentArgs(url string, start time.Duration, length time.Duration, bitrate string) []string {
+	return []string{
+		"-v", "error",
+		"-ss", formatSeconds(start),
+		"-t", formatSeconds(length),
+		"-i", url,
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", bitrate,
+		"-f", "mpegts",
+		// Segments keep timestamps of the original track, so players can join them.
+		"-output_ts_offset", formatSeconds(start),
+		"pipe:1",
+	}
+}
+
+// run runs the command writing its output to w. The error includes messages printed by the command.
+func run(ctx context.Context, w io.Writer, name string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+var errTranscoderBusy = errors.New("too many transcoding processes")
+
+// run runs the command unless the process limit is reached. Processes are killed after transcodingTimeout.
+func (t *Transcoder) run(ctx context.Context, w io.Writer, name string, args ...string) error {
+	select {
+	case t.processes <- struct{}{}:
+	default:
+		return errTranscoderBusy
+	}
+	defer func() { <-t.processes }()
+	ctx, cancel := context.WithTimeout(ctx, transcodingTimeout)
+	defer cancel()
+	return run(ctx, w, name, args...)
+}
+
+// Duration returns the duration of the track under the path, read from the URL.
+// Durations are cached, as every segment request needs the duration.
+func (t *Transcoder) Duration(ctx context.Context, p string, url string) (time.Duration, error) {
+	t.mu.Lock()
+	d, ok := t.durations[p]
+	t.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+	var out bytes.Buffer
+	if err := t.run(ctx, &out, t.cfg.FFprobe, ffprobeArgs(url)...); err != nil {
+		return 0, err
+	}
+	d, err := parseFFprobeDuration(out.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	if len(t.durations) >= transcoderMaxCachedDurations {
+		clear(t.durations)
+	}
+	t.durations[p] = d
+	t.mu.Unlock()
+	return d, nil
+}
+
+// Segment transcodes a part of the track from the URL and writes it to w.
+func (t *Transcoder) Segment(ctx context.Context, w io.Writer, url string, start time.Duration, length time.Duration) error {
+	return t.run(ctx, w, t.cfg.FFmpeg, ffmpegSegmentArgs(url, start, length, t.cfg.Bitrate)...)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFFprobeDuration(t *testing.T) {
+	d, err := parseFFprobeDuration([]byte("245.812000\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 245812*time.Millisecond, d)
+
+	for _, out := range []string{"", "N/A\n", "0.000000\n"} {
+		_, err := parseFFprobeDuration([]byte(out))
+		assert.ErrorIs(t, err, errUnknownDuration, out)
+	}
+}
+
+func TestFFmpegSegmentArgs(t *testing.T) {
+	args := ffmpegSegmentArgs("http://s3/a.mp3", 20*time.Second, 2500*time.Millisecond, "96k")
+	assert.Equal(t, []string{
+		"-v", "error",
+		"-ss", "20.000",
+		"-t", "2.500",
+		"-i", "http://s3/a.mp3",
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", "96k",
+		"-f", "mpegts",
+		"-output_ts_offset", "20.000",
+		"pipe:1",
+	}, args)
+}
+
+// writeScript creates an executable shell script in the directory.
+func writeScript(t *testing.T, dir string, name string, script string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(p, []byte("#!/bin/sh\n"+script), 0o755))
+	return p
+}
+
+func TestTranscoder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts aren't supported")
+	}
+	asrt := assert.New(t)
+
+	_, err := NewTranscoder(TranscodingConfig{FFmpeg: "bsimp-missing-ffmpeg"})
+	asrt.Error(err)
+
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "calls")
+	cfg := TranscodingConfig{
+		// The fake ffprobe counts calls to check caching.
+		FFprobe: writeScript(t, dir, "ffprobe", `echo >> "`+counter+`"; echo 12.5`),
+		// The fake ffmpeg prints its arguments.
+		FFmpeg: writeScript(t, dir, "ffmpeg", `echo "$@"`),
+	}
+	tr, err := NewTranscoder(cfg)
+	asrt.NoError(err)
+	asrt.Equal(10*time.Second, tr.SegmentDuration())
+
+	for i := 0; i < 2; i++ {
+		d, err := tr.Duration(context.Background(), "a.mp3", "http://s3/a.mp3")
+		asrt.NoError(err)
+		asrt.Equal(12500*time.Millisecond, d)
+	}
+	calls, err := os.ReadFile(counter)
+	asrt.NoError(err)
+	asrt.Equal("\n", string(calls))
+
+	var buf bytes.Buffer
+	asrt.NoError(tr.Segment(context.Background(), &buf, "http://s3/a.mp3", 10*time.Second, 2500*time.Millisecond))
+	asrt.Equal("-v error -ss 10.000 -t 2.500 -i http://s3/a.mp3 -vn -c:a aac -b:a 128k -f mpegts -output_ts_offset 10.000 pipe:1\n", buf.String())
+
+	cfg.FFmpeg = writeScript(t, dir, "ffmpeg-fail", `echo "no such file" >&2; exit 1`)
+	tr, err = NewTranscoder(cfg)
+	asrt.NoError(err)
+	err = tr.Segment(context.Background(), &buf, "http://s3/a.mp3", 0, time.Second)
+	asrt.ErrorContains(err, "no such file")
+}
+
+// blockingWriter signals the first write and blocks until released.
+type blockingWriter struct {
+	written chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	close(w.written)
+	<-w.release
+	return len(b), nil
+}
+
+func TestTranscoder_MaxProcesses(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts aren't supported")
+	}
+	dir := t.TempDir()
+	tr, err := NewTranscoder(TranscodingConfig{
+		FFprobe:      writeScript(t, dir, "ffprobe", `echo 12.5`),
+		FFmpeg:       writeScript(t, dir, "ffmpeg", `echo segment`),
+		MaxProcesses: 1,
+	})
+	require.NoError(t, err)
+
+	w := &blockingWriter{written: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- tr.Segment(context.Background(), w, "http://s3/a.mp3", 0, time.Second)
+	}()
+	<-w.written
+
+	// The only process slot is taken.
+	var buf bytes.Buffer
+	err = tr.Segment(context.Background(), &buf, "http://s3/a.mp3", 0, time.Second)
+	assert.ErrorIs(t, err, errTranscoderBusy)
+	_, err = tr.Duration(context.Background(), "a.mp3", "http://s3/a.mp3")
+	assert.ErrorIs(t, err, errTranscoderBusy)
+
+	close(w.release)
+	require.NoError(t, <-done)
+	assert.NoError(t, tr.Segment(context.Background(), &buf, "http://s3/a.mp3", 0, time.Second))
+	assert.Equal(t, "segment\n", buf.String())
+}
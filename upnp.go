@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	upnpMediaServerType       = "urn:schemas-upnp-org:device:MediaServer:1"
+	upnpContentDirectoryType  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	upnpConnectionManagerType = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+	// upnpRootID is the object ID of the library root. The root path is empty, which isn't a valid object ID.
+	upnpRootID = "0"
+
+	// upnpMaxSearchResults limits the number of objects a search can return.
+	upnpMaxSearchResults = 1000
+	// upnpMaxSearchDirectories limits the number of directories listed by a single search.
+	upnpMaxSearchDirectories = 10000
+)
+
+// UPnPError is an error returned to control points as a SOAP fault.
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", e.Code, e.Description)
+}
+
+var (
+	errUPnPInvalidAction = &UPnPError{Code: 401, Description: "Invalid Action"}
+	errUPnPInvalidArgs   = &UPnPError{Code: 402, Description: "Invalid Args"}
+	errUPnPNoSuchObject  = &UPnPError{Code: 701, Description: "No such object"}
+	errUPnPBadCriteria   = &UPnPError{Code: 708, Description: "Unsupported or invalid search criteria"}
+	errUPnPSearchLimit   = &UPnPError{Code: 720, Description: "Cannot process the request"}
+)
+
+// UPnPServer implements a UPnP MediaServer with ContentDirectory browsing and search backed by the media library.
+type UPnPServer struct {
+	cfg      UPnPConfig
+	mediaLib atomic.Pointer[MediaLibrary]
+	uuid     string
+	scheme   string
+	port     string
+	basePath string
+	ssdp     *SSDPServer
+	// maxSearchDirectories limits directories listed by a search.
+	maxSearchDirectories int
+}
+
+// defaultUPnPUUID returns a UUID that stays the same between restarts on the same host.
+func defaultUPnPUUID(seed string) string {
+	hostname, _ := os.Hostname()
+	sum := md5.Sum([]byte(hostname + "/" + seed))
+	// Version 3 (name-based, MD5) UUID.
+	sum[6] = sum[6]&0x0f | 0x30
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// NewUPnPServer creates a UPnP server for the library served by the HTTP server at httpURL.
+// The host of the URL is the HTTP listen address, the path is the base path.
+func NewUPnPServer(cfg UPnPConfig, mediaLib *MediaLibrary, httpURL *url.URL) (*UPnPServer, error) {
+	_, port, err := net.SplitHostPort(httpURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	u := &UPnPServer{
+		cfg:                  cfg,
+		uuid:                 cfg.UUID,
+		scheme:               httpURL.Scheme,
+		port:                 port,
+		basePath:             httpURL.Path,
+		maxSearchDirectories: upnpMaxSearchDirectories,
+	}
+	u.mediaLib.Store(mediaLib)
+	if u.cfg.FriendlyName == "" {
+		u.cfg.FriendlyName = "Bsimp"
+	}
+	if u.uuid == "" {
+		u.uuid = defaultUPnPUUID(u.cfg.FriendlyName)
+	}
+	types := []string{upnpMediaServerType, upnpContentDirectoryType, upnpConnectionManagerType}
+	u.ssdp = NewSSDPServer(u.uuid, types, u.location)
+	return u, nil
+}
+
+// SetMediaLibrary replaces the library on config reloads. Requests in progress keep using the previous library.
+func (u *UPnPServer) SetMediaLibrary(mediaLib *MediaLibrary) {
+	u.mediaLib.Store(mediaLib)
+}
+
+// location returns the device description URL reachable through the local IP.
+func (u *UPnPServer) location(local net.IP) string {
+	return u.scheme + "://" + net.JoinHostPort(local.String(), u.port) + u.basePath + "/upnp/device.xml"
+}
+
+// ListenAndServeSSDP announces the server on the local network.
+func (u *UPnPServer) ListenAndServeSSDP() error {
+	return u.ssdp.ListenAndServe()
+}
+
+// Close stops SSDP announcements.
+func (u *UPnPServer) Close() error {
+	return u.ssdp.Close()
+}
+
+// RegisterHandlers registers the device description, service descriptions and control handlers.
+func (u *UPnPServer) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc(u.basePath+"/upnp/device.xml", u.DeviceDescriptionHandler)
+	mux.HandleFunc(u.basePath+"/upnp/ContentDirectory.xml", xmlHandler(contentDirectorySCPD))
+	mux.HandleFunc(u.basePath+"/upnp/ConnectionManager.xml", xmlHandler(connectionManagerSCPD))
+	mux.HandleFunc(u.basePath+"/upnp/control/ContentDirectory", u.ContentDirectoryHandler)
+	mux.HandleFunc(u.basePath+"/upnp/control/ConnectionManager", u.ConnectionManagerHandler)
+	mux.HandleFunc(u.basePath+"/upnp/event/", EventSubscriptionHandler)
+}
+
+func xmlHandler(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, xml.Header+body)
+	}
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+	SCPDURL     string `xml:"SCPDURL"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+}
+
+type upnpDevice struct {
+	DeviceType   string        `xml:"deviceType"`
+	FriendlyName string        `xml:"friendlyName"`
+	Manufacturer string        `xml:"manufacturer"`
+	ModelName    string        `xml:"modelName"`
+	UDN          string        `xml:"UDN"`
+	Services     []upnpService `xml:"serviceList>service"`
+}
+
+type upnpDeviceDescription struct {
+	XMLName xml.Name   `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	Major   int        `xml:"specVersion>major"`
+	Minor   int        `xml:"specVersion>minor"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// DeviceDescriptionHandler returns the root device description.
+func (u *UPnPServer) DeviceDescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	desc := upnpDeviceDescription{
+		Major: 1,
+		Minor: 0,
+		Device: upnpDevice{
+			DeviceType:   upnpMediaServerType,
+			FriendlyName: u.cfg.FriendlyName,
+			Manufacturer: "Bsimp",
+			ModelName:    "Bsimp",
+			UDN:          "uuid:" + u.uuid,
+			Services: []upnpService{
+				{
+					ServiceType: upnpContentDirectoryType,
+					ServiceID:   "urn:upnp-org:serviceId:ContentDirectory",
+					SCPDURL:     u.basePath + "/upnp/ContentDirectory.xml",
+					ControlURL:  u.basePath + "/upnp/control/ContentDirectory",
+					EventSubURL: u.basePath + "/upnp/event/ContentDirectory",
+				},
+				{
+					ServiceType: upnpConnectionManagerType,
+					ServiceID:   "urn:upnp-org:serviceId:ConnectionManager",
+					SCPDURL:     u.basePath + "/upnp/ConnectionManager.xml",
+					ControlURL:  u.basePath + "/upnp/control/ConnectionManager",
+					EventSubURL: u.basePath + "/upnp/event/ConnectionManager",
+				},
+			},
+		},
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(desc); err != nil {
+		httpError(r, w, err, http.StatusInternalServerError)
+	}
+}
+
+// EventSubscriptionHandler accepts event subscriptions. The library doesn't track changes, so no events are ever sent.
+func EventSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			sid = "uuid:" + defaultUPnPUUID(r.RemoteAddr+r.Header.Get("Callback"))
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-1800")
+	case "UNSUBSCRIBE":
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// soapAction is a parsed SOAP action request.
+type soapAction struct {
+	Name string
+	Args map[string]string
+}
+
+// parseSOAPAction reads the action name and arguments from a SOAP envelope.
+func parseSOAPAction(r io.Reader) (*soapAction, error) {
+	dec := xml.NewDecoder(r)
+	var action *soapAction
+	var arg string
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch depth {
+			case 3:
+				// Envelope > Body > Action.
+				action = &soapAction{Name: t.Name.Local, Args: make(map[string]string)}
+			case 4:
+				if action != nil {
+					arg = t.Name.Local
+					action.Args[arg] = ""
+				}
+			}
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 4 && action != nil {
+				action.Args[arg] += string(t)
+			}
+		}
+	}
+	if action == nil {
+		return nil, errors.New("soap action not found")
+	}
+	return action, nil
+}
+
+// writeSOAPResponse writes a successful action response. Arguments are written in the given order.
+func writeSOAPResponse(w http.ResponseWriter, serviceType string, action string, args ...string) {
+	var body strings.Builder
+	body.WriteString(xml.Header)
+	body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%sResponse xmlns:u="%s">`, action, serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, `</u:%sResponse></s:Body></s:Envelope>`, action)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	io.WriteString(w, body.String())
+}
+
+// writeSOAPFault writes a UPnP error as a SOAP fault.
+func writeSOAPFault(r *http.Request, w http.ResponseWriter, err error) {
+	var upnpErr *UPnPError
+	if !errors.As(err, &upnpErr) {
+		upnpErr = &UPnPError{Code: 501, Description: "Action Failed"}
+	}
+	slog.Error("failed UPnP action",
+		slog.Any("err", err),
+		slog.String("url", r.URL.String()),
+	)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, xml.Header+`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, upnpErr.Code, upnpErr.Description)
+}
+
+// ConnectionManagerHandler handles ConnectionManager actions. Only the default connection is supported.
+func (u *UPnPServer) ConnectionManagerHandler(w http.ResponseWriter, r *http.Request) {
+	action, err := parseSOAPAction(r.Body)
+	if err != nil {
+		writeSOAPFault(r, w, errUPnPInvalidAction)
+		return
+	}
+	switch action.Name {
+	case "GetProtocolInfo":
+		var source []string
+		for _, ct := range audioContentTypes {
+			source = append(source, "http-get:*:"+ct+":*")
+		}
+		writeSOAPResponse(w, upnpConnectionManagerType, action.Name,
+			"Source", strings.Join(source, ","),
+			"Sink", "")
+	case "GetCurrentConnectionIDs":
+		writeSOAPResponse(w, upnpConnectionManagerType, action.Name, "ConnectionIDs", "0")
+	case "GetCurrentConnectionInfo":
+		if action.Args["ConnectionID"] != "0" {
+			writeSOAPFault(r, w, &UPnPError{Code: 706, Description: "Invalid connection reference"})
+			return
+		}
+		writeSOAPResponse(w, upnpConnectionManagerType, action.Name,
+			"RcsID", "-1",
+			"AVTransportID", "-1",
+			"ProtocolInfo", "",
+			"PeerConnectionManager", "",
+			"PeerConnectionID", "-1",
+			"Direction", "Output",
+			"Status", "OK")
+	default:
+		writeSOAPFault(r, w, errUPnPInvalidAction)
+	}
+}
+
+// ContentDirectoryHandler handles ContentDirectory actions.
+func (u *UPnPServer) ContentDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	action, err := parseSOAPAction(r.Body)
+	if err != nil {
+		writeSOAPFault(r, w, errUPnPInvalidAction)
+		return
+	}
+	switch action.Name {
+	case "GetSearchCapabilities":
+		writeSOAPResponse(w, upnpContentDirectoryType, action.Name, "SearchCaps", "dc:title,upnp:class")
+	case "GetSortCapabilities":
+		writeSOAPResponse(w, upnpContentDirectoryType, action.Name, "SortCaps", "")
+	case "GetSystemUpdateID":
+		writeSOAPResponse(w, upnpContentDirectoryType, action.Name, "Id", "0")
+	case "Browse", "Search":
+		var objects []didlObject
+		var total int
+		start, count, err := parsePagination(action.Args)
+		if err == nil {
+			if action.Name == "Browse" {
+				objects, total, err = u.browse(r.Context(), action.Args["ObjectID"], action.Args["BrowseFlag"], start, count)
+			} else {
+				objects, total, err = u.search(r.Context(), action.Args["ContainerID"], action.Args["SearchCriteria"], start, count)
+			}
+		}
+		if err != nil {
+			writeSOAPFault(r, w, err)
+			return
+		}
+		baseURL := requestBaseURL(r)
+		baseURL.Path = u.basePath
+		result, err := marshalDIDL(objects, baseURL)
+		if err != nil {
+			writeSOAPFault(r, w, err)
+			return
+		}
+		writeSOAPResponse(w, upnpContentDirectoryType, action.Name,
+			"Result", result,
+			"NumberReturned", strconv.Itoa(len(objects)),
+			"TotalMatches", strconv.Itoa(total),
+			"UpdateID", "0")
+	default:
+		writeSOAPFault(r, w, errUPnPInvalidAction)
+	}
+}
+
+func parsePagination(args map[string]string) (int, int, error) {
+	start, err := strconv.Atoi(defaultString(args["StartingIndex"], "0"))
+	if err != nil || start < 0 {
+		return 0, 0, errUPnPInvalidArgs
+	}
+	count, err := strconv.Atoi(defaultString(args["RequestedCount"], "0"))
+	if err != nil || count < 0 {
+		return 0, 0, errUPnPInvalidArgs
+	}
+	return start, count, nil
+}
+
+// paginate returns a page of objects. Zero count means all objects.
+func paginate(objects []didlObject, start int, count int) []didlObject {
+	if start >= len(objects) {
+		return nil
+	}
+	objects = objects[start:]
+	if count > 0 && count < len(objects) {
+		objects = objects[:count]
+	}
+	return objects
+}
+
+// objectPath converts a UPnP object ID to a library path.
+func objectPath(id string) (string, error) {
+	if id == upnpRootID {
+		return "", nil
+	}
+	if id == "" || !isValidPath(id) {
+		return "", errUPnPNoSuchObject
+	}
+	return id, nil
+}
+
+// objectID converts a library path to a UPnP object ID.
+func objectID(p string) string {
+	if p == "" {
+		return upnpRootID
+	}
+	return p
+}
+
+func parentID(p string) string {
+	if p == "" {
+		return "-1"
+	}
+	dir := path.Dir(p)
+	if dir == "." {
+		return upnpRootID
+	}
+	return dir
+}
+
+// didlObject is either a container (directory) or an item (audio track).
+type didlObject struct {
+	Dir   *StorageDirectory
+	File  *StorageFile
+	Cover *StorageFile
+}
+
+func (u *UPnPServer) browse(ctx context.Context, id string, flag string, start int, count int) ([]didlObject, int, error) {
+	p, err := objectPath(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	mediaLib := u.mediaLib.Load().WithContext(ctx)
+	switch flag {
+	case "BrowseMetadata":
+		if _, err := mediaLib.List(p); err == nil {
+			return []didlObject{{Dir: NewStorageDirectory(p)}}, 1, nil
+		}
+		tracks, err := mediaLib.AudioTracks(p)
+		if err != nil || len(tracks) != 1 || tracks[0].Path() != p {
+			return nil, 0, errUPnPNoSuchObject
+		}
+		return []didlObject{{File: tracks[0]}}, 1, nil
+	case "BrowseDirectChildren":
+		listing, err := mediaLib.List(p)
+		if err != nil {
+			return nil, 0, errUPnPNoSuchObject
+		}
+		var objects []didlObject
+		for _, dir := range listing.Directories {
+			objects = append(objects, didlObject{Dir: dir})
+		}
+		for _, track := range listing.AudioTracks {
+			objects = append(objects, didlObject{File: track, Cover: listing.Cover})
+		}
+		return paginate(objects, start, count), len(objects), nil
+	}
+	return nil, 0, errUPnPInvalidArgs
+}
+
+func (u *UPnPServer) search(ctx context.Context, id string, criteria string, start int, count int) ([]didlObject, int, error) {
+	p, err := objectPath(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	match, err := parseSearchCriteria(criteria)
+	if err != nil {
+		return nil, 0, err
+	}
+	mediaLib := u.mediaLib.Load().WithContext(ctx)
+	var objects []didlObject
+	visited := 0
+	var walk func(p string) error
+	walk = func(p string) error {
+		visited++
+		if visited > u.maxSearchDirectories {
+			return errUPnPSearchLimit
+		}
+		dirs, files, err := mediaLib.store.List(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if len(objects) >= upnpMaxSearchResults {
+				return nil
+			}
+			obj := didlObject{File: f}
+			if mediaLib.media.IsAudioFile(f) && match(obj) {
+				objects = append(objects, obj)
+			}
+		}
+		for _, dir := range dirs {
+			if len(objects) >= upnpMaxSearchResults {
+				return nil
+			}
+			obj := didlObject{Dir: dir}
+			if match(obj) {
+				objects = append(objects, obj)
+			}
+			if err := walk(dir.Path()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(p); err != nil {
+		if errors.Is(err, errUPnPSearchLimit) {
+			return nil, 0, err
+		}
+		return nil, 0, errUPnPNoSuchObject
+	}
+	return paginate(objects, start, count), len(objects), nil
+}
+
+func (o didlObject) title() string {
+	if o.Dir != nil {
+		return defaultString(o.Dir.Name(), "Music")
+	}
+	return o.File.FriendlyName()
+}
+
+func (o didlObject) class() string {
+	if o.Dir != nil {
+		return "object.container.storageFolder"
+	}
+	return "object.item.audioItem.musicTrack"
+}
+
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Size         int64  `xml:"size,attr,omitempty"`
+	URL          string `xml:",chardata"`
+}
+
+type didlElement struct {
+	ID          string   `xml:"id,attr"`
+	ParentID    string   `xml:"parentID,attr"`
+	Restricted  string   `xml:"restricted,attr"`
+	Searchable  string   `xml:"searchable,attr,omitempty"`
+	Title       string   `xml:"dc:title"`
+	Class       string   `xml:"upnp:class"`
+	AlbumArtURI string   `xml:"upnp:albumArtURI,omitempty"`
+	Res         *didlRes `xml:"res,omitempty"`
+}
+
+type didlLite struct {
+	XMLName    xml.Name      `xml:"DIDL-Lite"`
+	Xmlns      string        `xml:"xmlns,attr"`
+	XmlnsDC    string        `xml:"xmlns:dc,attr"`
+	XmlnsUPnP  string        `xml:"xmlns:upnp,attr"`
+	Containers []didlElement `xml:"container"`
+	Items      []didlElement `xml:"item"`
+}
+
+// marshalDIDL returns DIDL-Lite XML describing the objects. Items point to the stream handler.
+func marshalDIDL(objects []didlObject, baseURL *url.URL) (string, error) {
+	didl := didlLite{
+		Xmlns:     "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/",
+		XmlnsDC:   "http://purl.org/dc/elements/1.1/",
+		XmlnsUPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/",
+	}
+	for _, o := range objects {
+		if o.Dir != nil {
+			didl.Containers = append(didl.Containers, didlElement{
+				ID:         objectID(o.Dir.Path()),
+				ParentID:   parentID(o.Dir.Path()),
+				Restricted: "1",
+				Searchable: "1",
+				Title:      o.title(),
+				Class:      o.class(),
+			})
+			continue
+		}
+		item := didlElement{
+			ID:         objectID(o.File.Path()),
+			ParentID:   parentID(o.File.Path()),
+			Restricted: "1",
+			Title:      o.title(),
+			Class:      o.class(),
+			Res: &didlRes{
+				ProtocolInfo: "http-get:*:" + audioContentType(o.File) + ":*",
+				Size:         o.File.Size,
+				URL:          absoluteURL(baseURL, "/stream/", o.File.Path()),
+			},
+		}
+		if o.Cover != nil {
+			item.AlbumArtURI = absoluteURL(baseURL, "/stream/", o.Cover.Path())
+		}
+		didl.Items = append(didl.Items, item)
+	}
+	out, err := xml.Marshal(didl)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+)
+
+// searchMatcher reports whether an object matches the search criteria.
+type searchMatcher func(o didlObject) bool
+
+// searchProperty returns the value of a DIDL-Lite property. Only properties derived from file names are known.
+func searchProperty(o didlObject, property string) (string, bool) {
+	switch property {
+	case "dc:title":
+		return o.title(), true
+	case "upnp:class":
+		return o.class(), true
+	}
+	return "", false
+}
+
+// tokenizeSearchCriteria splits criteria into parentheses, quoted values and words.
+func tokenizeSearchCriteria(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			var val strings.Builder
+			val.WriteByte('"')
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				val.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errUPnPBadCriteria
+			}
+			i++
+			tokens = append(tokens, val.String())
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r()\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type searchParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *searchParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	return tok
+}
+
+func (p *searchParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// parseOr parses expressions joined with "or", which binds weaker than "and".
+func (p *searchParser) parseOr() (searchMatcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(o didlObject) bool { return l(o) || right(o) }
+	}
+	return left, nil
+}
+
+func (p *searchParser) parseAnd() (searchMatcher, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(o didlObject) bool { return l(o) && right(o) }
+	}
+	return left, nil
+}
+
+func (p *searchParser) parseTerm() (searchMatcher, error) {
+	if p.peek() == "(" {
+		p.next()
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errUPnPBadCriteria
+		}
+		return m, nil
+	}
+	property := p.next()
+	op := p.next()
+	val := p.next()
+	if property == "" || op == "" || val == "" {
+		return nil, errUPnPBadCriteria
+	}
+	if strings.EqualFold(op, "exists") {
+		want := strings.EqualFold(val, "true")
+		return func(o didlObject) bool {
+			_, ok := searchProperty(o, property)
+			return ok == want
+		}, nil
+	}
+	if !strings.HasPrefix(val, `"`) {
+		return nil, errUPnPBadCriteria
+	}
+	val = strings.ToLower(val[1:])
+	var cmp func(actual string) bool
+	switch strings.ToLower(op) {
+	case "=":
+		cmp = func(actual string) bool { return actual == val }
+	case "!=":
+		cmp = func(actual string) bool { return actual != val }
+	case "<":
+		cmp = func(actual string) bool { return actual < val }
+	case "<=":
+		cmp = func(actual string) bool { return actual <= val }
+	case ">":
+		cmp = func(actual string) bool { return actual > val }
+	case ">=":
+		cmp = func(actual string) bool { return actual >= val }
+	case "contains":
+		cmp = func(actual string) bool { return strings.Contains(actual, val) }
+	case "doesnotcontain":
+		cmp = func(actual string) bool { return !strings.Contains(actual, val) }
+	case "derivedfrom":
+		cmp = func(actual string) bool { return actual == val || strings.HasPrefix(actual, val+".") }
+	default:
+		return nil, errUPnPBadCriteria
+	}
+	return func(o didlObject) bool {
+		actual, ok := searchProperty(o, property)
+		return ok && cmp(strings.ToLower(actual))
+	}, nil
+}
+
+// parseSearchCriteria parses ContentDirectory search criteria. Unknown properties never match.
+func parseSearchCriteria(criteria string) (searchMatcher, error) {
+	criteria = strings.TrimSpace(criteria)
+	if criteria == "*" || criteria == "" {
+		return func(didlObject) bool { return true }, nil
+	}
+	tokens, err := tokenizeSearchCriteria(criteria)
+	if err != nil {
+		return nil, err
+	}
+	p := &searchParser{tokens: tokens}
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errUPnPBadCriteria
+	}
+	return m, nil
+}
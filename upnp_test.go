@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSearchCriteria(t *testing.T) {
+	track := didlObject{File: NewStorageFile("a/01 Windowlicker.mp3", 1)}
+	dir := didlObject{Dir: NewStorageDirectory("a/Windowlicker")}
+
+	testCases := []struct {
+		criteria string
+		track    bool
+		dir      bool
+	}{
+		{`*`, true, true},
+		{`upnp:class derivedfrom "object.item.audioItem"`, true, false},
+		{`upnp:class derivedfrom "object.container"`, false, true},
+		{`upnp:class = "object.container.storageFolder"`, false, true},
+		{`dc:title contains "window"`, true, true},
+		{`dc:title contains "Xtal"`, false, false},
+		{`dc:title doesNotContain "01"`, false, true},
+		{`upnp:class derivedfrom "object.item.audioItem" and dc:title contains "window"`, true, false},
+		{`(upnp:class derivedfrom "object.item" and (dc:title contains "xtal" or upnp:artist contains "window"))`, false, false},
+		{`dc:title contains "xtal" or dc:title = "windowlicker"`, false, true},
+		{`upnp:artist exists true`, false, false},
+		{`dc:title exists true`, true, true},
+		{`dc:title contains "\"quoted\""`, false, false},
+	}
+	for _, tc := range testCases {
+		match, err := parseSearchCriteria(tc.criteria)
+		if assert.NoError(t, err, tc.criteria) {
+			assert.Equal(t, tc.track, match(track), tc.criteria)
+			assert.Equal(t, tc.dir, match(dir), tc.criteria)
+		}
+	}
+
+	for _, criteria := range []string{
+		`dc:title contains`,
+		`dc:title contains "a`,
+		`dc:title like "a"`,
+		`(dc:title contains "a"`,
+		`dc:title contains "a" dc:title`,
+		`dc:title contains a`,
+	} {
+		_, err := parseSearchCriteria(criteria)
+		assert.ErrorIs(t, err, errUPnPBadCriteria, criteria)
+	}
+}
+
+type didlResult struct {
+	Containers []struct {
+		ID       string `xml:"id,attr"`
+		ParentID string `xml:"parentID,attr"`
+		Title    string `xml:"title"`
+	} `xml:"container"`
+	Items []struct {
+		ID       string `xml:"id,attr"`
+		ParentID string `xml:"parentID,attr"`
+		Title    string `xml:"title"`
+		Res      string `xml:"res"`
+		AlbumArt string `xml:"albumArtURI"`
+	} `xml:"item"`
+}
+
+type soapResult struct {
+	Body struct {
+		Response struct {
+			Result         string
+			NumberReturned int
+			TotalMatches   int
+		} `xml:",any"`
+		ErrorCode int `xml:"Fault>detail>UPnPError>errorCode"`
+	}
+}
+
+// callContentDirectory calls a ContentDirectory action and decodes the response and the DIDL-Lite result.
+func callContentDirectory(t *testing.T, baseURL string, action string, args string) (*soapResult, *didlResult) {
+	t.Helper()
+	body := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+		`<u:` + action + ` xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1">` + args + `</u:` + action + `>` +
+		`</s:Body></s:Envelope>`
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/upnp/control/ContentDirectory", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("SOAPAction", `"urn:schemas-upnp-org:service:ContentDirectory:1#`+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	res := &soapResult{}
+	assert.NoError(t, xml.NewDecoder(resp.Body).Decode(res))
+	didl := &didlResult{}
+	if res.Body.Response.Result != "" {
+		assert.NoError(t, xml.Unmarshal([]byte(res.Body.Response.Result), didl))
+	}
+	return res, didl
+}
+
+func TestUPnPServer_ContentDirectory(t *testing.T) {
+	asrt := assert.New(t)
+
+	storage := newTestStorage(t, "test",
+		"Aphex Twin/Windowlicker/01 Windowlicker.mp3",
+		"Aphex Twin/Windowlicker/02 Equation.mp3",
+		"Aphex Twin/Windowlicker/cover.jpg",
+		"Aphex Twin/Xtal.mp3",
+	)
+
+	u, err := NewUPnPServer(UPnPConfig{UUID: "1234"}, NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{}), &url.URL{Scheme: "http", Host: ":8080"})
+	asrt.NoError(err)
+	mux := http.NewServeMux()
+	u.RegisterHandlers(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	call := func(action string, args string) (*soapResult, *didlResult) {
+		t.Helper()
+		return callContentDirectory(t, ts.URL, action, args)
+	}
+
+	res, didl := call("Browse", `<ObjectID>0</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag><StartingIndex>0</StartingIndex><RequestedCount>0</RequestedCount>`)
+	asrt.Equal(1, res.Body.Response.TotalMatches)
+	if asrt.Len(didl.Containers, 1) {
+		asrt.Equal("Aphex Twin", didl.Containers[0].ID)
+		asrt.Equal("0", didl.Containers[0].ParentID)
+	}
+
+	res, didl = call("Browse", `<ObjectID>Aphex Twin/Windowlicker</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag><StartingIndex>1</StartingIndex><RequestedCount>5</RequestedCount>`)
+	asrt.Equal(2, res.Body.Response.TotalMatches)
+	asrt.Equal(1, res.Body.Response.NumberReturned)
+	if asrt.Len(didl.Items, 1) {
+		item := didl.Items[0]
+		asrt.Equal("Aphex Twin/Windowlicker/02 Equation.mp3", item.ID)
+		asrt.Equal("Aphex Twin/Windowlicker", item.ParentID)
+		asrt.Equal("02 Equation", item.Title)
+		asrt.Equal(ts.URL+"/stream/Aphex%20Twin/Windowlicker/02%20Equation.mp3", item.Res)
+		asrt.Equal(ts.URL+"/stream/Aphex%20Twin/Windowlicker/cover.jpg", item.AlbumArt)
+	}
+
+	res, didl = call("Browse", `<ObjectID>Aphex Twin/Xtal.mp3</ObjectID><BrowseFlag>BrowseMetadata</BrowseFlag>`)
+	asrt.Equal(1, res.Body.Response.TotalMatches)
+	if asrt.Len(didl.Items, 1) {
+		asrt.Equal("Aphex Twin", didl.Items[0].ParentID)
+	}
+
+	res, _ = call("Browse", `<ObjectID>Missing</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag>`)
+	asrt.Equal(701, res.Body.ErrorCode)
+
+	res, didl = call("Search", `<ContainerID>0</ContainerID><SearchCriteria>upnp:class derivedfrom "object.item.audioItem" and dc:title contains "w"</SearchCriteria>`)
+	asrt.Equal(1, res.Body.Response.TotalMatches)
+	if asrt.Len(didl.Items, 1) {
+		asrt.Equal("Aphex Twin/Windowlicker/01 Windowlicker.mp3", didl.Items[0].ID)
+	}
+
+	res, _ = call("Search", `<ContainerID>0</ContainerID><SearchCriteria>dc:title ~ "w"</SearchCriteria>`)
+	asrt.Equal(708, res.Body.ErrorCode)
+
+	resp, err := http.Get(ts.URL + "/upnp/device.xml")
+	asrt.NoError(err)
+	desc, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	asrt.NoError(err)
+	asrt.Contains(string(desc), "<UDN>uuid:1234</UDN>")
+	asrt.Contains(string(desc), "<friendlyName>Bsimp</friendlyName>")
+}
+
+func TestUPnPServer_SearchLimit(t *testing.T) {
+	storage := newTestStorage(t, "test", "a/b/c/d/e/1.mp3", "a/b/c/d/e/2.mp3", "f/g/h/3.mp3")
+
+	u, err := NewUPnPServer(UPnPConfig{UUID: "1234"}, NewMediaLibrary(storage, newTestMediaDetector(t), AudiobooksConfig{}), &url.URL{Scheme: "http", Host: ":8080"})
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	u.RegisterHandlers(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// A search matching nothing visits every directory.
+	search := `<ContainerID>0</ContainerID><SearchCriteria>dc:title contains "missing"</SearchCriteria>`
+	res, _ := callContentDirectory(t, ts.URL, "Search", search)
+	assert.Equal(t, 0, res.Body.ErrorCode)
+	assert.Equal(t, 0, res.Body.Response.TotalMatches)
+
+	u.maxSearchDirectories = 5
+	res, _ = callContentDirectory(t, ts.URL, "Search", search)
+	assert.Equal(t, 720, res.Body.ErrorCode)
+
+	// Searching a subtree stays within the limit.
+	res, _ = callContentDirectory(t, ts.URL, "Search", `<ContainerID>f</ContainerID><SearchCriteria>dc:title contains "3"</SearchCriteria>`)
+	assert.Equal(t, 0, res.Body.ErrorCode)
+	assert.Equal(t, 1, res.Body.Response.TotalMatches)
+}